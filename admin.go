@@ -0,0 +1,640 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group administration is reserved to the teacher or parent holding the admin PIN
+// of the group. The secret_key only proves membership: it is shared as the invite
+// link. The PIN is stored as a salted PBKDF2 hash and sent in the X-Admin-PIN header.
+
+const (
+	adminPinHeader     = "X-Admin-PIN"
+	adminPinMinLength  = 4
+	adminPinIterations = 100000
+	// Wrong PINs allowed per client and group within adminLockoutDuration before the
+	// admin requests of the client are refused for adminLockoutDuration
+	adminMaxFailures     = 5
+	adminLockoutDuration = time.Minute
+	// Wrong PINs allowed per group, from every client, within adminLockoutDuration
+	// before the admin requests of the whole group are refused. Behind a trusted
+	// proxy clients choose their X-Forwarded-For, so the per-client limit alone does
+	// not bound the guessing rate.
+	adminMaxGroupFailures = 20
+)
+
+var (
+	errAdminPinNotSet = errors.New("admin PIN not set for this group")
+	errInvalidPin     = errors.New("invalid admin PIN")
+)
+
+// initAdminTables adds the admin PIN hash to the groups table
+func initAdminTables(tx *Tx) error {
+	_, err := addColumnIfMissing(tx, "groups", "admin_pin_hash", "TEXT")
+	return err
+}
+
+// hashAdminPin returns the stored form of a PIN: iterations$salt$hash
+func hashAdminPin(pin string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, pin, salt, adminPinIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d$%s$%s", adminPinIterations, hex.EncodeToString(salt), hex.EncodeToString(key)), nil
+}
+
+// checkAdminPin reports whether a PIN matches a stored hash
+func checkAdminPin(pin, stored string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, pin, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// validAdminPin checks the length of a new PIN or passphrase
+func validAdminPin(pin string) bool {
+	return len([]rune(pin)) >= adminPinMinLength
+}
+
+// adminClient identifies the PIN attempts of a client on a group
+type adminClient struct {
+	groupID int64
+	address string
+}
+
+// adminAttempts tracks the wrong PINs of a client or a group
+type adminAttempts struct {
+	failures     int
+	firstFailure time.Time
+	lockedUntil  time.Time
+}
+
+// fail counts a wrong PIN and reports whether it reaches max within
+// adminLockoutDuration of the first one, which locks the attempts out
+func (a *adminAttempts) fail(now time.Time, max int) bool {
+	if now.Sub(a.firstFailure) >= adminLockoutDuration {
+		a.failures = 0
+		a.firstFailure = now
+	}
+	a.failures++
+	if a.failures < max {
+		return false
+	}
+	a.lockedUntil = now.Add(adminLockoutDuration)
+	a.failures = 0
+	return true
+}
+
+// locked reports whether the attempts are locked out at now
+func (a *adminAttempts) locked(now time.Time) bool {
+	return a != nil && now.Before(a.lockedUntil)
+}
+
+// expired reports whether the attempts no longer count at now
+func (a *adminAttempts) expired(now time.Time) bool {
+	return !a.locked(now) && now.Sub(a.firstFailure) >= adminLockoutDuration
+}
+
+// adminFailures counts the wrong PINs each client sends for a group, to slow down
+// guessing. A client reaching adminMaxFailures is locked out alone: the teacher
+// keeps access. A group reaching adminMaxGroupFailures is locked out for everyone.
+var adminFailures = struct {
+	sync.Mutex
+	clients   map[adminClient]*adminAttempts
+	groups    map[int64]*adminAttempts
+	lastPrune time.Time
+}{clients: map[adminClient]*adminAttempts{}, groups: map[int64]*adminAttempts{}}
+
+// pruneAdminFailures drops the expired attempts, at most once per adminLockoutDuration.
+// The caller holds adminFailures.
+func pruneAdminFailures(now time.Time) {
+	if now.Sub(adminFailures.lastPrune) < adminLockoutDuration {
+		return
+	}
+	adminFailures.lastPrune = now
+	maps.DeleteFunc(adminFailures.clients, func(_ adminClient, a *adminAttempts) bool { return a.expired(now) })
+	maps.DeleteFunc(adminFailures.groups, func(_ int64, a *adminAttempts) bool { return a.expired(now) })
+}
+
+// clientAddress returns the address of the client of a request: the first address
+// of X-Forwarded-For behind a trusted proxy, the peer address otherwise
+func clientAddress(r *http.Request) string {
+	if config.HTTPConfig.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// adminLocked reports whether the admin requests of a client are temporarily refused
+func adminLocked(client adminClient) bool {
+	adminFailures.Lock()
+	defer adminFailures.Unlock()
+	now := time.Now()
+	pruneAdminFailures(now)
+	return adminFailures.clients[client].locked(now) || adminFailures.groups[client.groupID].locked(now)
+}
+
+// recordAdminAttempt updates the failure counts of a client and its group after a PIN check
+func recordAdminAttempt(client adminClient, ok bool) {
+	adminFailures.Lock()
+	defer adminFailures.Unlock()
+	if ok {
+		delete(adminFailures.clients, client)
+		return
+	}
+	now := time.Now()
+	attempts := adminFailures.clients[client]
+	if attempts == nil {
+		attempts = &adminAttempts{}
+		adminFailures.clients[client] = attempts
+	}
+	if attempts.fail(now, adminMaxFailures) {
+		slog.Warn("Too many wrong admin PINs, client locked out", "group_id", client.groupID, "address", client.address)
+	}
+	group := adminFailures.groups[client.groupID]
+	if group == nil {
+		group = &adminAttempts{}
+		adminFailures.groups[client.groupID] = group
+	}
+	if group.fail(now, adminMaxGroupFailures) {
+		slog.Warn("Too many wrong admin PINs, group locked out", "group_id", client.groupID)
+	}
+}
+
+// verifyGroupAdmin checks the admin PIN sent by a client against the group's hash
+func verifyGroupAdmin(client adminClient, pin string) error {
+	groupID := client.groupID
+	hash, err := store.GroupAdminPinHash(groupID)
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return errAdminPinNotSet
+	}
+	ok := pin != "" && checkAdminPin(pin, hash)
+	recordAdminAttempt(client, ok)
+	if !ok {
+		return errInvalidPin
+	}
+	return nil
+}
+
+// requireGroupAdmin wraps a handler of a /api/groups/{id}/... route so that it only
+// runs for requests carrying the admin PIN of the group
+func requireGroupAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groupID, ok := groupIDFromPath(w, r)
+		if !ok {
+			return
+		}
+		client := adminClient{groupID: groupID, address: clientAddress(r)}
+		if adminLocked(client) {
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "too many wrong PINs, try again later")
+			return
+		}
+
+		switch err := verifyGroupAdmin(client, r.Header.Get(adminPinHeader)); err {
+		case nil:
+			handler(w, r)
+		case errGroupNotFound:
+			writeError(w, http.StatusNotFound, codeNotFound, "group not found")
+		case errAdminPinNotSet:
+			writeError(w, http.StatusForbidden, codeForbidden, err.Error())
+		case errInvalidPin:
+			slog.Warn("Rejected admin request", "group_id", groupID, "path", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+		default:
+			slog.Error("Failed to check admin PIN", "error", err)
+			writeDatabaseError(w)
+		}
+	}
+}
+
+type adminPinRequest struct {
+	Pin string `json:"pin"`
+}
+
+// PUT /api/groups/{id}/admin-pin - Set or change the admin PIN of a group.
+// Changing the PIN requires the current one. The secret_key is shared with every
+// member, so only the server admin sets the first PIN of a group created without one.
+func setAdminPin(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req adminPinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if !validAdminPin(req.Pin) {
+		writeFieldError(w, codeInvalidField, "pin", fmt.Sprintf("pin must have at least %d characters", adminPinMinLength))
+		return
+	}
+
+	hash, err := store.GroupAdminPinHash(groupID)
+	if err == errGroupNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to get group", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	if hash != "" {
+		requireGroupAdmin(func(w http.ResponseWriter, r *http.Request) {
+			updateAdminPin(w, groupID, req.Pin)
+		})(w, r)
+		return
+	}
+
+	if !isServerAdmin(r) {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "server admin token required to set the first admin PIN")
+		return
+	}
+	updateAdminPin(w, groupID, req.Pin)
+}
+
+// updateAdminPin stores a new admin PIN for a group
+func updateAdminPin(w http.ResponseWriter, groupID int64, pin string) {
+	hash, err := hashAdminPin(pin)
+	if err != nil {
+		slog.Error("Failed to hash admin PIN", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+	if err := store.SetGroupAdminPinHash(groupID, hash); err != nil {
+		slog.Error("Failed to update admin PIN", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("Admin PIN updated", "group_id", groupID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// writeGroup sends a group as the response, after an admin change
+func writeGroup(w http.ResponseWriter, groupID int64) {
+	group, err := store.GroupByID(groupID)
+	if err != nil {
+		slog.Error("Failed to get group", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	group.Token = groupToken(group.ID, group.SecretKey)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+type updateGroupRequest struct {
+	Name *string `json:"name"`
+	// Timezone of the streaks, "" for the server default
+	Timezone *string `json:"timezone"`
+	// LeaderboardStrategy of /api/scores, "" for the server default
+	LeaderboardStrategy *string `json:"leaderboard_strategy"`
+}
+
+// PATCH /api/groups/{id} - Rename a group, change its timezone or leaderboard strategy (admin)
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+
+	var req updateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if req.Name == nil && req.Timezone == nil && req.LeaderboardStrategy == nil {
+		writeFieldError(w, codeMissingField, "name", "name, timezone or leaderboard_strategy required")
+		return
+	}
+	var name, timezone, strategy string
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" {
+			writeFieldError(w, codeMissingField, "name", "name required")
+			return
+		}
+	}
+	if req.Timezone != nil {
+		timezone = strings.TrimSpace(*req.Timezone)
+		if timezone != "" {
+			if err := validateTimezone(timezone); err != nil {
+				writeAPIError(w, err)
+				return
+			}
+		}
+	}
+	if req.LeaderboardStrategy != nil {
+		strategy = strings.TrimSpace(*req.LeaderboardStrategy)
+		if strategy != "" {
+			if err := validateLeaderboardStrategy(strategy); err != nil {
+				err.Field = "leaderboard_strategy"
+				writeAPIError(w, err)
+				return
+			}
+		}
+	}
+
+	if req.Name != nil {
+		if err := store.RenameGroup(groupID, name); err != nil {
+			slog.Error("Failed to rename group", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		slog.Info("Group renamed", "id", groupID, "name", name)
+	}
+	if req.Timezone != nil {
+		if err := store.SetGroupTimezone(groupID, timezone); err != nil {
+			slog.Error("Failed to set group timezone", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		slog.Info("Group timezone changed", "id", groupID, "timezone", timezone)
+	}
+	if req.LeaderboardStrategy != nil {
+		if err := store.SetGroupLeaderboardStrategy(groupID, strategy); err != nil {
+			slog.Error("Failed to set group leaderboard strategy", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		slog.Info("Group leaderboard strategy changed", "id", groupID, "strategy", strategy)
+	}
+	writeGroup(w, groupID)
+}
+
+// POST /api/groups/{id}/rotate-key - Replace the secret_key, invalidating the old invite link (admin)
+func rotateGroupKey(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+
+	secretKey, err := generateSecretKey()
+	if err != nil {
+		slog.Error("Failed to generate secret key", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+	if err := store.SetGroupSecretKey(groupID, secretKey); err != nil {
+		slog.Error("Failed to rotate secret key", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("Group secret key rotated", "id", groupID)
+	writeGroup(w, groupID)
+}
+
+// groupUserFromPath loads the {userID} member of the {id} group of the route
+func groupUserFromPath(w http.ResponseWriter, r *http.Request, param string) *User {
+	groupID, ok := groupIDFromPath(w, r)
+	if !ok {
+		return nil
+	}
+	userID, err := strconv.ParseInt(r.PathValue(param), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, param, "invalid user id")
+		return nil
+	}
+
+	user, err := loadUser(userID)
+	if err == errUserNotFound || (err == nil && user.GroupID != groupID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return nil
+	}
+	if err != nil {
+		slog.Error("Failed to load user", "error", err)
+		writeDatabaseError(w)
+		return nil
+	}
+	return user
+}
+
+// DELETE /api/groups/{id}/users/{userID} - Remove a pupil and all their records (admin)
+func deleteGroupUser(w http.ResponseWriter, r *http.Request) {
+	user := groupUserFromPath(w, r, "userID")
+	if user == nil {
+		return
+	}
+
+	if err := deleteUser(user); err != nil {
+		slog.Error("Failed to delete user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("User deleted", "id", user.ID, "group_id", user.GroupID, "name", user.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser removes a user and their records in every per-user table
+func deleteUser(user *User) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Session questions are only reachable through their session
+	_, err = tx.Exec(`DELETE FROM session_questions WHERE session_id IN (SELECT id FROM quiz_sessions WHERE user_id = ?)`, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, table := range append(userTables, "earned_badges") {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, user.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type mergeUserRequest struct {
+	IntoUserID int64 `json:"into_user_id"`
+}
+
+// POST /api/groups/{id}/users/{userID}/merge - Merge a pupil into another one of the group (admin).
+// The records of {userID} are moved to into_user_id, then {userID} is removed.
+func mergeGroupUser(w http.ResponseWriter, r *http.Request) {
+	source := groupUserFromPath(w, r, "userID")
+	if source == nil {
+		return
+	}
+
+	var req mergeUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if req.IntoUserID == source.ID {
+		writeFieldError(w, codeInvalidField, "into_user_id", "cannot merge a user into itself")
+		return
+	}
+
+	target, err := loadUser(req.IntoUserID)
+	if err == errUserNotFound || (err == nil && target.GroupID != source.GroupID) {
+		writeFieldError(w, codeInvalidField, "into_user_id", "into_user_id not found in group")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	if err := mergeUsers(source, target); err != nil {
+		slog.Error("Failed to merge users", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("Users merged", "from", source.ID, "into", target.ID, "group_id", target.GroupID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+// mergeUsers moves the records of source to target and removes source.
+// Rows unique per user are combined the same way as the legacy name migration.
+func mergeUsers(source, target *User) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`INSERT INTO user_errors (user_id, user_name, exercise_type, question, fact_key, error_count, last_error_date, group_id)
+		SELECT ?, ?, exercise_type, question, fact_key, error_count, last_error_date, group_id
+		FROM user_errors WHERE user_id = ?
+		ON CONFLICT(user_id, exercise_type, question) DO UPDATE SET
+			error_count = user_errors.error_count + excluded.error_count,
+			last_error_date = CASE WHEN excluded.last_error_date > user_errors.last_error_date
+				THEN excluded.last_error_date ELSE user_errors.last_error_date END`,
+		`INSERT INTO specialist_badges (user_id, user_name, exercise_type, table_number, consecutive_perfect, badge_earned, earned_at, group_id,
+			consecutive_failures, dimmed_at)
+		SELECT ?, ?, exercise_type, table_number, consecutive_perfect, badge_earned, earned_at, group_id,
+			consecutive_failures, dimmed_at
+		FROM specialist_badges WHERE user_id = ?
+		ON CONFLICT(user_id, exercise_type, table_number) DO UPDATE SET
+			consecutive_perfect = CASE WHEN excluded.consecutive_perfect > specialist_badges.consecutive_perfect
+				THEN excluded.consecutive_perfect ELSE specialist_badges.consecutive_perfect END,
+			badge_earned = CASE WHEN excluded.badge_earned > specialist_badges.badge_earned
+				THEN excluded.badge_earned ELSE specialist_badges.badge_earned END,
+			earned_at = COALESCE(specialist_badges.earned_at, excluded.earned_at)`,
+		`INSERT INTO review_schedule (user_id, user_name, exercise_type, fact_key, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id)
+		SELECT ?, ?, exercise_type, fact_key, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id
+		FROM review_schedule WHERE user_id = ?
+		ON CONFLICT(user_id, fact_key) DO UPDATE SET
+			exercise_type = excluded.exercise_type,
+			question = excluded.question,
+			ease = excluded.ease,
+			interval_days = excluded.interval_days,
+			repetitions = excluded.repetitions,
+			lapses = excluded.lapses,
+			due_at = excluded.due_at,
+			last_reviewed_at = excluded.last_reviewed_at
+		WHERE excluded.last_reviewed_at > review_schedule.last_reviewed_at`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, target.ID, target.Name, source.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range userTables {
+		switch table {
+		case "user_errors", "specialist_badges", "review_schedule":
+			_, err = tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, source.ID)
+		default:
+			_, err = tx.Exec(`UPDATE `+table+` SET user_id = ?, user_name = ? WHERE user_id = ?`, target.ID, target.Name, source.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// The target's badges are recomputed from the merged results
+	if _, err := tx.Exec(`DELETE FROM earned_badges WHERE user_id = ?`, source.ID); err != nil {
+		return err
+	}
+	if _, err := rebuildGroupBadges(tx, ledgerScope{UserID: &target.ID}); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, source.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DELETE /api/groups/{id}/attempts/{attemptID} - Delete an erroneous attempt from user_results (admin)
+func deleteGroupAttempt(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	attemptID, err := strconv.ParseInt(r.PathValue("attemptID"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "attemptID", "invalid attempt id")
+		return
+	}
+
+	deleted, err := store.DeleteResult(groupID, attemptID)
+	if err != nil {
+		slog.Error("Failed to delete attempt", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, codeNotFound, "attempt not found")
+		return
+	}
+
+	slog.Info("Attempt deleted", "id", attemptID, "group_id", groupID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAdminAttemptsAgeOut(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	a := &adminAttempts{}
+	for i := range adminMaxFailures - 1 {
+		if a.fail(start.Add(time.Duration(i)*time.Second), adminMaxFailures) {
+			t.Fatalf("locked out after %d failures", i+1)
+		}
+	}
+	// The next failure comes after the window of the first one: the count restarts
+	later := start.Add(adminLockoutDuration + time.Second)
+	if a.fail(later, adminMaxFailures) || a.failures != 1 {
+		t.Fatalf("failures = %d after the window, want 1", a.failures)
+	}
+	if a.expired(later) {
+		t.Error("attempts expired right after a failure")
+	}
+	if !a.expired(later.Add(adminLockoutDuration)) {
+		t.Error("attempts not expired a lockout duration after the last window")
+	}
+
+	for range adminMaxFailures - 1 {
+		a.fail(later, adminMaxFailures)
+	}
+	if !a.locked(later) {
+		t.Fatal("not locked out after adminMaxFailures failures in the window")
+	}
+	if a.expired(later) || !a.expired(later.Add(adminLockoutDuration)) {
+		t.Error("locked attempts must expire when the lockout ends")
+	}
+}
+
+func TestAdminGroupLockout(t *testing.T) {
+	t.Cleanup(func() {
+		adminFailures.Lock()
+		clear(adminFailures.clients)
+		clear(adminFailures.groups)
+		adminFailures.Unlock()
+	})
+	teacher := adminClient{groupID: 7, address: "192.0.2.1"}
+	for i := range adminMaxGroupFailures {
+		// Each guess comes from another forwarded address
+		recordAdminAttempt(adminClient{groupID: 7, address: fmt.Sprintf("198.51.100.%d", i)}, false)
+	}
+	if !adminLocked(teacher) {
+		t.Error("group not locked out after adminMaxGroupFailures failures")
+	}
+	if adminLocked(adminClient{groupID: 8, address: "192.0.2.1"}) {
+		t.Error("another group locked out")
+	}
+
+	recordAdminAttempt(adminClient{groupID: 8, address: "192.0.2.2"}, false)
+	recordAdminAttempt(adminClient{groupID: 8, address: "192.0.2.2"}, true)
+	adminFailures.Lock()
+	_, kept := adminFailures.clients[adminClient{groupID: 8, address: "192.0.2.2"}]
+	adminFailures.Unlock()
+	if kept {
+		t.Error("failures of a client kept after a right PIN")
+	}
+}
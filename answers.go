@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Answer events log every answer given, with its timing, for learning analytics.
+// An event belongs to a session: a server session ID, or an ID generated by an API
+// client for its own quiz. The (session_id, position) pair identifies an answer, so
+// an answer reported twice, such as in a retried result, is logged once. Both are
+// required: a unique index does not match NULL values.
+
+// errAnswerWithoutSession rejects an answer that cannot be deduplicated
+var errAnswerWithoutSession = errors.New("session_id and position required")
+
+// initAnswerTables creates the answer_events table
+func initAnswerTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS answer_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT,
+			position INTEGER,
+			user_name TEXT NOT NULL,
+			group_id INTEGER REFERENCES groups(id),
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			question_type TEXT NOT NULL,
+			given_answer TEXT,
+			correct INTEGER NOT NULL,
+			response_ms INTEGER,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create answer_events table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_answer_events_session
+		ON answer_events(session_id, position)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create answer_events session index: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_answer_events_lookup
+		ON answer_events(user_name, exercise_type, created_at)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create answer_events index: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_answer_events_group
+		ON answer_events(group_id, created_at)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create answer_events group index: %w", err)
+	}
+
+	return nil
+}
+
+// AnswerEvent is a single answer given by a user
+type AnswerEvent struct {
+	ID           int64  `json:"id"`
+	SessionID    string `json:"session_id,omitempty"`
+	Position     *int   `json:"position,omitempty"`
+	UserID       int64  `json:"user_id"`
+	UserName     string `json:"user_name"`
+	GroupID      *int64 `json:"group_id,omitempty"`
+	ExerciseType string `json:"exercise_type"`
+	Question     string `json:"question"`
+	FactKey      string `json:"fact_key,omitempty"`
+	QuestionType string `json:"question_type"`
+	GivenAnswer  string `json:"given_answer"`
+	Correct      bool   `json:"correct"`
+	ResponseMs   *int64 `json:"response_ms,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// answerEntry is an answer reported by the client, alone or in a result
+type answerEntry struct {
+	SessionID    string `json:"session_id,omitempty"`
+	Position     *int   `json:"position,omitempty"`
+	Question     string `json:"question"`
+	QuestionType string `json:"question_type,omitempty"`
+	GivenAnswer  string `json:"given_answer"`
+	Correct      bool   `json:"correct"`
+	ResponseMs   *int64 `json:"response_ms,omitempty"`
+}
+
+// recordAnswerEvent logs an answer and updates the review schedule of the fact in a
+// transaction. Answers already logged for the same session and position are ignored;
+// it reports whether the answer was newly logged.
+func recordAnswerEvent(tx *Tx, ev AnswerEvent) (bool, error) {
+	if ev.SessionID == "" || ev.Position == nil {
+		return false, errAnswerWithoutSession
+	}
+	if ev.QuestionType == "" {
+		ev.QuestionType = ev.ExerciseType
+	}
+	result, err := tx.Exec(`
+		INSERT INTO answer_events (session_id, position, user_id, user_name, group_id, exercise_type, question, fact_key, question_type, given_answer, correct, response_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(session_id, position) DO NOTHING
+	`, ev.SessionID, ev.Position, ev.UserID, ev.UserName, ev.GroupID, ev.ExerciseType, ev.Question, nullableString(questionFactKey(ev.Question)),
+		ev.QuestionType, ev.GivenAnswer, boolToInt(ev.Correct), ev.ResponseMs)
+	if err != nil {
+		return false, err
+	}
+
+	// Only a newly logged answer moves the fact in the review schedule
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, updateReviewSchedule(tx, ev)
+}
+
+// validateAnswerEntries checks that the answers sent with a result can be deduplicated
+func validateAnswerEntries(entries []answerEntry) error {
+	for _, entry := range entries {
+		if entry.SessionID == "" || entry.Position == nil {
+			return errAnswerWithoutSession
+		}
+	}
+	return nil
+}
+
+// recordAnswerEntries logs the answers sent with a result
+func recordAnswerEntries(user *User, exerciseType string, entries []answerEntry) {
+	for _, entry := range entries {
+		if entry.Question == "" {
+			continue
+		}
+		err := logAnswerEvent(AnswerEvent{
+			SessionID:    entry.SessionID,
+			Position:     entry.Position,
+			UserID:       user.ID,
+			UserName:     user.Name,
+			GroupID:      &user.GroupID,
+			ExerciseType: exerciseType,
+			Question:     entry.Question,
+			QuestionType: entry.QuestionType,
+			GivenAnswer:  entry.GivenAnswer,
+			Correct:      entry.Correct,
+			ResponseMs:   entry.ResponseMs,
+		})
+		if err != nil {
+			slog.Error("Failed to record answer event", "error", err)
+		}
+	}
+}
+
+// logAnswerEvent records an answer event in its own transaction
+func logAnswerEvent(ev AnswerEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := recordAnswerEvent(tx, ev); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parseDateParam parses a date filter, either a day (2006-01-02) starting at midnight
+// in loc or an RFC3339 timestamp. A day used as an upper bound includes the whole day.
+func parseDateParam(value string, upperBound bool, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if upperBound {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// formatDBTime formats a time the way CURRENT_TIMESTAMP stores it, for comparisons in queries
+func formatDBTime(t time.Time) string {
+	return t.UTC().Format(time.DateTime)
+}
+
+// GET /api/answers?user_id=X&name=X&group_id=Y&type=Z&from=D&to=D&period=P&limit=N - Returns the answer log
+func getAnswers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+	window, ok := requestWindow(w, r, groupID)
+	if !ok {
+		return
+	}
+	windowCond, args := window.conditions("created_at")
+	conditions := []string{windowCond}
+
+	if q.Get("user_id") != "" || strings.TrimSpace(q.Get("name")) != "" {
+		user, err := queryUser(r, groupID)
+		if err == errUserNotFound || err == errGroupNotFound {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode([]AnswerEvent{})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to resolve user", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, user.ID)
+	}
+	if groupID != nil {
+		conditions = append(conditions, "group_id = ?")
+		args = append(args, *groupID)
+	}
+	if exerciseType := strings.TrimSpace(q.Get("type")); exerciseType != "" {
+		conditions = append(conditions, "exercise_type = ?")
+		args = append(args, exerciseType)
+	}
+
+	limit := 500
+	if limitParam := q.Get("limit"); limitParam != "" {
+		n, err := strconv.Atoi(limitParam)
+		if err != nil || n < 1 || n > 5000 {
+			writeFieldError(w, codeInvalidField, "limit", "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	query := `
+		SELECT id, COALESCE(session_id, ''), position, user_id, user_name, group_id, exercise_type, question, COALESCE(fact_key, ''),
+			question_type, COALESCE(given_answer, ''), correct, response_ms, created_at
+		FROM answer_events
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY created_at DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		slog.Error("Failed to query answers", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	defer rows.Close()
+
+	var events []AnswerEvent
+	for rows.Next() {
+		var ev AnswerEvent
+		var position sql.NullInt64
+		var groupID, responseMs sql.NullInt64
+		var correct int
+		if err := rows.Scan(&ev.ID, &ev.SessionID, &position, &ev.UserID, &ev.UserName, &groupID, &ev.ExerciseType, &ev.Question,
+			&ev.FactKey, &ev.QuestionType, &ev.GivenAnswer, &correct, &responseMs, &ev.CreatedAt); err != nil {
+			slog.Error("Failed to scan row", "error", err)
+			continue
+		}
+		if position.Valid {
+			p := int(position.Int64)
+			ev.Position = &p
+		}
+		if groupID.Valid {
+			ev.GroupID = &groupID.Int64
+		}
+		if responseMs.Valid {
+			ev.ResponseMs = &responseMs.Int64
+		}
+		ev.Correct = correct == 1
+		events = append(events, ev)
+	}
+
+	if events == nil {
+		events = []AnswerEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
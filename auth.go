@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Group data is only readable by members of the group, and only members record
+// answers and results for the pupils of the group. A request proves membership
+// with the group secret_key (X-Group-Key header or secret_key parameter) or with the
+// group token returned by /api/groups (Authorization: Bearer <token>). The token is
+// derived from the secret_key, so rotating the key invalidates it too.
+// The server admin token from [adminconfig] reads and writes every group.
+
+const groupKeyHeader = "X-Group-Key"
+
+var (
+	errNoCredentials  = errors.New("group secret_key or token required")
+	errBadCredentials = errors.New("invalid group secret_key or token")
+)
+
+// groupToken returns the membership token of a group: "<id>.<hmac>"
+func groupToken(groupID int64, secretKey string) string {
+	mac := hmac.New(sha256.New, []byte(secretKey))
+	mac.Write([]byte("group-token:" + strconv.FormatInt(groupID, 10)))
+	return strconv.FormatInt(groupID, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// isServerAdmin reports whether a request carries the server admin token
+func isServerAdmin(r *http.Request) bool {
+	adminToken := config.AdminConfig.Token
+	if adminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminToken)) == 1
+}
+
+// requestGroupMembership returns the group a request proves membership of
+func requestGroupMembership(r *http.Request) (int64, error) {
+	secretKey := r.Header.Get(groupKeyHeader)
+	if secretKey == "" {
+		secretKey = r.URL.Query().Get("secret_key")
+	}
+	if secretKey = strings.TrimSpace(secretKey); secretKey != "" {
+		group, err := store.GroupBySecretKey(secretKey)
+		if err == errGroupNotFound {
+			return 0, errBadCredentials
+		}
+		if err != nil {
+			return 0, err
+		}
+		return group.ID, nil
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return 0, errNoCredentials
+	}
+	idPart, _, _ := strings.Cut(token, ".")
+	groupID, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, errBadCredentials
+	}
+	group, err := store.GroupByID(groupID)
+	if err == errGroupNotFound {
+		return 0, errBadCredentials
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !hmac.Equal([]byte(token), []byte(groupToken(groupID, group.SecretKey))) {
+		return 0, errBadCredentials
+	}
+	return groupID, nil
+}
+
+// requestGroupScope returns the group a read request is restricted to: the group of
+// the request credentials. Members only read their own group, per-user reads
+// included (see queryUser); the server admin reads the group_id parameter, or every
+// group (nil) without it. Every read handler of group data starts with it. It writes
+// the error response on failure.
+func requestGroupScope(w http.ResponseWriter, r *http.Request) (*int64, bool) {
+	var requested *int64
+	if groupIDParam := r.URL.Query().Get("group_id"); groupIDParam != "" {
+		groupID, err := strconv.ParseInt(groupIDParam, 10, 64)
+		if err != nil {
+			writeFieldError(w, codeInvalidField, "group_id", "invalid group_id")
+			return nil, false
+		}
+		requested = &groupID
+	}
+
+	if isServerAdmin(r) {
+		return requested, true
+	}
+
+	groupID, err := requestGroupMembership(r)
+	switch err {
+	case nil:
+	case errNoCredentials, errBadCredentials:
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+		return nil, false
+	default:
+		slog.Error("Failed to check group membership", "error", err)
+		writeDatabaseError(w)
+		return nil, false
+	}
+
+	if requested != nil && *requested != groupID {
+		writeError(w, http.StatusForbidden, codeForbidden, "group_id does not match the group credentials")
+		return nil, false
+	}
+	return &groupID, true
+}
+
+// requireGroupMember wraps a handler of a /api/groups/{id}/... route so that it only
+// runs for members of the group or the server admin
+func requireGroupMember(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groupID, ok := groupIDFromPath(w, r)
+		if !ok {
+			return
+		}
+		if isServerAdmin(r) {
+			handler(w, r)
+			return
+		}
+
+		memberOf, err := requestGroupMembership(r)
+		switch {
+		case err == errNoCredentials || err == errBadCredentials:
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+		case err != nil:
+			slog.Error("Failed to check group membership", "error", err)
+			writeDatabaseError(w)
+		case memberOf != groupID:
+			writeError(w, http.StatusForbidden, codeForbidden, "not a member of this group")
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+// requireServerAdmin wraps a handler so that it only runs for the server admin
+func requireServerAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isServerAdmin(r) {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "server admin token required")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Badges are awarded by rules: the server rules come from badge_rules.toml, embedded
+// in the binary, or from the file set by [badgeconfig] rules_file; group admins add
+// rules of their own group through /api/groups/{id}/badge-rules. evaluateBadges is
+// the only place deciding which badges a result earns, for new results as well as
+// for rebuilding the ledger.
+
+//go:embed badge_rules.toml
+var defaultBadgeRules []byte
+
+// badgeRules are the server rules, applying to every group
+var badgeRules []BadgeRule
+
+// specialistRules define the specialist badge of each exercise type
+var specialistRules []SpecialistRule
+
+// BadgeRule awards a badge to the results meeting all its conditions
+type BadgeRule struct {
+	// ID identifies the badge in the ledger, for example "gold10"
+	ID string `json:"id" toml:"id"`
+	// Badge is the level shown (bronze, silver, gold, diamond...), the ID by default
+	Badge string `json:"badge" toml:"badge"`
+	// Only the matching rule of highest rank is awarded in each category,
+	// the ID by default
+	Category string `json:"category" toml:"category"`
+	Rank     int    `json:"rank" toml:"rank"`
+	Name     string `json:"name,omitempty" toml:"name"`
+	BadgeThresholds
+
+	// GroupID is set on the rules of a group
+	GroupID   *int64 `json:"group_id,omitempty" toml:"-"`
+	CreatedAt string `json:"created_at,omitempty" toml:"-"`
+
+	// table is the table of an awarded per-table badge
+	table int
+}
+
+// BadgeThresholds are the conditions of a rule, shown with the badges it awards
+type BadgeThresholds struct {
+	ExerciseTypes        []string `json:"exercise_types,omitempty" toml:"exercise_types"`
+	ExcludeExerciseTypes []string `json:"exclude_exercise_types,omitempty" toml:"exclude_exercise_types"`
+	Totals               []int    `json:"totals,omitempty" toml:"totals"`
+	MinRatio             float64  `json:"min_ratio" toml:"min_ratio"`
+	MinTables            int      `json:"min_tables,omitempty" toml:"min_tables"`
+	MaxTables            int      `json:"max_tables,omitempty" toml:"max_tables"`
+	MaxMeanTimeSeconds   float64  `json:"max_mean_time_seconds,omitempty" toml:"max_mean_time_seconds"`
+	// PerTable rules are earned on single-table runs, once per table
+	PerTable bool `json:"per_table,omitempty" toml:"per_table"`
+	// MinStreakDays rules are earned by results ending a streak of as many days
+	MinStreakDays int `json:"min_streak_days,omitempty" toml:"min_streak_days"`
+}
+
+// badgeInput is what the rules know of a result
+type badgeInput struct {
+	ExerciseType    string
+	Score           int
+	Total           int
+	Tables          []int
+	MeanTimeSeconds float64
+	// StreakDays is the daily streak of the user on the day of the result
+	StreakDays int
+}
+
+// appliesTo reports whether the rule applies to an exercise type
+func (rule *BadgeRule) appliesTo(exerciseType string) bool {
+	if len(rule.ExerciseTypes) > 0 && !slices.Contains(rule.ExerciseTypes, exerciseType) {
+		return false
+	}
+	return !slices.Contains(rule.ExcludeExerciseTypes, exerciseType)
+}
+
+// matches reports whether a result meets every condition of the rule
+func (rule *BadgeRule) matches(in badgeInput) bool {
+	if !rule.appliesTo(in.ExerciseType) || in.Total <= 0 {
+		return false
+	}
+	if len(rule.Totals) > 0 && !slices.Contains(rule.Totals, in.Total) {
+		return false
+	}
+	// Tolerance for ratios such as 0.95, not exact in binary
+	if float64(in.Score) < rule.MinRatio*float64(in.Total)-1e-9 {
+		return false
+	}
+	if len(in.Tables) < rule.MinTables || (rule.MaxTables > 0 && len(in.Tables) > rule.MaxTables) {
+		return false
+	}
+	if rule.PerTable && len(in.Tables) != 1 {
+		return false
+	}
+	if rule.MaxMeanTimeSeconds > 0 && (in.MeanTimeSeconds <= 0 || in.MeanTimeSeconds > rule.MaxMeanTimeSeconds) {
+		return false
+	}
+	return in.StreakDays >= rule.MinStreakDays
+}
+
+// evaluateBadges returns the badges a result earns: the matching rule of highest
+// rank in each category, best first. Per-table badges carry the table of the run.
+func evaluateBadges(rules []BadgeRule, in badgeInput) []BadgeRule {
+	best := make(map[string]BadgeRule)
+	for _, rule := range rules {
+		if !rule.matches(in) {
+			continue
+		}
+		if rule.PerTable {
+			rule.table = in.Tables[0]
+		}
+		if existing, ok := best[rule.Category]; !ok || rule.Rank > existing.Rank {
+			best[rule.Category] = rule
+		}
+	}
+
+	earned := make([]BadgeRule, 0, len(best))
+	for _, rule := range best {
+		earned = append(earned, rule)
+	}
+	sort.Slice(earned, func(i, j int) bool {
+		if earned[i].Rank != earned[j].Rank {
+			return earned[i].Rank > earned[j].Rank
+		}
+		return earned[i].ID < earned[j].ID
+	})
+	return earned
+}
+
+// ledgerID is the badge of an awarded rule in the ledger: its ID, followed by the
+// table for per-table badges ("lightning:7")
+func (rule *BadgeRule) ledgerID() string {
+	if rule.table > 0 {
+		return fmt.Sprintf("%s:%d", rule.ID, rule.table)
+	}
+	return rule.ID
+}
+
+// badgeIDs returns the ledger IDs of awarded rules
+func badgeIDs(rules []BadgeRule) []string {
+	ids := make([]string, len(rules))
+	for i, rule := range rules {
+		ids[i] = rule.ledgerID()
+	}
+	return ids
+}
+
+// groupBadgeRules returns the rules applying to a group: the server rules, then
+// those of the group. The server rules alone are used when the group rules cannot
+// be read.
+func groupBadgeRules(groupID int64) []BadgeRule {
+	rules, err := store.BadgeRules(&groupID)
+	if err != nil {
+		slog.Error("Failed to query group badge rules", "group_id", groupID, "error", err)
+		return badgeRules
+	}
+	return append(slices.Clone(badgeRules), rules...)
+}
+
+// groupRulesOf returns the server rules and the rules of a group among rules
+func groupRulesOf(rules []BadgeRule, groupID int64) []BadgeRule {
+	var of []BadgeRule
+	for _, rule := range rules {
+		if rule.GroupID == nil || *rule.GroupID == groupID {
+			of = append(of, rule)
+		}
+	}
+	return of
+}
+
+// findBadgeRule returns the rule of a badge of the ledger. When the rules no longer
+// define it, it returns a rule of rank 0 named after the badge and false.
+func findBadgeRule(rules []BadgeRule, badge EarnedBadge) (BadgeRule, bool) {
+	id := badge.BadgeType
+	if badge.TableNumber > 0 {
+		id = strings.TrimSuffix(id, fmt.Sprintf(":%d", badge.TableNumber))
+	}
+	for _, rule := range rules {
+		if rule.ID == id && rule.appliesTo(badge.ExerciseType) {
+			rule.table = badge.TableNumber
+			return rule, true
+		}
+	}
+	return BadgeRule{ID: id, Badge: id, Category: badge.Category, table: badge.TableNumber}, false
+}
+
+// SpecialistRule defines the specialist badge of exercise types: earned after Runs
+// successful runs in a row on a unit, and dimmed or revoked after DecayFailures
+// failed runs in a row on it
+type SpecialistRule struct {
+	ExerciseTypes []string `json:"exercise_types" toml:"exercise_types"`
+	// Unit is "table", a badge per table earned on single-table runs, or "run", a
+	// badge earned on whole runs of the exercise type such as Megamix
+	Unit string `json:"unit" toml:"unit"`
+	// Totals are the accepted numbers of questions, any when empty
+	Totals   []int   `json:"totals,omitempty" toml:"totals"`
+	MinRatio float64 `json:"min_ratio" toml:"min_ratio"`
+	Runs     int     `json:"runs" toml:"runs"`
+	// DecayFailures is the number of failed runs in a row after which an earned
+	// badge decays, never when 0
+	DecayFailures int `json:"decay_failures,omitempty" toml:"decay_failures"`
+	// Decay is "dim", keeping the badge shown as dimmed until the next successful
+	// run, or "revoke", taking it back
+	Decay string `json:"decay,omitempty" toml:"decay"`
+}
+
+const (
+	specialistUnitTable   = "table"
+	specialistUnitRun     = "run"
+	specialistDecayDim    = "dim"
+	specialistDecayRevoke = "revoke"
+)
+
+// specialistRun is a result as seen by a specialist rule
+type specialistRun struct {
+	// Table is the table of the run, 0 for the "run" unit
+	Table   int
+	Success bool
+}
+
+// run returns the unit of a result and whether it succeeded, false when the rule
+// does not track the result
+func (rule *SpecialistRule) run(tables []int, score, total int) (specialistRun, bool) {
+	var run specialistRun
+	if rule.Unit == specialistUnitTable {
+		if len(tables) != 1 {
+			return run, false
+		}
+		run.Table = tables[0]
+	}
+	run.Success = total > 0 &&
+		(len(rule.Totals) == 0 || slices.Contains(rule.Totals, total)) &&
+		float64(score) >= rule.MinRatio*float64(total)-1e-9
+	return run, true
+}
+
+// findSpecialistRule returns the specialist rule of an exercise type
+func findSpecialistRule(exerciseType string) (SpecialistRule, bool) {
+	for _, rule := range specialistRules {
+		if slices.Contains(rule.ExerciseTypes, exerciseType) {
+			return rule, true
+		}
+	}
+	return SpecialistRule{}, false
+}
+
+// validateSpecialistRule checks a specialist rule and fills its defaults
+func validateSpecialistRule(rule *SpecialistRule) error {
+	if len(rule.ExerciseTypes) == 0 {
+		return fmt.Errorf("exercise_types required")
+	}
+	for _, t := range rule.ExerciseTypes {
+		if !exerciseTypes[t] {
+			return fmt.Errorf("unknown exercise type %q", t)
+		}
+	}
+	if rule.Unit == "" {
+		rule.Unit = specialistUnitTable
+	}
+	if rule.Unit != specialistUnitTable && rule.Unit != specialistUnitRun {
+		return fmt.Errorf("unit must be %q or %q", specialistUnitTable, specialistUnitRun)
+	}
+	for _, total := range rule.Totals {
+		if total <= 0 {
+			return fmt.Errorf("totals must be positive")
+		}
+	}
+	if math.IsNaN(rule.MinRatio) || rule.MinRatio < 0 || rule.MinRatio > 1 {
+		return fmt.Errorf("min_ratio must be between 0 and 1")
+	}
+	if rule.Runs < 1 || rule.Runs > 100 {
+		return fmt.Errorf("runs must be between 1 and 100")
+	}
+	if rule.DecayFailures < 0 {
+		return fmt.Errorf("decay_failures must not be negative")
+	}
+	if rule.Decay == "" {
+		rule.Decay = specialistDecayDim
+	}
+	if rule.Decay != specialistDecayDim && rule.Decay != specialistDecayRevoke {
+		return fmt.Errorf("decay must be %q or %q", specialistDecayDim, specialistDecayRevoke)
+	}
+	return nil
+}
+
+// badgeRulesFile is the content of a rules file
+type badgeRulesFile struct {
+	Rules       []BadgeRule      `json:"rules" toml:"rules"`
+	Specialists []SpecialistRule `json:"specialists" toml:"specialists"`
+}
+
+// loadBadgeRules loads the server rules from a TOML or JSON file, or the embedded
+// rules when path is empty
+func loadBadgeRules(path string) error {
+	data, format, source := defaultBadgeRules, ".toml", "embedded"
+	if path != "" {
+		source = path
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("failed to read badge rules: %w", err)
+		}
+		format = strings.ToLower(filepath.Ext(path))
+	}
+
+	var file badgeRulesFile
+	var err error
+	switch format {
+	case ".json":
+		err = json.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		return fmt.Errorf("badge rules file %s must be .toml or .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse badge rules: %w", err)
+	}
+
+	for i := range file.Rules {
+		if err := validateBadgeRule(&file.Rules[i]); err != nil {
+			return fmt.Errorf("invalid badge rule %d: %s", i+1, err.Message)
+		}
+	}
+	// A rules file without specialist rules keeps the embedded ones
+	if path != "" && len(file.Specialists) == 0 {
+		var defaults badgeRulesFile
+		if err := toml.Unmarshal(defaultBadgeRules, &defaults); err != nil {
+			return fmt.Errorf("failed to parse embedded badge rules: %w", err)
+		}
+		file.Specialists = defaults.Specialists
+	}
+	seen := make(map[string]bool)
+	for i := range file.Specialists {
+		if err := validateSpecialistRule(&file.Specialists[i]); err != nil {
+			return fmt.Errorf("invalid specialist rule %d: %w", i+1, err)
+		}
+		for _, t := range file.Specialists[i].ExerciseTypes {
+			if seen[t] {
+				return fmt.Errorf("invalid specialist rule %d: several specialist rules for %q", i+1, t)
+			}
+			seen[t] = true
+		}
+	}
+	badgeRules = file.Rules
+	specialistRules = file.Specialists
+	slog.Info("Badge rules loaded", "rules", len(badgeRules), "specialists", len(specialistRules), "source", source)
+	return nil
+}
+
+var badgeIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// validateBadgeRule checks a rule and fills its defaults
+func validateBadgeRule(rule *BadgeRule) *APIError {
+	invalid := func(field, message string) *APIError {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: field, Message: message}
+	}
+
+	if rule.ID == "" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeMissingField, Field: "id", Message: "id required"}
+	}
+	if rule.Badge == "" {
+		rule.Badge = rule.ID
+	}
+	if rule.Category == "" {
+		rule.Category = rule.ID
+	}
+	for _, f := range []struct{ field, value string }{{"id", rule.ID}, {"badge", rule.Badge}, {"category", rule.Category}} {
+		if !badgeIDPattern.MatchString(f.value) {
+			return invalid(f.field, f.field+" must be 1 to 32 lowercase letters, digits, - or _")
+		}
+	}
+	if len(rule.Name) > 100 {
+		return invalid("name", "name must be at most 100 characters")
+	}
+	for _, t := range rule.ExerciseTypes {
+		if !exerciseTypes[t] {
+			return invalid("exercise_types", fmt.Sprintf("unknown exercise type %q", t))
+		}
+	}
+	for _, t := range rule.ExcludeExerciseTypes {
+		if !exerciseTypes[t] {
+			return invalid("exclude_exercise_types", fmt.Sprintf("unknown exercise type %q", t))
+		}
+	}
+	for _, total := range rule.Totals {
+		if total <= 0 {
+			return invalid("totals", "totals must be positive")
+		}
+	}
+	if math.IsNaN(rule.MinRatio) || rule.MinRatio < 0 || rule.MinRatio > 1 {
+		return invalid("min_ratio", "min_ratio must be between 0 and 1")
+	}
+	if rule.MinTables < 0 || rule.MinTables > maxTable {
+		return invalid("min_tables", fmt.Sprintf("min_tables must be between 0 and %d", maxTable))
+	}
+	if rule.MaxTables < 0 || rule.MaxTables > maxTable || (rule.MaxTables > 0 && rule.MaxTables < rule.MinTables) {
+		return invalid("max_tables", fmt.Sprintf("max_tables must be between min_tables and %d", maxTable))
+	}
+	if math.IsNaN(rule.MaxMeanTimeSeconds) || rule.MaxMeanTimeSeconds < 0 {
+		return invalid("max_mean_time_seconds", "max_mean_time_seconds must not be negative")
+	}
+	if rule.MinStreakDays < 0 || rule.MinStreakDays > maxStreakMilestone {
+		return invalid("min_streak_days", fmt.Sprintf("min_streak_days must be between 0 and %d", maxStreakMilestone))
+	}
+	if rule.PerTable && rule.MinTables > 1 {
+		return invalid("min_tables", "per_table rules are earned on single-table runs")
+	}
+	return nil
+}
+
+// initBadgeRuleTables creates the badge_rules table, holding the group rules
+func initBadgeRuleTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS badge_rules (
+			id ` + tx.autoIncrementID() + `,
+			group_id BIGINT NOT NULL REFERENCES groups(id),
+			rule_id TEXT NOT NULL,
+			definition TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(group_id, rule_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create badge_rules table: %w", err)
+	}
+	return nil
+}
+
+// addSpecialistDecay adds the failed runs in a row and the dimming of the specialist
+// badges
+func addSpecialistDecay(tx *Tx) error {
+	for _, column := range []string{
+		"consecutive_failures INTEGER NOT NULL DEFAULT 0",
+		"dimmed_at TIMESTAMP",
+	} {
+		if _, err := tx.Exec(`ALTER TABLE specialist_badges ADD COLUMN ` + column); err != nil {
+			return fmt.Errorf("failed to add %s to specialist_badges: %w", strings.Fields(column)[0], err)
+		}
+	}
+	return nil
+}
+
+// queryGroupBadgeRules returns the rules of a group, or of every group when nil
+func queryGroupBadgeRules(q dbtx, groupID *int64) ([]BadgeRule, error) {
+	cond, args := groupFilter(groupID)
+	rows, err := q.Query(`
+		SELECT group_id, definition, created_at
+		FROM badge_rules
+		WHERE `+cond+`
+		ORDER BY group_id, id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []BadgeRule
+	for rows.Next() {
+		var rule BadgeRule
+		var ruleGroupID int64
+		var definition, createdAt string
+		if err := rows.Scan(&ruleGroupID, &definition, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(definition), &rule); err != nil {
+			return nil, fmt.Errorf("invalid badge rule of group %d: %w", ruleGroupID, err)
+		}
+		rule.GroupID = &ruleGroupID
+		rule.CreatedAt = createdAt
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// GET /api/groups/{id}/badge-rules - List the badge rules applying to a group: server rules, then the group's
+func listGroupBadgeRules(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	rules, err := store.BadgeRules(&groupID)
+	if err != nil {
+		slog.Error("Failed to query badge rules", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(append(slices.Clone(badgeRules), rules...))
+}
+
+// POST /api/groups/{id}/badge-rules - Add a badge to a group (admin). The badges of the group's past results are recomputed.
+func createGroupBadgeRule(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+
+	var rule BadgeRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if err := validateBadgeRule(&rule); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if slices.ContainsFunc(badgeRules, func(s BadgeRule) bool { return s.ID == rule.ID }) {
+		writeAPIError(w, &APIError{Status: http.StatusConflict, Code: codeConflict, Field: "id", Message: "id already used by a server badge"})
+		return
+	}
+	rule.GroupID = &groupID
+
+	created, err := store.CreateBadgeRule(&rule)
+	if err != nil {
+		slog.Error("Failed to create badge rule", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !created {
+		writeAPIError(w, &APIError{Status: http.StatusConflict, Code: codeConflict, Field: "id", Message: "badge rule already exists"})
+		return
+	}
+	slog.Info("Badge rule created", "group_id", groupID, "rule", rule.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DELETE /api/groups/{id}/badge-rules/{ruleID} - Remove a badge of a group and its awards (admin)
+func deleteGroupBadgeRule(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	ruleID := r.PathValue("ruleID")
+
+	deleted, err := store.DeleteBadgeRule(groupID, ruleID)
+	if err != nil {
+		slog.Error("Failed to delete badge rule", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, codeNotFound, "badge rule not found")
+		return
+	}
+	slog.Info("Badge rule deleted", "group_id", groupID, "rule", ruleID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEvaluateBadges(t *testing.T) {
+	if err := loadBadgeRules(""); err != nil {
+		t.Fatalf("loadBadgeRules: %v", err)
+	}
+	fiveTables := []int{2, 3, 4, 5, 6}
+	tenTables := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	allTables := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+	tests := []struct {
+		name string
+		in   badgeInput
+		want []string
+	}{
+		{"35/40 on 5 tables", badgeInput{ExerciseType: "mul", Score: 35, Total: 40, Tables: fiveTables}, []string{}},
+		{"36/40 on 5 tables", badgeInput{ExerciseType: "mul", Score: 36, Total: 40, Tables: fiveTables}, []string{"bronze"}},
+		{"38/40 on 5 tables", badgeInput{ExerciseType: "mul", Score: 38, Total: 40, Tables: fiveTables}, []string{"silver"}},
+		{"40/40 on 5 tables", badgeInput{ExerciseType: "mul", Score: 40, Total: 40, Tables: fiveTables}, []string{"gold"}},
+		{"40/40 on 4 tables", badgeInput{ExerciseType: "mul", Score: 40, Total: 40, Tables: fiveTables[:4]}, []string{}},
+		{"36/40 on 10 tables", badgeInput{ExerciseType: "mul", Score: 36, Total: 40, Tables: tenTables}, []string{"bronze10", "bronze"}},
+		{"38/40 on 10 tables", badgeInput{ExerciseType: "add", Score: 38, Total: 40, Tables: tenTables}, []string{"silver10", "silver"}},
+		{"40/40 on 10 tables", badgeInput{ExerciseType: "sub", Score: 40, Total: 40, Tables: tenTables}, []string{"gold10", "gold"}},
+		{"40/40 on 12 tables", badgeInput{ExerciseType: "mul", Score: 40, Total: 40, Tables: allTables}, []string{"diamond", "gold10", "gold"}},
+		{"39/40 on 12 tables", badgeInput{ExerciseType: "mul", Score: 39, Total: 40, Tables: allTables}, []string{"silver10", "silver"}},
+		{"20/20 on 5 tables", badgeInput{ExerciseType: "mul", Score: 20, Total: 20, Tables: fiveTables}, []string{}},
+		{"megamix 89/100", badgeInput{ExerciseType: "mega", Score: 89, Total: 100, Tables: allTables}, []string{}},
+		{"megamix 90/100", badgeInput{ExerciseType: "mega", Score: 90, Total: 100, Tables: allTables}, []string{"bronze"}},
+		{"megamix 95/100", badgeInput{ExerciseType: "mega", Score: 95, Total: 100, Tables: allTables}, []string{"silver"}},
+		{"megamix 100/100", badgeInput{ExerciseType: "mega", Score: 100, Total: 100, Tables: allTables}, []string{"gold"}},
+		{"megamix 200/200", badgeInput{ExerciseType: "mega", Score: 200, Total: 200, Tables: allTables}, []string{"diamond", "gold"}},
+		{"megamix 199/200", badgeInput{ExerciseType: "mega", Score: 199, Total: 200, Tables: allTables}, []string{}},
+		{"megamix 40/40", badgeInput{ExerciseType: "mega", Score: 40, Total: 40, Tables: allTables}, []string{}},
+		{"fast 38/40", badgeInput{ExerciseType: "mul", Score: 38, Total: 40, Tables: fiveTables, MeanTimeSeconds: 1.8}, []string{"speed-gold", "silver"}},
+		{"slow 38/40", badgeInput{ExerciseType: "mul", Score: 38, Total: 40, Tables: fiveTables, MeanTimeSeconds: 4.5}, []string{"silver"}},
+		{"lightning table", badgeInput{ExerciseType: "mul", Score: 10, Total: 10, Tables: []int{7}, MeanTimeSeconds: 1.2}, []string{"lightning:7"}},
+		{"7 days streak", badgeInput{ExerciseType: "mul", Score: 5, Total: 10, Tables: []int{7}, StreakDays: 8}, []string{"streak-7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := badgeIDs(evaluateBadges(badgeRules, tt.in))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("evaluateBadges = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBadgeRule(t *testing.T) {
+	valid := BadgeRule{ID: "club", Rank: 10, BadgeThresholds: BadgeThresholds{Totals: []int{20}, MinRatio: 0.9}}
+	rule := valid
+	if err := validateBadgeRule(&rule); err != nil {
+		t.Fatalf("validateBadgeRule(valid) = %v", err)
+	}
+	if rule.Badge != "club" || rule.Category != "club" {
+		t.Errorf("badge, category = %q, %q, want the id", rule.Badge, rule.Category)
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(*BadgeRule)
+		code  string
+		field string
+	}{
+		{"missing id", func(r *BadgeRule) { r.ID = "" }, codeMissingField, "id"},
+		{"uppercase id", func(r *BadgeRule) { r.ID = "Club" }, codeInvalidField, "id"},
+		{"bad badge", func(r *BadgeRule) { r.Badge = "gold star" }, codeInvalidField, "badge"},
+		{"long category", func(r *BadgeRule) { r.Category = "c123456789012345678901234567890123" }, codeInvalidField, "category"},
+		{"long name", func(r *BadgeRule) { r.Name = string(make([]byte, 101)) }, codeInvalidField, "name"},
+		{"unknown type", func(r *BadgeRule) { r.ExerciseTypes = []string{"div"} }, codeInvalidField, "exercise_types"},
+		{"unknown excluded type", func(r *BadgeRule) { r.ExcludeExerciseTypes = []string{"div"} }, codeInvalidField, "exclude_exercise_types"},
+		{"zero total", func(r *BadgeRule) { r.Totals = []int{40, 0} }, codeInvalidField, "totals"},
+		{"ratio above 1", func(r *BadgeRule) { r.MinRatio = 1.1 }, codeInvalidField, "min_ratio"},
+		{"negative ratio", func(r *BadgeRule) { r.MinRatio = -0.1 }, codeInvalidField, "min_ratio"},
+		{"too many min tables", func(r *BadgeRule) { r.MinTables = maxTable + 1 }, codeInvalidField, "min_tables"},
+		{"max below min tables", func(r *BadgeRule) { r.MinTables, r.MaxTables = 5, 3 }, codeInvalidField, "max_tables"},
+		{"negative mean time", func(r *BadgeRule) { r.MaxMeanTimeSeconds = -1 }, codeInvalidField, "max_mean_time_seconds"},
+		{"streak too long", func(r *BadgeRule) { r.MinStreakDays = maxStreakMilestone + 1 }, codeInvalidField, "min_streak_days"},
+		{"per table on several tables", func(r *BadgeRule) { r.PerTable, r.MinTables = true, 2 }, codeInvalidField, "min_tables"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := valid
+			rule.Totals = slices.Clone(valid.Totals)
+			tt.edit(&rule)
+			err := validateBadgeRule(&rule)
+			if err == nil {
+				t.Fatal("validateBadgeRule accepted the rule")
+			}
+			if err.Code != tt.code || err.Field != tt.field {
+				t.Errorf("error = %s on %q, want %s on %q", err.Code, err.Field, tt.code, tt.field)
+			}
+		})
+	}
+}
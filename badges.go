@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// The earned_badges ledger keeps one row per user, exercise type and badge rule
+// (gold, gold10, diamond...): when it was first earned and by which result, how many
+// results earned it, and the best of them. It is written when a result is saved;
+// rebuildBadgeLedger recomputes it from user_results after an admin correction or a
+// change of the group rules, or with the backfill-badges command.
+
+// EarnedBadge is a row of the ledger
+type EarnedBadge struct {
+	UserID       int64
+	UserName     string
+	GroupID      int64
+	ExerciseType string
+	BadgeType    string
+	Category     string
+	Count        int
+	BestScore    int
+	BestTotal    int
+	TablesCount  int
+	// TableNumber is the table of a per-table badge, 0 otherwise
+	TableNumber   int
+	FirstEarnedAt string
+	FirstResultID int64
+	LastEarnedAt  string
+}
+
+// initBadgeTables creates the earned_badges ledger and fills it from the results
+func initBadgeTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS earned_badges (
+			id ` + tx.autoIncrementID() + `,
+			user_id BIGINT NOT NULL REFERENCES users(id),
+			exercise_type TEXT NOT NULL,
+			badge_type TEXT NOT NULL,
+			category TEXT NOT NULL,
+			earned_count INTEGER NOT NULL DEFAULT 1,
+			best_score INTEGER NOT NULL,
+			best_total INTEGER NOT NULL,
+			tables_count INTEGER NOT NULL,
+			first_earned_at TIMESTAMP NOT NULL,
+			first_result_id BIGINT,
+			last_earned_at TIMESTAMP NOT NULL,
+			UNIQUE(user_id, exercise_type, badge_type)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create earned_badges table: %w", err)
+	}
+
+	n, err := fillBadgeLedger(tx, false, migrationBadgesV11)
+	if err != nil {
+		return fmt.Errorf("failed to fill earned_badges: %w", err)
+	}
+	slog.Info("Filled badge ledger from results", "badges", n)
+	return nil
+}
+
+// addBadgeTableNumber adds the table of per-table badges to the ledger
+func addBadgeTableNumber(tx *Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE earned_badges ADD COLUMN table_number INTEGER`); err != nil {
+		return fmt.Errorf("failed to add table_number to earned_badges: %w", err)
+	}
+	return nil
+}
+
+// backfillSpeedBadges awards the speed and lightning badges to the results saved
+// before they existed. Rows already in the ledger are kept.
+func backfillSpeedBadges(tx *Tx) error {
+	n, err := fillBadgeLedger(tx, true, migrationBadgesV20)
+	if err != nil {
+		return fmt.Errorf("failed to backfill speed badges: %w", err)
+	}
+	slog.Info("Backfilled speed badges from results", "badges", n)
+	return nil
+}
+
+// Ledger migrations award badges with a frozen copy of the rules of their release,
+// so that editing badge_rules.toml never changes what a released migration does.
+// The backfill-badges command recomputes the ledger with the current rules.
+
+// migrationResult is a result read by a ledger migration
+type migrationResult struct {
+	ID           int64
+	UserID       int64
+	ExerciseType string
+	Score        int
+	Total        int
+	Tables       []int
+	MeanTime     float64
+	CreatedAt    time.Time
+}
+
+// migrationBadge is a badge awarded by a ledger migration
+type migrationBadge struct {
+	BadgeType string
+	Category  string
+	Table     int
+}
+
+// migrationBadgesV11 returns the badges of a result under the rules of migration
+// 11: gold, silver and bronze on 5 tables or more and on 10 tables or more, diamond
+// on the 12 tables, and the megamix thresholds
+func migrationBadgesV11(res migrationResult) []migrationBadge {
+	score, total, tablesCount := res.Score, res.Total, len(res.Tables)
+	level := func(perfect, good, fair int) string {
+		switch {
+		case score == perfect:
+			return "gold"
+		case score >= good:
+			return "silver"
+		case score >= fair:
+			return "bronze"
+		}
+		return ""
+	}
+
+	if res.ExerciseType == "mega" {
+		switch {
+		case total == 200 && score == 200:
+			return []migrationBadge{{"diamond", "diamond", 0}, {"gold", "regular", 0}}
+		case total == 100:
+			if badge := level(100, 95, 90); badge != "" {
+				return []migrationBadge{{badge, "regular", 0}}
+			}
+		}
+		return nil
+	}
+
+	if tablesCount < 5 || total != 40 {
+		return nil
+	}
+	var badges []migrationBadge
+	if tablesCount == 12 && score == 40 {
+		badges = append(badges, migrationBadge{"diamond", "diamond", 0})
+	}
+	if badge := level(40, 38, 36); badge != "" {
+		badges = append(badges, migrationBadge{badge, "regular", 0})
+		if tablesCount >= 10 {
+			badges = append(badges, migrationBadge{badge + "10", "ten", 0})
+		}
+	}
+	return badges
+}
+
+// migrationBadgesV20 returns the speed and lightning badges of a result under the
+// rules of migration 20: 38/40 or better on 5 tables or more under 2, 3 or 4 seconds
+// per answer, and a perfect single-table run of 10 under 1.5 seconds, per table
+func migrationBadgesV20(res migrationResult) []migrationBadge {
+	if res.ExerciseType == "mega" || res.MeanTime <= 0 {
+		return nil
+	}
+	switch {
+	case res.Total == 40 && res.Score >= 38 && len(res.Tables) >= 5:
+		switch {
+		case res.MeanTime <= 2:
+			return []migrationBadge{{"speed-gold", "speed", 0}}
+		case res.MeanTime <= 3:
+			return []migrationBadge{{"speed-silver", "speed", 0}}
+		case res.MeanTime <= 4:
+			return []migrationBadge{{"speed-bronze", "speed", 0}}
+		}
+	case res.Total == 10 && res.Score == 10 && len(res.Tables) == 1 && res.MeanTime <= 1.5:
+		table := res.Tables[0]
+		return []migrationBadge{{fmt.Sprintf("lightning:%d", table), "lightning", table}}
+	}
+	return nil
+}
+
+// fillBadgeLedger adds the badges awarded to the results of every user to the ledger,
+// keeping the rows already there, and returns the number of rows added. withTable
+// writes table_number, which the ledger has since migration 13.
+func fillBadgeLedger(tx *Tx, withTable bool, award func(migrationResult) []migrationBadge) (int, error) {
+	// Read every result first: the inserts cannot run while rows are open
+	rows, err := tx.Query(`
+		SELECT id, user_id, exercise_type, score, total, COALESCE(tables, ''), COALESCE(mean_time_seconds, 0), created_at
+		FROM user_results
+		WHERE user_id IS NOT NULL
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var results []migrationResult
+	for rows.Next() {
+		var res migrationResult
+		var tables string
+		if err := rows.Scan(&res.ID, &res.UserID, &res.ExerciseType, &res.Score, &res.Total, &tables, &res.MeanTime, &res.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if tables != "" {
+			if err := json.Unmarshal([]byte(tables), &res.Tables); err != nil {
+				res.Tables = nil
+			}
+		}
+		results = append(results, res)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	type ledgerKey struct {
+		userID       int64
+		exerciseType string
+		badgeType    string
+	}
+	ledger := make(map[ledgerKey]*EarnedBadge)
+	var order []*EarnedBadge
+	for _, res := range results {
+		earnedAt := formatDBTime(res.CreatedAt)
+		for _, awarded := range award(res) {
+			key := ledgerKey{res.UserID, res.ExerciseType, awarded.BadgeType}
+			badge, ok := ledger[key]
+			if !ok {
+				badge = &EarnedBadge{
+					UserID:        res.UserID,
+					ExerciseType:  res.ExerciseType,
+					BadgeType:     awarded.BadgeType,
+					Category:      awarded.Category,
+					TableNumber:   awarded.Table,
+					FirstEarnedAt: earnedAt,
+					FirstResultID: res.ID,
+					BestScore:     -1,
+				}
+				ledger[key] = badge
+				order = append(order, badge)
+			}
+			badge.Count++
+			badge.LastEarnedAt = earnedAt
+			if res.Score > badge.BestScore {
+				badge.BestScore, badge.BestTotal, badge.TablesCount = res.Score, res.Total, len(res.Tables)
+			}
+		}
+	}
+
+	added := 0
+	for _, b := range order {
+		columns, values := "", ""
+		args := []any{b.UserID, b.ExerciseType, b.BadgeType, b.Category, b.Count,
+			b.BestScore, b.BestTotal, b.TablesCount, b.FirstEarnedAt, b.FirstResultID, b.LastEarnedAt}
+		if withTable {
+			columns, values = ", table_number", ", ?"
+			args = append(args, nullableTable(b.TableNumber))
+		}
+		result, err := tx.Exec(`
+			INSERT INTO earned_badges (user_id, exercise_type, badge_type, category, earned_count,
+				best_score, best_total, tables_count, first_earned_at, first_result_id, last_earned_at`+columns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`+values+`)
+			ON CONFLICT(user_id, exercise_type, badge_type) DO NOTHING
+		`, args...)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err == nil {
+			added += int(n)
+		}
+	}
+	return added, nil
+}
+
+// ledgerResult is a result read to rebuild the ledger
+type ledgerResult struct {
+	ID           int64
+	UserID       int64
+	UserName     string
+	ExerciseType string
+	Score        int
+	Total        int
+	Tables       string
+	MeanTime     float64
+	GroupID      int64
+	Timezone     string
+	CreatedAt    time.Time
+}
+
+// ledgerScope selects the users whose ledger is rebuilt: one user, the users of a
+// group, or every user when both are nil
+type ledgerScope struct {
+	UserID  *int64
+	GroupID *int64
+}
+
+// rebuildBadgeLedger recomputes the ledger of the users of a scope from user_results,
+// with the server rules and the group rules given. It returns the number of ledger
+// rows written.
+func rebuildBadgeLedger(q dbtx, scope ledgerScope, groupRules []BadgeRule) (int, error) {
+	cond, args := scope.condition()
+	if _, err := q.Exec(`DELETE FROM earned_badges WHERE `+cond, args...); err != nil {
+		return 0, err
+	}
+
+	// Read every result first: the inserts cannot run while rows are open
+	results, err := readLedgerResults(q, scope)
+	if err != nil {
+		return 0, err
+	}
+	ledger := evaluateLedger(results, groupRules, timeWindow{})
+	for _, b := range ledger {
+		_, err := q.Exec(`
+			INSERT INTO earned_badges (user_id, exercise_type, badge_type, category, table_number, earned_count,
+				best_score, best_total, tables_count, first_earned_at, first_result_id, last_earned_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, b.UserID, b.ExerciseType, b.BadgeType, b.Category, nullableTable(b.TableNumber), b.Count,
+			b.BestScore, b.BestTotal, b.TablesCount, b.FirstEarnedAt, b.FirstResultID, b.LastEarnedAt)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ledger), nil
+}
+
+// condition returns the condition of a scope on the user_id column
+func (scope ledgerScope) condition() (string, []any) {
+	switch {
+	case scope.UserID != nil:
+		return "user_id = ?", []any{*scope.UserID}
+	case scope.GroupID != nil:
+		return "user_id IN (SELECT id FROM users WHERE group_id = ?)", []any{*scope.GroupID}
+	}
+	return "user_id IS NOT NULL", nil
+}
+
+// readLedgerResults returns the results of the users of a scope in chronological order
+func readLedgerResults(q dbtx, scope ledgerScope) ([]ledgerResult, error) {
+	cond, args := scope.condition()
+	rows, err := q.Query(`
+		SELECT r.id, r.user_id, u.name, r.exercise_type, r.score, r.total, COALESCE(r.tables, ''),
+			COALESCE(r.mean_time_seconds, 0), u.group_id, COALESCE(g.timezone, ''), r.created_at
+		FROM user_results r
+		JOIN users u ON u.id = r.user_id
+		LEFT JOIN groups g ON g.id = u.group_id
+		WHERE r.`+cond+`
+		ORDER BY r.created_at, r.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []ledgerResult
+	for rows.Next() {
+		var res ledgerResult
+		if err := rows.Scan(&res.ID, &res.UserID, &res.UserName, &res.ExerciseType, &res.Score, &res.Total, &res.Tables, &res.MeanTime,
+			&res.GroupID, &res.Timezone, &res.CreatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// evaluateLedger evaluates the server rules and the group rules given on results in
+// chronological order, and returns the ledger rows of the badges earned by the
+// results of a window. Streaks count the results before the window too.
+func evaluateLedger(results []ledgerResult, groupRules []BadgeRule, window timeWindow) []*EarnedBadge {
+	rulesByGroup := make(map[int64][]BadgeRule)
+	for _, rule := range groupRules {
+		if rule.GroupID != nil {
+			rulesByGroup[*rule.GroupID] = append(rulesByGroup[*rule.GroupID], rule)
+		}
+	}
+
+	type ledgerKey struct {
+		userID       int64
+		exerciseType string
+		badgeType    string
+	}
+	ledger := make(map[ledgerKey]*EarnedBadge)
+	var order []*EarnedBadge
+	streaks := make(map[int64]*streakCounter)
+	for _, res := range results {
+		counter, ok := streaks[res.UserID]
+		if !ok {
+			counter = &streakCounter{}
+			streaks[res.UserID] = counter
+		}
+		streakDays := counter.add(practiceDay(res.CreatedAt, groupLocation(res.Timezone)))
+		if !window.contains(res.CreatedAt) {
+			continue
+		}
+
+		var tables []int
+		if res.Tables != "" {
+			if err := json.Unmarshal([]byte(res.Tables), &tables); err != nil {
+				tables = nil
+			}
+		}
+		tablesCount := len(tables)
+		earnedAt := formatDBTime(res.CreatedAt)
+		rules := badgeRules
+		if len(rulesByGroup[res.GroupID]) > 0 {
+			rules = append(slices.Clone(badgeRules), rulesByGroup[res.GroupID]...)
+		}
+		in := badgeInput{res.ExerciseType, res.Score, res.Total, tables, res.MeanTime, streakDays}
+		for _, rule := range evaluateBadges(rules, in) {
+			key := ledgerKey{res.UserID, res.ExerciseType, rule.ledgerID()}
+			badge, ok := ledger[key]
+			if !ok {
+				badge = &EarnedBadge{
+					UserID:        res.UserID,
+					UserName:      res.UserName,
+					GroupID:       res.GroupID,
+					ExerciseType:  res.ExerciseType,
+					BadgeType:     rule.ledgerID(),
+					Category:      rule.Category,
+					TableNumber:   rule.table,
+					FirstEarnedAt: earnedAt,
+					FirstResultID: res.ID,
+					BestScore:     -1,
+				}
+				ledger[key] = badge
+				order = append(order, badge)
+			}
+			badge.Count++
+			badge.LastEarnedAt = earnedAt
+			if res.Score > badge.BestScore {
+				badge.BestScore, badge.BestTotal, badge.TablesCount = res.Score, res.Total, tablesCount
+			}
+		}
+	}
+	return order
+}
+
+// resultBadges evaluates the badge rules of the user's group on a result about to be
+// saved at now, its day counting in the streak of the user
+func resultBadges(res resultRecord, now time.Time) ([]BadgeRule, error) {
+	streakDays, err := userStreakDays(res.User.ID, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute streak: %w", err)
+	}
+	in := badgeInput{res.ExerciseType, res.Score, res.Total, res.Tables, res.MeanTimeSeconds, streakDays}
+	return evaluateBadges(groupBadgeRules(res.User.GroupID), in), nil
+}
+
+// nullableTable stores the table of a per-table badge, NULL for the other badges
+func nullableTable(table int) any {
+	if table == 0 {
+		return nil
+	}
+	return table
+}
+
+// runBackfillBadgesCommand runs the "backfill-badges" command, which rebuilds the
+// whole ledger from user_results, and returns the exit code
+func runBackfillBadgesCommand() int {
+	err := initDB()
+	if err == nil {
+		var n int
+		n, err = store.RebuildBadges(ledgerScope{})
+		if err == nil {
+			slog.Info("Badge ledger rebuilt", "badges", n)
+		}
+	}
+	if store != nil {
+		store.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
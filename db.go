@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Queries are written once, with ? placeholders and SQL understood by both SQLite
+// and PostgreSQL. DB and Tx wrap their database/sql counterpart and rewrite the
+// placeholders to $1, $2... for PostgreSQL.
+
+// dialect is the SQL flavour of a database
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+// DB is a database handle rewriting placeholders for its dialect
+type DB struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (d *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return d.DB.Exec(rebind(d.dialect, query), args...)
+}
+
+func (d *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.DB.Query(rebind(d.dialect, query), args...)
+}
+
+func (d *DB) QueryRow(query string, args ...any) *sql.Row {
+	return d.DB.QueryRow(rebind(d.dialect, query), args...)
+}
+
+func (d *DB) Begin() (*Tx, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: d.dialect}, nil
+}
+
+// Tx is a transaction rewriting placeholders for its dialect
+type Tx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(rebind(t.dialect, query), args...)
+}
+
+func (t *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(rebind(t.dialect, query), args...)
+}
+
+func (t *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(rebind(t.dialect, query), args...)
+}
+
+// autoIncrementID is the column definition of an auto-incremented primary key
+func (t *Tx) autoIncrementID() string {
+	if t.dialect == dialectPostgres {
+		return "BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// forUpdate is the clause locking the rows read by a SELECT until the end of the
+// transaction. SQLite has none: its writers are serialised by the database lock.
+func (t *Tx) forUpdate() string {
+	if t.dialect == dialectPostgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// dbtx is implemented by *DB and *Tx
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// rebind rewrites the ? placeholders of a query for a dialect,
+// leaving question marks inside quoted strings untouched
+func rebind(d dialect, query string) string {
+	if d != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	inString := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		query    string
+		postgres string
+	}{
+		{`SELECT 1`, `SELECT 1`},
+		{`SELECT * FROM users WHERE id = ?`, `SELECT * FROM users WHERE id = $1`},
+		{`INSERT INTO t (a, b, c) VALUES (?, ?, ?)`, `INSERT INTO t (a, b, c) VALUES ($1, $2, $3)`},
+		// Question marks in strings are text
+		{`SELECT '?' FROM t WHERE a = ? AND b = 'why?'`, `SELECT '?' FROM t WHERE a = $1 AND b = 'why?'`},
+		{`SELECT 'it''s ?' WHERE a = ?`, `SELECT 'it''s ?' WHERE a = $1`},
+		{`SELECT 'é' || ? || ?`, `SELECT 'é' || $1 || $2`},
+	}
+	for _, tt := range tests {
+		if got := rebind(dialectSQLite, tt.query); got != tt.query {
+			t.Errorf("rebind(sqlite, %q) = %q, want it unchanged", tt.query, got)
+		}
+		if got := rebind(dialectPostgres, tt.query); got != tt.postgres {
+			t.Errorf("rebind(postgres, %q) = %q, want %q", tt.query, got, tt.postgres)
+		}
+	}
+
+	// Placeholders are numbered up to 10 and more
+	query, want := "", ""
+	for i := 1; i <= 12; i++ {
+		query += "?,"
+		want += "$" + strconv.Itoa(i) + ","
+	}
+	if got := rebind(dialectPostgres, query); got != want {
+		t.Errorf("rebind(postgres, %q) = %q, want %q", query, got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// Every /api error response is a JSON envelope:
+//
+//	{"error": {"code": "missing_field", "message": "name required", "field": "name", "request_id": "..."}}
+//
+// The code is stable and meant for programs, the message is for humans. Field names
+// the offending request field or path parameter when there is one. The request ID is
+// also sent in the X-Request-ID header and logged with server errors.
+
+const requestIDHeader = "X-Request-ID"
+
+// Error codes
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeMissingField     = "missing_field"
+	codeInvalidField     = "invalid_field"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeSessionExpired   = "session_expired"
+	codeRateLimited      = "rate_limited"
+	codeDatabaseError    = "database_error"
+	codeInternalError    = "internal_error"
+)
+
+// APIError is an error answered to an API client
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+type errorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// writeAPIError sends an error envelope, tagged with the request ID of the response
+func writeAPIError(w http.ResponseWriter, e *APIError) {
+	e.RequestID = w.Header().Get(requestIDHeader)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(errorResponse{Error: e})
+}
+
+// writeError sends an error not tied to a request field
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, &APIError{Status: status, Code: code, Message: message})
+}
+
+// writeFieldError sends a 400 error about a request field or path parameter
+func writeFieldError(w http.ResponseWriter, code, field, message string) {
+	writeAPIError(w, &APIError{Status: http.StatusBadRequest, Code: code, Field: field, Message: message})
+}
+
+// writeDatabaseError sends the 500 response of a failed database operation
+func writeDatabaseError(w http.ResponseWriter) {
+	writeError(w, http.StatusInternalServerError, codeDatabaseError, "database error")
+}
+
+// requestID returns the ID of a request: the X-Request-ID sent by a proxy when
+// it looks sane, otherwise a new random ID
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 64 && isRequestIDSafe(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isRequestIDSafe accepts the characters of UUIDs and common trace IDs, so that a
+// client-provided ID can be logged and echoed as is
+func isRequestIDSafe(id string) bool {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
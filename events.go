@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events are posted to the webhook subscriptions of config.toml ([[webhooks]]) and
+// of the webhook_subscriptions table, global or limited to one group. Each delivery
+// goes through the outbox and is signed with the subscription secret:
+//
+//	X-Webhook-Timestamp: <unix seconds>
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256(secret, timestamp + "." + body)>
+//
+// Receivers recompute the signature and reject old timestamps. Deliveries are at
+// least once: a retried event keeps its id, for receivers to skip duplicates.
+
+const (
+	eventBadgeEarned           = "badge.earned"
+	eventSpecialistBadgeEarned = "specialist_badge.earned"
+	eventGroupCreated          = "group.created"
+
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// webhookEvents lists the events a subscription can ask for
+var webhookEvents = []string{eventResultSubmitted, eventBadgeEarned, eventSpecialistBadgeEarned, eventGroupCreated}
+
+// WebhookSubscription sends some events, or all of them when Events is empty, to a URL
+type WebhookSubscription struct {
+	ID int64 `json:"id" toml:"-"`
+	// GroupID limits the subscription to the events of a group, nil for every group
+	GroupID *int64   `json:"group_id,omitempty" toml:"group_id"`
+	URL     string   `json:"url" toml:"url"`
+	Secret  string   `json:"secret,omitempty" toml:"secret"`
+	Events  []string `json:"events" toml:"events"`
+	// CreatedAt is empty for the subscriptions of config.toml
+	CreatedAt string `json:"created_at,omitempty" toml:"-"`
+}
+
+// wants reports whether the subscription receives an event of a group
+func (s *WebhookSubscription) wants(event string, groupID *int64) bool {
+	if s.GroupID != nil && (groupID == nil || *s.GroupID != *groupID) {
+		return false
+	}
+	return len(s.Events) == 0 || slices.Contains(s.Events, event)
+}
+
+// validateWebhookSubscription checks the URL and events of a subscription
+func validateWebhookSubscription(s *WebhookSubscription) *APIError {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "url", Message: "url must be an http or https URL"}
+	}
+	if err := checkWebhookHost(u.Hostname()); err != nil {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "url", Message: "url " + err.Error()}
+	}
+	for _, event := range s.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "events",
+				Message: fmt.Sprintf("unknown event %q, expected one of %s", event, strings.Join(webhookEvents, ", "))}
+		}
+	}
+	return nil
+}
+
+// checkWebhookHost rejects a host resolving to an address webhooks may not reach
+func checkWebhookHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !webhookAddressAllowed(ip) {
+			return fmt.Errorf("host %s is a private, loopback or link-local address", host)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("host %s does not resolve", host)
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr.IP) {
+			return fmt.Errorf("host %s resolves to %s, a private, loopback or link-local address", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// webhookAddressAllowed reports whether webhooks may connect to an address. They
+// never reach the server itself, the hosts of its network or the cloud metadata
+// service (169.254.169.254), unless [webhookconfig] allow_private_networks is set.
+func webhookAddressAllowed(ip net.IP) bool {
+	if config.WebhookConfig.AllowPrivateNetworks {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// initWebhookSubscriptionTables creates the webhook_subscriptions table and
+// adds the signing secret to the outbox
+func initWebhookSubscriptionTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id ` + tx.autoIncrementID() + `,
+			group_id BIGINT REFERENCES groups(id),
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook_subscriptions table: %w", err)
+	}
+
+	if _, err := tx.Exec(`ALTER TABLE webhook_outbox ADD COLUMN secret TEXT`); err != nil {
+		return fmt.Errorf("failed to add secret to webhook_outbox: %w", err)
+	}
+	return nil
+}
+
+// webhookEvent is the body posted for an event
+type webhookEvent struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	CreatedAt string `json:"created_at"`
+	GroupID   *int64 `json:"group_id,omitempty"`
+	Data      any    `json:"data"`
+}
+
+// resultEventData is the data of result.submitted
+type resultEventData struct {
+	ResultID        int64   `json:"result_id"`
+	User            *User   `json:"user"`
+	ExerciseType    string  `json:"exercise_type"`
+	Score           int     `json:"score"`
+	Total           int     `json:"total"`
+	Tables          []int   `json:"tables"`
+	MeanTimeSeconds float64 `json:"mean_time_seconds"`
+}
+
+// badgeEventData is the data of badge.earned, sent for each result earning badges
+type badgeEventData struct {
+	ResultID     int64    `json:"result_id"`
+	User         *User    `json:"user"`
+	ExerciseType string   `json:"exercise_type"`
+	Badges       []string `json:"badges"`
+	// NewBadges are the badges the user earned for the first time
+	NewBadges   []string `json:"new_badges"`
+	Score       int      `json:"score"`
+	Total       int      `json:"total"`
+	TablesCount int      `json:"tables_count"`
+}
+
+// specialistBadgeEventData is the data of specialist_badge.earned
+type specialistBadgeEventData struct {
+	User         *User  `json:"user"`
+	ExerciseType string `json:"exercise_type"`
+	TableNumber  int    `json:"table_number"`
+}
+
+// groupEventData is the data of group.created. The secret key is never sent.
+type groupEventData struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// publishEvent queues an event for every subscription that wants it. Failures are
+// logged: the action that raised the event has already succeeded.
+func publishEvent(event string, groupID *int64, data any) {
+	subscriptions := append([]WebhookSubscription(nil), config.Webhooks...)
+	stored, err := store.WebhookSubscriptions(nil)
+	if err == nil && groupID != nil {
+		var groupSubscriptions []WebhookSubscription
+		groupSubscriptions, err = store.WebhookSubscriptions(groupID)
+		stored = append(stored, groupSubscriptions...)
+	}
+	if err != nil {
+		slog.Error("Failed to read webhook subscriptions", "event", event, "error", err)
+		return
+	}
+	subscriptions = append(subscriptions, stored...)
+
+	var body []byte
+	queued := 0
+	for _, s := range subscriptions {
+		if !s.wants(event, groupID) {
+			continue
+		}
+		if body == nil {
+			if body, err = newEventBody(event, groupID, data); err != nil {
+				slog.Error("Failed to marshal webhook event", "event", event, "error", err)
+				return
+			}
+		}
+		if err := store.EnqueueWebhook(event, s.URL, s.Secret, body, time.Now()); err != nil {
+			slog.Error("Failed to queue webhook event", "event", event, "url", s.URL, "error", err)
+			continue
+		}
+		queued++
+	}
+	if queued > 0 {
+		wakeWebhookWorker()
+	}
+}
+
+// newEventBody marshals an event with a new ID
+func newEventBody(event string, groupID *int64, data any) ([]byte, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return json.Marshal(webhookEvent{
+		ID:        "evt_" + hex.EncodeToString(id),
+		Event:     event,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		GroupID:   groupID,
+		Data:      data,
+	})
+}
+
+// signWebhook returns the signature header value of a body sent at timestamp
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GET /api/groups/{id}/webhooks - List the webhook subscriptions of a group (admin)
+func listGroupWebhooks(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	writeWebhookSubscriptions(w, &groupID)
+}
+
+// POST /api/groups/{id}/webhooks - Subscribe a URL to the events of a group (admin)
+func createGroupWebhook(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	createWebhookSubscription(w, r, &groupID)
+}
+
+// DELETE /api/groups/{id}/webhooks/{webhookID} - Remove a webhook subscription of a group (admin)
+func deleteGroupWebhook(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	deleteWebhookSubscription(w, r, &groupID)
+}
+
+// GET /api/webhooks?group_id=G - List the global webhook subscriptions, or those of a group (server admin)
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	var groupID *int64
+	if groupIDParam := r.URL.Query().Get("group_id"); groupIDParam != "" {
+		id, err := strconv.ParseInt(groupIDParam, 10, 64)
+		if err != nil {
+			writeFieldError(w, codeInvalidField, "group_id", "invalid group_id")
+			return
+		}
+		groupID = &id
+	}
+	writeWebhookSubscriptions(w, groupID)
+}
+
+// POST /api/webhooks - Subscribe a URL to the events of every group, or of the group_id of the body (server admin)
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	createWebhookSubscription(w, r, nil)
+}
+
+// DELETE /api/webhooks/{webhookID} - Remove a webhook subscription (server admin)
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	deleteWebhookSubscription(w, r, nil)
+}
+
+// writeWebhookSubscriptions sends the subscriptions of a group, or the global
+// ones, without their secret
+func writeWebhookSubscriptions(w http.ResponseWriter, groupID *int64) {
+	subscriptions, err := store.WebhookSubscriptions(groupID)
+	if err != nil {
+		slog.Error("Failed to query webhook subscriptions", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if subscriptions == nil {
+		subscriptions = []WebhookSubscription{}
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+// createWebhookSubscription stores the subscription of the request body in a group,
+// or in the group of the body when groupID is nil. The secret is generated when
+// missing and only returned here.
+func createWebhookSubscription(w http.ResponseWriter, r *http.Request, groupID *int64) {
+	var sub WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if groupID != nil {
+		sub.GroupID = groupID
+	} else if sub.GroupID != nil {
+		if _, err := store.GroupByID(*sub.GroupID); err == errGroupNotFound {
+			writeFieldError(w, codeInvalidField, "group_id", "group not found")
+			return
+		} else if err != nil {
+			slog.Error("Failed to get group", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+	}
+	sub.URL = strings.TrimSpace(sub.URL)
+	if sub.URL == "" {
+		writeFieldError(w, codeMissingField, "url", "url required")
+		return
+	}
+	if apiErr := validateWebhookSubscription(&sub); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if sub.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			slog.Error("Failed to generate webhook secret", "error", err)
+			writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+			return
+		}
+		sub.Secret = secret
+	}
+	if sub.Events == nil {
+		sub.Events = []string{}
+	}
+
+	if err := store.CreateWebhookSubscription(&sub); err != nil {
+		slog.Error("Failed to create webhook subscription", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	if sub.GroupID != nil {
+		slog.Info("Webhook subscription created", "id", sub.ID, "group_id", *sub.GroupID, "url", sub.URL, "events", sub.Events)
+	} else {
+		slog.Info("Webhook subscription created", "id", sub.ID, "url", sub.URL, "events", sub.Events)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// deleteWebhookSubscription removes the subscription of the {webhookID} path value,
+// which must belong to groupID unless it is nil
+func deleteWebhookSubscription(w http.ResponseWriter, r *http.Request, groupID *int64) {
+	id, err := strconv.ParseInt(r.PathValue("webhookID"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "webhookID", "invalid webhook id")
+		return
+	}
+
+	deleted, err := store.DeleteWebhookSubscription(id, groupID)
+	if err != nil {
+		slog.Error("Failed to delete webhook subscription", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, codeNotFound, "webhook subscription not found")
+		return
+	}
+
+	slog.Info("Webhook subscription deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
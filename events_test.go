@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedWebhook is a request seen by a test receiver
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver starts a receiver answering the statuses given in turn, then 200
+func webhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, func() []receivedWebhook) {
+	t.Helper()
+	var mu sync.Mutex
+	var received []receivedWebhook
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, receivedWebhook{r.Header.Clone(), body})
+		status := http.StatusOK
+		if len(received) <= len(statuses) {
+			status = statuses[len(received)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []receivedWebhook {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedWebhook(nil), received...)
+	}
+}
+
+// allowLocalWebhooks lets the deliveries of a test reach its httptest receiver
+func allowLocalWebhooks(t *testing.T) {
+	saved := config.WebhookConfig.AllowPrivateNetworks
+	config.WebhookConfig.AllowPrivateNetworks = true
+	t.Cleanup(func() { config.WebhookConfig.AllowPrivateNetworks = saved })
+}
+
+func TestPostWebhookSignature(t *testing.T) {
+	allowLocalWebhooks(t)
+	srv, received := webhookReceiver(t)
+
+	payload := []byte(`{"id":"evt_1","event":"badge.earned","data":{}}`)
+	d := WebhookDelivery{ID: 42, Event: eventBadgeEarned, URL: srv.URL, Payload: payload, secret: "s3cret"}
+	if err := postWebhook(newWebhookClient(5*time.Second), d); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+
+	got := received()
+	if len(got) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(got))
+	}
+	header, body := got[0].header, got[0].body
+	if string(body) != string(payload) {
+		t.Errorf("body = %s, want %s", body, payload)
+	}
+	if header.Get(webhookEventHeader) != eventBadgeEarned || header.Get(webhookDeliveryHeader) != "42" {
+		t.Errorf("event and delivery headers = %q, %q", header.Get(webhookEventHeader), header.Get(webhookDeliveryHeader))
+	}
+
+	timestamp := header.Get(webhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Fatalf("timestamp header = %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if header.Get(webhookSignatureHeader) != want {
+		t.Errorf("signature = %q, want %q", header.Get(webhookSignatureHeader), want)
+	}
+}
+
+func TestPostWebhookUnsigned(t *testing.T) {
+	allowLocalWebhooks(t)
+	srv, received := webhookReceiver(t)
+
+	d := WebhookDelivery{ID: 1, Event: eventResultSubmitted, URL: srv.URL, Payload: []byte(`{}`)}
+	if err := postWebhook(newWebhookClient(5*time.Second), d); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+	if got := received(); len(got) != 1 || got[0].header.Get(webhookSignatureHeader) != "" {
+		t.Errorf("unsigned delivery sent a signature: %+v", got)
+	}
+}
+
+// dueDelivery returns the only pending delivery of the outbox, whatever its next attempt
+func dueDelivery(t *testing.T) WebhookDelivery {
+	t.Helper()
+	due, err := store.DueWebhooks(time.Now().Add(24*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("DueWebhooks: %v", err)
+	}
+	if len(due) != 1 {
+		t.Fatalf("%d pending deliveries, want 1", len(due))
+	}
+	return due[0]
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	useTestStore(t)
+	allowLocalWebhooks(t)
+	srv, received := webhookReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	client := newWebhookClient(5 * time.Second)
+
+	payload := []byte(`{"id":"evt_2"}`)
+	if err := store.EnqueueWebhook(eventBadgeEarned, srv.URL, "s3cret", payload, time.Now()); err != nil {
+		t.Fatalf("EnqueueWebhook: %v", err)
+	}
+
+	// Two failures are retried with a growing delay
+	for attempt, delay := range []time.Duration{30 * time.Second, time.Minute} {
+		before := time.Now()
+		deliverWebhook(client, dueDelivery(t))
+		d := dueDelivery(t)
+		if d.Attempts != attempt+1 || !strings.Contains(d.LastError, "status") {
+			t.Fatalf("after attempt %d: attempts = %d, last error = %q", attempt+1, d.Attempts, d.LastError)
+		}
+		next, err := time.ParseInLocation(time.DateTime, d.NextAttemptAt, time.UTC)
+		if err != nil {
+			next, err = time.Parse(time.RFC3339, d.NextAttemptAt)
+		}
+		if err != nil || next.Before(before.Add(delay).Truncate(time.Second)) {
+			t.Errorf("after attempt %d: next attempt at %q, want %v later", attempt+1, d.NextAttemptAt, delay)
+		}
+	}
+
+	// The third attempt is delivered
+	deliverWebhook(client, dueDelivery(t))
+	if due, err := store.DueWebhooks(time.Now().Add(24*time.Hour), 10); err != nil || len(due) != 0 {
+		t.Fatalf("pending deliveries after success: %v, %v", due, err)
+	}
+	got := received()
+	if len(got) != 3 {
+		t.Fatalf("receiver got %d requests, want 3", len(got))
+	}
+	for i, req := range got {
+		if req.header.Get(webhookDeliveryHeader) != got[0].header.Get(webhookDeliveryHeader) || string(req.body) != string(payload) {
+			t.Errorf("attempt %d was not the same delivery: %v %s", i+1, req.header, req.body)
+		}
+		if req.header.Get(webhookSignatureHeader) == "" {
+			t.Errorf("attempt %d was not signed", i+1)
+		}
+	}
+}
+
+func TestDeliverWebhookDeadLetter(t *testing.T) {
+	useTestStore(t)
+	allowLocalWebhooks(t)
+	config.WebhookConfig.MaxAttempts = 2
+	srv, _ := webhookReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	client := newWebhookClient(5 * time.Second)
+
+	if err := store.EnqueueWebhook(eventResultSubmitted, srv.URL, "", []byte(`{}`), time.Now()); err != nil {
+		t.Fatalf("EnqueueWebhook: %v", err)
+	}
+	deliverWebhook(client, dueDelivery(t))
+	deliverWebhook(client, dueDelivery(t))
+
+	dead, err := store.DeadWebhooks(10)
+	if err != nil {
+		t.Fatalf("DeadWebhooks: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 2 || dead[0].Status != webhookStatusDead {
+		t.Fatalf("dead letters = %+v, want one after 2 attempts", dead)
+	}
+
+	// Retrying a dead letter makes it due again
+	if ok, err := store.RetryWebhook(dead[0].ID, time.Now()); err != nil || !ok {
+		t.Fatalf("RetryWebhook: %v, %v", ok, err)
+	}
+	deliverWebhook(client, dueDelivery(t))
+	if dead, _ := store.DeadWebhooks(10); len(dead) != 0 {
+		t.Errorf("dead letters after retry: %+v", dead)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{20, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestValidateWebhookSubscriptionTargets(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hooks", true},
+		{"http://[2606:4700:4700::1111]:8080/", true},
+		{"ftp://93.184.216.34/", false},
+		{"http://127.0.0.1:8080/", false},
+		{"http://localhost/", false},
+		{"http://[::1]/", false},
+		{"http://0.0.0.0/", false},
+		{"http://10.1.2.3/", false},
+		{"http://172.16.0.1/", false},
+		{"http://192.168.1.10/", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[fe80::1]/", false},
+		{"http://[fd00::1]/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+	}
+	for _, tt := range tests {
+		err := validateWebhookSubscription(&WebhookSubscription{URL: tt.url})
+		if (err == nil) != tt.ok {
+			t.Errorf("validateWebhookSubscription(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+		if err != nil && err.Field != "url" {
+			t.Errorf("validateWebhookSubscription(%q) field = %q, want url", tt.url, err.Field)
+		}
+	}
+
+	allowLocalWebhooks(t)
+	if err := validateWebhookSubscription(&WebhookSubscription{URL: "http://127.0.0.1:8080/"}); err != nil {
+		t.Errorf("allow_private_networks: %v", err)
+	}
+}
+
+func TestWebhookClientRefusesLocalTargets(t *testing.T) {
+	srv, received := webhookReceiver(t)
+
+	// httptest listens on the loopback address
+	d := WebhookDelivery{ID: 1, Event: eventResultSubmitted, URL: srv.URL, Payload: []byte(`{}`)}
+	err := postWebhook(newWebhookClient(5*time.Second), d)
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Fatalf("postWebhook to %s: %v, want a refused address", srv.URL, err)
+	}
+
+	if n := len(received()); n != 0 {
+		t.Errorf("receiver got %d requests, want none", n)
+	}
+}
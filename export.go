@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exports give the results of a group as a spreadsheet, generated locally: an XLSX
+// workbook with the attempts, a summary per pupil and exercise type, and the badges,
+// or one of these sheets as CSV. The time window (see requestWindow) applies to the
+// three of them.
+
+// exportSheets lists the sheets of an export, in workbook order
+var exportSheets = []string{"attempts", "summary", "badges"}
+
+// exportTables builds the sheets named, in that order, of the results of a group
+// within a window. The queries of the sheets not asked for are not run.
+func exportTables(groupID *int64, window timeWindow, sheets []string) ([]exportTable, error) {
+	var runs []LeaderboardRun
+	if slices.Contains(sheets, "attempts") || slices.Contains(sheets, "summary") {
+		var err error
+		if runs, err = store.LeaderboardRuns(groupID, "", window); err != nil {
+			return nil, err
+		}
+	}
+
+	tables := make([]exportTable, 0, len(sheets))
+	for _, sheet := range sheets {
+		switch sheet {
+		case "attempts":
+			tables = append(tables, attemptsSheet(runs))
+		case "summary":
+			tables = append(tables, summarySheet(runs))
+		case "badges":
+			badges, err := userBadges(groupID, window)
+			if err != nil {
+				return nil, err
+			}
+			tables = append(tables, badgesSheet(badges))
+		}
+	}
+	return tables, nil
+}
+
+// summarySheet sums up the runs per user and exercise type, from the runs ordered by
+// user and type
+func summarySheet(runs []LeaderboardRun) exportTable {
+	summary := exportTable{
+		Name: "Summary",
+		Header: []string{"user_id", "user_name", "exercise_type", "sessions", "questions", "correct", "accuracy",
+			"mean_time_seconds", "best_score", "best_total", "first_result", "last_result"},
+	}
+	for start := 0; start < len(runs); {
+		end := start + 1
+		for end < len(runs) && runs[end].UserID == runs[start].UserID && runs[end].ExerciseType == runs[start].ExerciseType {
+			end++
+		}
+		var point ProgressPoint
+		best := runs[start]
+		for _, run := range runs[start:end] {
+			point.add(run)
+			if betterRun(run, best) {
+				best = run
+			}
+		}
+		point.finish()
+		summary.Rows = append(summary.Rows, []any{best.UserID, best.UserName, best.ExerciseType, point.Sessions, point.Questions,
+			point.Correct, point.Accuracy, point.MeanTimeSeconds, best.Score, best.Total,
+			runs[start].CreatedAt.UTC().Format(time.RFC3339), runs[end-1].CreatedAt.UTC().Format(time.RFC3339)})
+		start = end
+	}
+	return summary
+}
+
+// attemptsSheet lists the runs in chronological order
+func attemptsSheet(runs []LeaderboardRun) exportTable {
+	runs = slices.Clone(runs)
+	sort.SliceStable(runs, func(i, j int) bool {
+		if !runs[i].CreatedAt.Equal(runs[j].CreatedAt) {
+			return runs[i].CreatedAt.Before(runs[j].CreatedAt)
+		}
+		return runs[i].ID < runs[j].ID
+	})
+	attempts := exportTable{
+		Name: "Attempts",
+		Header: []string{"id", "created_at", "user_id", "user_name", "exercise_type", "score", "total", "accuracy",
+			"mean_time_seconds", "tables"},
+	}
+	for _, run := range runs {
+		var tables []int
+		if run.Tables != "" {
+			json.Unmarshal([]byte(run.Tables), &tables)
+		}
+		attempts.Rows = append(attempts.Rows, []any{run.ID, run.CreatedAt.UTC().Format(time.RFC3339), run.UserID, run.UserName,
+			run.ExerciseType, run.Score, run.Total, run.accuracy(), run.MeanTimeSeconds, joinInts(tables)})
+	}
+	return attempts
+}
+
+// badgesSheet lists the badges earned
+func badgesSheet(badges []UserBadge) exportTable {
+	badgeSheet := exportTable{
+		Name: "Badges",
+		Header: []string{"user_id", "user_name", "exercise_type", "badge", "category", "name", "table_number", "count",
+			"best_score", "best_total", "first_earned_at"},
+	}
+	for _, b := range badges {
+		var table any
+		if b.TableNumber > 0 {
+			table = b.TableNumber
+		}
+		badgeSheet.Rows = append(badgeSheet.Rows, []any{b.UserID, b.UserName, b.ExerciseType, b.BadgeType, b.Category, b.Name,
+			table, b.Count, b.BestScore, b.BestTotal, b.FirstEarnedAt})
+	}
+	return badgeSheet
+}
+
+// csvValue formats a value for CSV. Text starting like a formula is prefixed with a
+// quote, so that spreadsheets do not evaluate pupil names.
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case *float64:
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+// GET /api/export?group_id=Y&format=csv|xlsx&sheet=S&from=D&to=D&period=P&term=T - Attempts, per-pupil
+// summaries and badges of the group as a spreadsheet
+func getExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "xlsx"
+	}
+	if format != "csv" && format != "xlsx" {
+		writeFieldError(w, codeInvalidField, "format", "format must be csv or xlsx")
+		return
+	}
+	sheet := q.Get("sheet")
+	if sheet == "" {
+		sheet = exportSheets[0]
+	}
+	if !slices.Contains(exportSheets, sheet) {
+		writeFieldError(w, codeInvalidField, "sheet", "sheet must be attempts, summary or badges")
+		return
+	}
+	window, ok := requestWindow(w, r, groupID)
+	if !ok {
+		return
+	}
+
+	sheets := exportSheets
+	if format == "csv" {
+		sheets = []string{sheet}
+	}
+	tables, err := exportTables(groupID, window, sheets)
+	if err != nil {
+		slog.Error("Failed to query export", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	filename := "results"
+	if groupID != nil {
+		filename += "-group-" + strconv.FormatInt(*groupID, 10)
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.csv"`, filename, sheet))
+		// Byte order mark, for spreadsheets to read the names as UTF-8
+		w.Write([]byte("\ufeff"))
+		cw := csv.NewWriter(w)
+		table := tables[0]
+		cw.Write(table.Header)
+		for _, row := range table.Rows {
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = csvValue(value)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			slog.Error("Failed to write export", "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, filename))
+	if err := writeXLSX(w, tables); err != nil {
+		slog.Error("Failed to write export", "error", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCSVValue(t *testing.T) {
+	half := 0.5
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{nil, ""},
+		{(*float64)(nil), ""},
+		{&half, "0.5"},
+		{0.25, "0.25"},
+		{42, "42"},
+		{int64(-3), "-3"},
+		{"", ""},
+		{"Zoé", "Zoé"},
+		{"a=b", "a=b"},
+		// Text a spreadsheet would evaluate
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+33 6 12", "'+33 6 12"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+	}
+	for _, tt := range tests {
+		if got := csvValue(tt.value); got != tt.want {
+			t.Errorf("csvValue(%#v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// readXLSXPart returns a part of a workbook, failing when it is missing or not
+// well-formed XML
+func readXLSXPart(t *testing.T, zr *zip.Reader, name string) []byte {
+	t.Helper()
+	f, err := zr.Open(name)
+	if err != nil {
+		t.Fatalf("missing part %s: %v", name, err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s is not well-formed: %v", name, err)
+		}
+	}
+	return content
+}
+
+func TestWriteXLSX(t *testing.T) {
+	mean := 2.5
+	tables := []exportTable{
+		{Name: "Attempts", Header: []string{"id", "user_name", "mean_time_seconds"},
+			Rows: [][]any{{int64(1), "Zoé <& co>", &mean}, {int64(2), "=1+1", nil}}},
+		{Name: "Badges", Header: []string{"badge"}},
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, tables); err != nil {
+		t.Fatalf("writeXLSX: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip: %v", err)
+	}
+
+	contentTypes := string(readXLSXPart(t, zr, "[Content_Types].xml"))
+	rootRels := readXLSXPart(t, zr, "_rels/.rels")
+	readXLSXPart(t, zr, "xl/styles.xml")
+	if !strings.Contains(string(rootRels), `Target="xl/workbook.xml"`) {
+		t.Errorf("_rels/.rels does not point to the workbook: %s", rootRels)
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(readXLSXPart(t, zr, "xl/workbook.xml"), &workbook); err != nil {
+		t.Fatalf("workbook.xml: %v", err)
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := xml.Unmarshal(readXLSXPart(t, zr, "xl/_rels/workbook.xml.rels"), &rels); err != nil {
+		t.Fatalf("workbook.xml.rels: %v", err)
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Relationships {
+		targets[rel.ID] = rel.Target
+	}
+	if len(workbook.Sheets) != len(tables) {
+		t.Fatalf("workbook has %d sheets, want %d", len(workbook.Sheets), len(tables))
+	}
+
+	for i, sheet := range workbook.Sheets {
+		if sheet.Name != tables[i].Name {
+			t.Errorf("sheet %d is named %q, want %q", i+1, sheet.Name, tables[i].Name)
+		}
+		target, ok := targets[sheet.RID]
+		if !ok {
+			t.Fatalf("sheet %q has no relationship %q", sheet.Name, sheet.RID)
+		}
+		part := path.Join("xl", target)
+		if !strings.Contains(contentTypes, `PartName="/`+part+`"`) {
+			t.Errorf("no content type for %s", part)
+		}
+
+		var worksheet struct {
+			Rows []struct {
+				Cells []struct {
+					Ref    string `xml:"r,attr"`
+					Type   string `xml:"t,attr"`
+					Value  string `xml:"v"`
+					Inline string `xml:"is>t"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		if err := xml.Unmarshal(readXLSXPart(t, zr, part), &worksheet); err != nil {
+			t.Fatalf("%s: %v", part, err)
+		}
+		if len(worksheet.Rows) != len(tables[i].Rows)+1 {
+			t.Fatalf("%s has %d rows, want %d", part, len(worksheet.Rows), len(tables[i].Rows)+1)
+		}
+		if i == 0 {
+			row := worksheet.Rows[1].Cells
+			if len(row) != 3 || row[0].Value != "1" || row[1].Inline != "Zoé <& co>" || row[2].Value != "2.5" {
+				t.Errorf("first row = %+v", row)
+			}
+			// Empty cells are left out; formulas are never written
+			row = worksheet.Rows[2].Cells
+			if len(row) != 2 || row[1].Type != "inlineStr" || row[1].Inline != "=1+1" {
+				t.Errorf("second row = %+v", row)
+			}
+		}
+	}
+}
+
+func TestExportTablesBuildsTheSheetsAsked(t *testing.T) {
+	useTestStore(t)
+
+	tables, err := exportTables(nil, timeWindow{}, []string{"badges"})
+	if err != nil {
+		t.Fatalf("exportTables: %v", err)
+	}
+	if len(tables) != 1 || tables[0].Name != "Badges" {
+		t.Fatalf("exportTables(badges) = %+v", tables)
+	}
+
+	tables, err = exportTables(nil, timeWindow{}, exportSheets)
+	if err != nil {
+		t.Fatalf("exportTables: %v", err)
+	}
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+	}
+	if strings.Join(names, ",") != "Attempts,Summary,Badges" {
+		t.Errorf("sheets = %v, want Attempts, Summary, Badges", names)
+	}
+}
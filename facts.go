@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A fact key identifies a fact whatever its display text: the operation and its
+// operands, "mul:7:8" for "7 x 8 = ?" and "fact:56" for "56 = ? x ?". It is stored
+// with the question in user_errors and answer_events. The commutative key groups
+// "7 x 8" with "8 x 7" (and "7 + 8" with "8 + 7"), for analytics and weighting.
+
+var (
+	// operationQuestion matches "7 x 8 = ?", "7×8", "7 * 8 =" or "12 - 5 = ?"
+	operationQuestion = regexp.MustCompile(`^\s*(\d+)\s*([x×*·+\-−])\s*(\d+)\s*(=\s*\??)?\s*$`)
+	// factorQuestion matches "56 = ? x ?"
+	factorQuestion = regexp.MustCompile(`^\s*(\d+)\s*=\s*\?\s*[x×*·]\s*\?\s*$`)
+)
+
+// factKey builds the key of an operation on its operands
+func factKey(operation string, operands ...int) string {
+	parts := make([]string, 0, len(operands)+1)
+	parts = append(parts, operation)
+	for _, operand := range operands {
+		parts = append(parts, strconv.Itoa(operand))
+	}
+	return strings.Join(parts, ":")
+}
+
+// parseFactKey returns the fact key of a question text, false when it is not a fact
+func parseFactKey(question string) (string, bool) {
+	question = strings.ToLower(question)
+	if m := factorQuestion.FindStringSubmatch(question); m != nil {
+		product, err := strconv.Atoi(m[1])
+		if err != nil {
+			return "", false
+		}
+		return factKey("fact", product), true
+	}
+	m := operationQuestion.FindStringSubmatch(question)
+	if m == nil {
+		return "", false
+	}
+	a, errA := strconv.Atoi(m[1])
+	b, errB := strconv.Atoi(m[3])
+	if errA != nil || errB != nil {
+		return "", false
+	}
+	operation := "mul"
+	switch m[2] {
+	case "+":
+		operation = "add"
+	case "-", "−":
+		operation = "sub"
+	}
+	return factKey(operation, a, b), true
+}
+
+// questionFactKey returns the fact key of a question text, empty when it is not a fact
+func questionFactKey(question string) string {
+	key, _ := parseFactKey(question)
+	return key
+}
+
+// cardFactKey returns the fact key of a flashcard, from its payload
+func cardFactKey(card Flashcard) string {
+	return factKey(card.Type, card.Payload.Operands...)
+}
+
+// commutativeFactKey returns the key grouping a fact with its commuted form: the
+// operands of multiplications and additions in increasing order
+func commutativeFactKey(key string) string {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 || (parts[0] != "mul" && parts[0] != "add") {
+		return key
+	}
+	a, errA := strconv.Atoi(parts[1])
+	b, errB := strconv.Atoi(parts[2])
+	if errA != nil || errB != nil || a <= b {
+		return key
+	}
+	return factKey(parts[0], b, a)
+}
+
+// commutedFactKeys returns a key and, for multiplications and additions of
+// different operands, its commuted form
+func commutedFactKeys(key string) []string {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 || (parts[0] != "mul" && parts[0] != "add") || parts[1] == parts[2] {
+		return []string{key}
+	}
+	return []string{key, strings.Join([]string{parts[0], parts[2], parts[1]}, ":")}
+}
+
+// addFactKeys stores the fact key of the questions of user_errors and answer_events,
+// parsed from the existing question texts
+func addFactKeys(tx *Tx) error {
+	for _, table := range []string{"user_errors", "answer_events"} {
+		if _, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN fact_key TEXT`); err != nil {
+			return fmt.Errorf("failed to add fact_key to %s: %w", table, err)
+		}
+		if _, err := tx.Exec(`CREATE INDEX idx_` + table + `_fact ON ` + table + `(user_id, fact_key)`); err != nil {
+			return fmt.Errorf("failed to create %s fact_key index: %w", table, err)
+		}
+
+		// Read every question first: the updates cannot run while rows are open
+		rows, err := tx.Query(`SELECT DISTINCT question FROM ` + table)
+		if err != nil {
+			return fmt.Errorf("failed to read %s questions: %w", table, err)
+		}
+		var questions []string
+		for rows.Next() {
+			var question string
+			if err := rows.Scan(&question); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read %s questions: %w", table, err)
+			}
+			questions = append(questions, question)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to read %s questions: %w", table, err)
+		}
+
+		var unparsed []string
+		for _, question := range questions {
+			key, ok := parseFactKey(question)
+			if !ok {
+				unparsed = append(unparsed, question)
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE `+table+` SET fact_key = ? WHERE question = ?`, key, question); err != nil {
+				return fmt.Errorf("failed to set %s fact_key: %w", table, err)
+			}
+		}
+		if len(unparsed) > 0 {
+			slog.Warn("Questions without a fact key", "table", table, "count", len(unparsed), "examples", unparsed[:min(len(unparsed), 5)])
+		}
+		slog.Info("Filled fact keys", "table", table, "questions", len(questions)-len(unparsed))
+	}
+	return nil
+}
+
+// groupFactCounts sums counts by commutative fact key
+func groupFactCounts(counts map[string]int) map[string]int {
+	grouped := make(map[string]int, len(counts))
+	for key, count := range counts {
+		grouped[commutativeFactKey(key)] += count
+	}
+	return grouped
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Leaderboard strategies rank the users of each exercise type:
+//   - best: the best complete run (40 questions, or 100 and 200 for Megamix), highest
+//     score first, then fastest mean time; runs without a time come after timed ones
+//   - average: the mean accuracy of the last runs, whatever their length
+//   - speed: accuracy-weighted speed, the correct answers per minute of the last timed runs
+//   - improved: the accuracy gained over a period, mean of the last runs of the period
+//     minus mean of the first ones (two runs at least)
+//
+// The last runs are the last N ("runs" parameter). With average and speed, users with
+// fewer runs are provisional and ranked after the others, so that one lucky run does
+// not own the leaderboard. The strategy of a request defaults to the group's, then to
+// [leaderboardconfig]. Within a time window (see requestWindow), only the runs of the
+// window count, and the period of improved is the window.
+
+const (
+	strategyBest     = "best"
+	strategyAverage  = "average"
+	strategySpeed    = "speed"
+	strategyImproved = "improved"
+
+	// maxLeaderboardRuns bounds the runs parameter
+	maxLeaderboardRuns = 50
+	// maxLeaderboardDays bounds the period of the improved strategy
+	maxLeaderboardDays = 366
+	// maxLeaderboardLimit bounds the page size
+	maxLeaderboardLimit = 500
+)
+
+// leaderboardStrategies lists the ranking strategies
+var leaderboardStrategies = map[string]bool{
+	strategyBest:     true,
+	strategyAverage:  true,
+	strategySpeed:    true,
+	strategyImproved: true,
+}
+
+// validateLeaderboardStrategy checks a strategy name
+func validateLeaderboardStrategy(name string) *APIError {
+	if !leaderboardStrategies[name] {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "strategy",
+			Message: fmt.Sprintf("unknown strategy %q, expected best, average, speed or improved", name)}
+	}
+	return nil
+}
+
+// LeaderboardRun is a result read to rank the users, chart their progress or export them
+type LeaderboardRun struct {
+	ID           int64
+	UserID       int64
+	UserName     string
+	ExerciseType string
+	Score        int
+	Total        int
+	// Tables is the JSON array of the tables of the run
+	Tables string
+	// MeanTimeSeconds is nil for runs saved without a time
+	MeanTimeSeconds *float64
+	CreatedAt       time.Time
+}
+
+// accuracy returns the ratio of correct answers of a run
+func (run LeaderboardRun) accuracy() float64 {
+	if run.Total <= 0 {
+		return 0
+	}
+	return float64(run.Score) / float64(run.Total)
+}
+
+// timed reports whether the run has a usable mean time
+func (run LeaderboardRun) timed() bool {
+	return run.MeanTimeSeconds != nil && *run.MeanTimeSeconds > 0
+}
+
+// completeRun reports whether a run is a complete exercise, as counted by the best strategy
+func completeRun(run LeaderboardRun) bool {
+	return run.Total == 40 || (run.ExerciseType == "mega" && (run.Total == 100 || run.Total == 200))
+}
+
+// betterRun reports whether a run beats another: higher score, then timed, then faster
+func betterRun(a, b LeaderboardRun) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if a.timed() != b.timed() {
+		return a.timed()
+	}
+	return a.timed() && *a.MeanTimeSeconds < *b.MeanTimeSeconds
+}
+
+// UserScore is the leaderboard entry of a user for an exercise type
+type UserScore struct {
+	// Rank is the position of the user among those of the exercise type, from 1
+	Rank         int    `json:"rank"`
+	UserID       int64  `json:"user_id"`
+	UserName     string `json:"user_name"`
+	ExerciseType string `json:"exercise_type"`
+	Strategy     string `json:"strategy"`
+	// CompositeScore is the value ranked by the strategy: the score of the best run, the
+	// mean accuracy in percent, correct answers per minute or percentage points gained
+	CompositeScore float64 `json:"composite_score"`
+	// Runs is the number of runs counted by the strategy
+	Runs int `json:"runs"`
+	// Provisional is true when the user has fewer runs than the strategy counts
+	Provisional bool `json:"provisional,omitempty"`
+	// BestScore, BestTotal and BestMeanTime describe the best of the runs counted
+	BestScore    int      `json:"best_score"`
+	BestTotal    int      `json:"best_total"`
+	BestMeanTime *float64 `json:"best_mean_time"`
+	best         LeaderboardRun
+}
+
+// leaderboardParams are the settings of a ranking
+type leaderboardParams struct {
+	Strategy string
+	Runs     int
+	// Since starts the period of the improved strategy
+	Since time.Time
+}
+
+// lastRuns returns the last n runs
+func lastRuns(runs []LeaderboardRun, n int) []LeaderboardRun {
+	return runs[max(len(runs)-n, 0):]
+}
+
+// meanOf averages a value over runs
+func meanOf(runs []LeaderboardRun, value func(LeaderboardRun) float64) float64 {
+	sum := 0.0
+	for _, run := range runs {
+		sum += value(run)
+	}
+	return sum / float64(len(runs))
+}
+
+// scoreRuns ranks the runs of a user for an exercise type, in chronological order.
+// It returns false when the strategy counts none of them.
+func scoreRuns(runs []LeaderboardRun, params leaderboardParams) (UserScore, bool) {
+	var counted []LeaderboardRun
+	var value float64
+	provisional := false
+	switch params.Strategy {
+	case strategyBest:
+		for _, run := range runs {
+			if completeRun(run) {
+				counted = append(counted, run)
+			}
+		}
+	case strategyAverage:
+		counted = lastRuns(runs, params.Runs)
+		value = meanOf(counted, LeaderboardRun.accuracy) * 100
+		provisional = len(counted) < params.Runs
+	case strategySpeed:
+		var timed []LeaderboardRun
+		for _, run := range runs {
+			if run.timed() && run.Total > 0 {
+				timed = append(timed, run)
+			}
+		}
+		if len(timed) == 0 {
+			return UserScore{}, false
+		}
+		counted = lastRuns(timed, params.Runs)
+		value = meanOf(counted, func(run LeaderboardRun) float64 {
+			return run.accuracy() * 60 / *run.MeanTimeSeconds
+		})
+		provisional = len(counted) < params.Runs
+	case strategyImproved:
+		for _, run := range runs {
+			if !run.CreatedAt.Before(params.Since) {
+				counted = append(counted, run)
+			}
+		}
+		if len(counted) < 2 {
+			return UserScore{}, false
+		}
+		n := min(params.Runs, len(counted)/2)
+		value = (meanOf(counted[len(counted)-n:], LeaderboardRun.accuracy) - meanOf(counted[:n], LeaderboardRun.accuracy)) * 100
+	}
+	if len(counted) == 0 {
+		return UserScore{}, false
+	}
+
+	best := counted[0]
+	for _, run := range counted[1:] {
+		if betterRun(run, best) {
+			best = run
+		}
+	}
+	if params.Strategy == strategyBest {
+		value = float64(best.Score)
+	}
+	return UserScore{
+		UserID:         best.UserID,
+		UserName:       best.UserName,
+		ExerciseType:   best.ExerciseType,
+		Strategy:       params.Strategy,
+		CompositeScore: math.Round(value*100) / 100,
+		Runs:           len(counted),
+		Provisional:    provisional,
+		BestScore:      best.Score,
+		BestTotal:      best.Total,
+		BestMeanTime:   best.MeanTimeSeconds,
+		best:           best,
+	}, true
+}
+
+// rankUsers ranks the users of each exercise type from their runs, ordered by user,
+// exercise type and time. Entries are sorted best first, ranks counting per type.
+func rankUsers(runs []LeaderboardRun, params leaderboardParams) []UserScore {
+	scores := []UserScore{}
+	for start := 0; start < len(runs); {
+		end := start + 1
+		for end < len(runs) && runs[end].UserID == runs[start].UserID && runs[end].ExerciseType == runs[start].ExerciseType {
+			end++
+		}
+		if score, ok := scoreRuns(runs[start:end], params); ok {
+			scores = append(scores, score)
+		}
+		start = end
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		a, b := scores[i], scores[j]
+		if a.Provisional != b.Provisional {
+			return !a.Provisional
+		}
+		if a.CompositeScore != b.CompositeScore {
+			return a.CompositeScore > b.CompositeScore
+		}
+		if betterRun(a.best, b.best) != betterRun(b.best, a.best) {
+			return betterRun(a.best, b.best)
+		}
+		if a.UserName != b.UserName {
+			return a.UserName < b.UserName
+		}
+		return a.UserID < b.UserID
+	})
+
+	ranks := make(map[string]int)
+	for i := range scores {
+		ranks[scores[i].ExerciseType]++
+		scores[i].Rank = ranks[scores[i].ExerciseType]
+	}
+	return scores
+}
+
+// intParam reads an optional integer query parameter within bounds
+func intParam(w http.ResponseWriter, r *http.Request, name string, value, lo, hi int) (int, bool) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return value, true
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n < lo || n > hi {
+		writeFieldError(w, codeInvalidField, name, fmt.Sprintf("%s must be between %d and %d", name, lo, hi))
+		return 0, false
+	}
+	return n, true
+}
+
+// GET /api/scores?strategy=S&type=T&runs=N&days=D&from=D&to=D&period=P&term=T&limit=L&offset=O - Leaderboard of
+// the group, best first. X-Total-Count gives the number of entries before pagination.
+func getAllScores(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+
+	exerciseType := strings.TrimSpace(q.Get("type"))
+	if exerciseType != "" && !exerciseTypes[exerciseType] {
+		writeFieldError(w, codeInvalidField, "type", "invalid type")
+		return
+	}
+
+	params := leaderboardParams{Strategy: strings.TrimSpace(q.Get("strategy"))}
+	if params.Strategy == "" && groupID != nil {
+		group, err := store.GroupByID(*groupID)
+		if err != nil {
+			slog.Error("Failed to query group", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		params.Strategy = group.LeaderboardStrategy
+	}
+	if params.Strategy == "" {
+		params.Strategy = config.LeaderboardConfig.Strategy
+	}
+	if err := validateLeaderboardStrategy(params.Strategy); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if params.Runs, ok = intParam(w, r, "runs", config.LeaderboardConfig.Runs, 1, maxLeaderboardRuns); !ok {
+		return
+	}
+	days, ok := intParam(w, r, "days", config.LeaderboardConfig.PeriodDays, 1, maxLeaderboardDays)
+	if !ok {
+		return
+	}
+	window, ok := requestWindow(w, r, groupID)
+	if !ok {
+		return
+	}
+	params.Since = time.Now().AddDate(0, 0, -days)
+	if window.bounded() {
+		params.Since = time.Time{}
+	}
+	limit, ok := intParam(w, r, "limit", maxLeaderboardLimit, 1, maxLeaderboardLimit)
+	if !ok {
+		return
+	}
+	offset, ok := intParam(w, r, "offset", 0, 0, math.MaxInt32)
+	if !ok {
+		return
+	}
+
+	runs, err := store.LeaderboardRuns(groupID, exerciseType, window)
+	if err != nil {
+		slog.Error("Failed to query scores", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	scores := rankUsers(runs, params)
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(scores)))
+	scores = scores[min(offset, len(scores)):min(offset+limit, len(scores))]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scores)
+}
+
+// addGroupLeaderboardStrategy adds the leaderboard strategy of the groups
+func addGroupLeaderboardStrategy(tx *Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE groups ADD COLUMN leaderboard_strategy TEXT`); err != nil {
+		return fmt.Errorf("failed to add leaderboard_strategy to groups: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// leaderboardRun builds a run of a user on the given day, untimed when mean is 0
+func leaderboardRun(userID int64, exerciseType string, score, total int, mean float64, day int) LeaderboardRun {
+	run := LeaderboardRun{
+		UserID:       userID,
+		UserName:     fmt.Sprintf("user%d", userID),
+		ExerciseType: exerciseType,
+		Score:        score,
+		Total:        total,
+		CreatedAt:    time.Date(2026, 3, 1+day, 17, 0, 0, 0, time.UTC),
+	}
+	if mean > 0 {
+		run.MeanTimeSeconds = &mean
+	}
+	return run
+}
+
+func TestRankUsers(t *testing.T) {
+	// Runs of users 1 to 4, ordered by user, exercise type and time
+	runs := []LeaderboardRun{
+		leaderboardRun(1, "mega", 95, 100, 4, 1),
+		leaderboardRun(1, "mul", 38, 40, 3, 1),
+		leaderboardRun(1, "mul", 10, 20, 2, 2),
+		leaderboardRun(1, "mul", 38, 40, 2.5, 3),
+		leaderboardRun(2, "mul", 40, 40, 0, 1),
+		leaderboardRun(3, "mul", 38, 40, 2, 1),
+		leaderboardRun(3, "mul", 30, 40, 3, 2),
+		leaderboardRun(4, "mul", 20, 20, 1, 1),
+	}
+	type entry struct {
+		userID       int64
+		exerciseType string
+		rank         int
+		score        float64
+		runs         int
+		provisional  bool
+	}
+	tests := []struct {
+		strategy string
+		want     []entry
+	}{
+		// Complete runs only: user 4 has none, user 3 beats user 1 on time
+		{strategyBest, []entry{
+			{1, "mega", 1, 95, 1, false},
+			{2, "mul", 1, 40, 1, false},
+			{3, "mul", 2, 38, 2, false},
+			{1, "mul", 3, 38, 2, false},
+		}},
+		// Mean accuracy of the last 2 runs, users with a single run ranked after the others,
+		// user 2 before user 4 on the better run
+		{strategyAverage, []entry{
+			{3, "mul", 1, 85, 2, false},
+			{1, "mul", 2, 72.5, 2, false},
+			{2, "mul", 3, 100, 1, true},
+			{4, "mul", 4, 100, 1, true},
+			{1, "mega", 1, 95, 1, true},
+		}},
+		// Correct answers per minute of the last 2 timed runs, user 2 never timed
+		{strategySpeed, []entry{
+			{3, "mul", 1, 21.75, 2, false},
+			{1, "mul", 2, 18.9, 2, false},
+			{4, "mul", 3, 60, 1, true},
+			{1, "mega", 1, 14.25, 1, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			scores := rankUsers(runs, leaderboardParams{Strategy: tt.strategy, Runs: 2})
+			got := make([]entry, len(scores))
+			for i, s := range scores {
+				got[i] = entry{s.UserID, s.ExerciseType, s.Rank, s.CompositeScore, s.Runs, s.Provisional}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rankUsers =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScoreRunsImproved(t *testing.T) {
+	params := leaderboardParams{Strategy: strategyImproved, Runs: 2, Since: time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)}
+	tests := []struct {
+		name  string
+		runs  []LeaderboardRun
+		score float64
+		ok    bool
+	}{
+		{"last two minus first two", []LeaderboardRun{
+			leaderboardRun(1, "mul", 20, 40, 0, 0), // before the period
+			leaderboardRun(1, "mul", 30, 40, 0, 1),
+			leaderboardRun(1, "mul", 34, 40, 0, 2),
+			leaderboardRun(1, "mul", 38, 40, 0, 3),
+			leaderboardRun(1, "mul", 40, 40, 0, 4),
+		}, 17.5, true},
+		{"odd count splits around the middle run", []LeaderboardRun{
+			leaderboardRun(1, "mul", 40, 40, 0, 1),
+			leaderboardRun(1, "mul", 36, 40, 0, 2),
+			leaderboardRun(1, "mul", 32, 40, 0, 3),
+		}, -20, true},
+		{"a single run in the period", []LeaderboardRun{
+			leaderboardRun(1, "mul", 10, 40, 0, 0),
+			leaderboardRun(1, "mul", 40, 40, 0, 1),
+		}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, ok := scoreRuns(tt.runs, params)
+			if ok != tt.ok || score.CompositeScore != tt.score {
+				t.Errorf("scoreRuns = %v, %v, want %v, %v", score.CompositeScore, ok, tt.score, tt.ok)
+			}
+		})
+	}
+}
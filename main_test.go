@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	stopTestPostgres()
+	os.Exit(code)
+}
+
+// useTestStore opens a new SQLite database with every migration applied as the
+// store of the test, with the default configuration
+func useTestStore(t *testing.T) {
+	t.Helper()
+	useStore(t, DBConfig{DBPath: filepath.Join(t.TempDir(), "test.db")})
+}
+
+// useStore opens a database with every migration applied as the store of the test,
+// with the default configuration and badge rules
+func useStore(t *testing.T, cfg DBConfig) {
+	t.Helper()
+	savedConfig := config
+	config = Config{
+		DBConfig:      cfg,
+		WebhookConfig: WebhookConfig{TimeoutSeconds: 10, MaxAttempts: 10},
+		GroupConfig:   GroupConfig{Timezone: "UTC"},
+	}
+	t.Cleanup(func() { config = savedConfig })
+	if err := loadBadgeRules(""); err != nil {
+		t.Fatalf("loadBadgeRules: %v", err)
+	}
+	if err := initDB(); err != nil {
+		if store != nil {
+			store.Close()
+		}
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		store, db = nil, nil
+	})
+}
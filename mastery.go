@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The mastery matrix shows how well each fact is known: a row per table and a
+// column per second operand, as in the decks of generateFlashcards. A cell holds the
+// answers logged in answer_events for its fact key, whatever the exercise they were
+// given in (Megamix included), and the errors counted in user_errors. A fact
+// belonging to several cells, such as "9 - 3" (table 9, or table 3 swapped) or the
+// factorisation of 12, counts in each of them. With commutative=true, "7 x 8" and
+// "8 x 7" count as the same fact.
+
+// MasteryCell is the mastery of a fact
+type MasteryCell struct {
+	Question string `json:"question"`
+	FactKey  string `json:"fact_key"`
+	Attempts int    `json:"attempts"`
+	Correct  int    `json:"correct"`
+	// Accuracy is Correct / Attempts, nil without attempts
+	Accuracy         *float64 `json:"accuracy"`
+	MedianResponseMs *int64   `json:"median_response_ms"`
+	// RecordedErrors is the error count of user_errors, which predates the answer log
+	RecordedErrors int `json:"recorded_errors"`
+}
+
+// MasteryMatrix is the mastery of the facts of an exercise type, Cells[row][column]
+type MasteryMatrix struct {
+	ExerciseType string          `json:"exercise_type"`
+	Commutative  bool            `json:"commutative"`
+	UserID       *int64          `json:"user_id,omitempty"`
+	GroupID      *int64          `json:"group_id,omitempty"`
+	Rows         []int           `json:"rows"`
+	Columns      []int           `json:"columns"`
+	Cells        [][]MasteryCell `json:"cells"`
+}
+
+// masteryColumns is the default number of columns, the second operands of the decks
+const masteryColumns = 10
+
+// masteryCard returns the flashcard of the fact of a cell
+func masteryCard(exerciseType string, table, i int) Flashcard {
+	if exerciseType == "fact" {
+		product := table * i
+		return Flashcard{
+			Question: strconv.Itoa(product) + " = ? x ?",
+			Type:     "fact",
+			Payload:  FlashcardPayload{Operands: []int{product}},
+		}
+	}
+	return newOperationFlashcard(exerciseType, table, i)
+}
+
+// medianMs returns the median of response times, nil when there are none
+func medianMs(times []int64) *int64 {
+	if len(times) == 0 {
+		return nil
+	}
+	slices.Sort(times)
+	median := times[len(times)/2]
+	if len(times)%2 == 0 {
+		median = (times[len(times)/2-1] + median) / 2
+	}
+	return &median
+}
+
+// GET /api/mastery?type=X&group_id=Y&user_id=Z&tables=1,2&columns=N&commutative=true&from=D&to=D&period=P - Mastery matrix of the
+// facts of a type, for a user or aggregated over the group
+func getMastery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+
+	exerciseType := strings.TrimSpace(q.Get("type"))
+	if exerciseType == "" {
+		exerciseType = "mul"
+	}
+	if !exerciseTypes[exerciseType] || exerciseType == "mega" {
+		writeFieldError(w, codeInvalidField, "type", "type must be mul, add, sub or fact")
+		return
+	}
+
+	columns := masteryColumns
+	if columnsParam := q.Get("columns"); columnsParam != "" {
+		n, err := strconv.Atoi(columnsParam)
+		if err != nil || n < 1 || n > maxTable {
+			writeFieldError(w, codeInvalidField, "columns", "columns must be between 1 and 12")
+			return
+		}
+		columns = n
+	}
+	commutative := q.Get("commutative") == "true"
+
+	tables, err := parseTables(q.Get("tables"))
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "tables", err.Error())
+		return
+	}
+	window, ok := requestWindow(w, r, groupID)
+	if !ok {
+		return
+	}
+	matrix := MasteryMatrix{ExerciseType: exerciseType, Commutative: commutative, GroupID: groupID, Rows: tables}
+	for i := 1; i <= columns; i++ {
+		matrix.Columns = append(matrix.Columns, i)
+	}
+
+	// cellKey is the key a fact is counted under, the same for both forms of a
+	// commutative fact
+	cellKey := func(key string) string {
+		if commutative {
+			return commutativeFactKey(key)
+		}
+		return key
+	}
+
+	// Cells of each key, and the fact keys to query
+	type cellIndex struct{ row, column int }
+	cellsOf := make(map[string][]cellIndex)
+	var factKeys []any
+	matrix.Cells = make([][]MasteryCell, len(matrix.Rows))
+	for row, table := range matrix.Rows {
+		matrix.Cells[row] = make([]MasteryCell, len(matrix.Columns))
+		for column, i := range matrix.Columns {
+			card := masteryCard(exerciseType, table, i)
+			key := cardFactKey(card)
+			matrix.Cells[row][column].Question = card.Question
+			matrix.Cells[row][column].FactKey = key
+			if _, ok := cellsOf[cellKey(key)]; !ok {
+				if commutative {
+					for _, k := range commutedFactKeys(key) {
+						factKeys = append(factKeys, k)
+					}
+				} else {
+					factKeys = append(factKeys, key)
+				}
+			}
+			cellsOf[cellKey(key)] = append(cellsOf[cellKey(key)], cellIndex{row, column})
+		}
+	}
+
+	var conditions []string
+	var args []any
+	if q.Get("user_id") != "" || strings.TrimSpace(q.Get("name")) != "" {
+		user, err := queryUser(r, groupID)
+		if err == errUserNotFound || err == errGroupNotFound {
+			writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to resolve user", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		matrix.UserID = &user.ID
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, user.ID)
+	}
+	if groupID != nil {
+		conditions = append(conditions, "group_id = ?")
+		args = append(args, *groupID)
+	}
+	conditions = append(conditions, "fact_key IN (?"+strings.Repeat(", ?", len(factKeys)-1)+")")
+	args = append(args, factKeys...)
+
+	// The time window applies to the answer log only: user_errors keeps no dates
+	windowCond, windowArgs := window.conditions("created_at")
+	answerConditions := append(slices.Clone(conditions), windowCond)
+	answerArgs := append(slices.Clone(args), windowArgs...)
+
+	rows, err := db.Query(`
+		SELECT fact_key, correct, response_ms
+		FROM answer_events
+		WHERE `+strings.Join(answerConditions, " AND "), answerArgs...)
+	if err != nil {
+		slog.Error("Failed to query answers", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	responseTimes := make(map[string][]int64)
+	for rows.Next() {
+		var key string
+		var correct int
+		var responseMs *int64
+		if err := rows.Scan(&key, &correct, &responseMs); err != nil {
+			slog.Error("Failed to scan row", "error", err)
+			continue
+		}
+		key = cellKey(key)
+		for _, c := range cellsOf[key] {
+			cell := &matrix.Cells[c.row][c.column]
+			cell.Attempts++
+			cell.Correct += correct
+		}
+		if responseMs != nil {
+			responseTimes[key] = append(responseTimes[key], *responseMs)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Failed to query answers", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	rows, err = db.Query(`
+		SELECT fact_key, SUM(error_count)
+		FROM user_errors
+		WHERE `+strings.Join(conditions, " AND ")+`
+		GROUP BY fact_key`, args...)
+	if err != nil {
+		slog.Error("Failed to query user errors", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var errors int
+		if err := rows.Scan(&key, &errors); err != nil {
+			slog.Error("Failed to scan row", "error", err)
+			continue
+		}
+		for _, c := range cellsOf[cellKey(key)] {
+			matrix.Cells[c.row][c.column].RecordedErrors += errors
+		}
+	}
+
+	for key, cells := range cellsOf {
+		median := medianMs(responseTimes[key])
+		for _, c := range cells {
+			cell := &matrix.Cells[c.row][c.column]
+			cell.MedianResponseMs = median
+			if cell.Attempts > 0 {
+				accuracy := float64(cell.Correct) / float64(cell.Attempts)
+				cell.Accuracy = &accuracy
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matrix)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Schema changes are numbered migrations, applied in order, each in its own
+// transaction, and recorded in schema_migrations so that they run exactly once.
+// Migrations are never edited once released: a schema change is a new migration
+// appended to the list. The first migrations use IF NOT EXISTS and column checks
+// because databases created before schema_migrations existed may already have them.
+
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *Tx) error
+}
+
+// sqliteMigrations lists every schema change of the SQLite store, by increasing version
+var sqliteMigrations = []migration{
+	{1, "create base tables", initBaseTables},
+	{2, "add group_id to per-user tables", addGroupColumns},
+	{3, "move records without group to the default group", migrateExistingDataToDefaultGroup},
+	{4, "create quiz session tables", initSessionTables},
+	{5, "create answer_events", initAnswerTables},
+	{6, "create review_schedule", initReviewTables},
+	{7, "create users and link records to user IDs", initUserTables},
+	{8, "add group admin PIN", initAdminTables},
+	{9, "create webhook_outbox", initWebhookTables},
+	{10, "create webhook_subscriptions", initWebhookSubscriptionTables},
+	{11, "create earned_badges", initBadgeTables},
+	{12, "create badge_rules", initBadgeRuleTables},
+	{13, "add table_number to earned_badges", addBadgeTableNumber},
+	{14, "add timezone to groups", addGroupTimezone},
+	{15, "add specialist badge decay", addSpecialistDecay},
+	{16, "add fact keys to user_errors and answer_events", addFactKeys},
+	{17, "add group leaderboard strategy", addGroupLeaderboardStrategy},
+	{18, "create group_terms", initGroupTerms},
+	{19, "key review_schedule by fact", keyReviewScheduleByFact},
+	{20, "backfill speed and lightning badges", backfillSpeedBadges},
+}
+
+// schemaVersion is the version of the schema expected by this binary
+func schemaVersion() int {
+	migrations := store.Migrations()
+	return migrations[len(migrations)-1].Version
+}
+
+// initMigrationTable creates the schema_migrations table
+func initMigrationTable() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// appliedMigrations returns the applied_at date of each applied version
+func appliedMigrations() (map[int]string, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// checkSchemaVersion refuses a database migrated by a newer binary
+func checkSchemaVersion(applied map[int]string) error {
+	for version := range applied {
+		if version > schemaVersion() {
+			return fmt.Errorf("database schema version %d is newer than this binary (version %d), refusing to start", version, schemaVersion())
+		}
+	}
+	return nil
+}
+
+// runMigrations applies the pending migrations in order
+func runMigrations() error {
+	if err := initMigrationTable(); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(applied); err != nil {
+		return err
+	}
+
+	for _, m := range store.Migrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records it, in a single transaction
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.Version, m.Name, formatDBTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// printMigrationStatus lists the migrations and whether they are applied
+func printMigrationStatus() error {
+	if err := initMigrationTable(); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, m := range store.Migrations() {
+		appliedAt, ok := applied[m.Version]
+		if !ok {
+			appliedAt = "pending"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, appliedAt)
+	}
+	for version, appliedAt := range applied {
+		if version > schemaVersion() {
+			fmt.Fprintf(tw, "%d\t(unknown to this binary)\t%s\n", version, appliedAt)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	return checkSchemaVersion(applied)
+}
+
+// columnExists reports whether a table has a column
+func columnExists(q dbtx, table, column string) (bool, error) {
+	var count int
+	err := q.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s: %w", table, err)
+	}
+	return count > 0, nil
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists
+func addColumnIfMissing(tx *Tx, table, column, definition string) (bool, error) {
+	exists, err := columnExists(tx, table, column)
+	if err != nil || exists {
+		return false, err
+	}
+	if _, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return false, fmt.Errorf("failed to add %s to %s: %w", column, table, err)
+	}
+	return true, nil
+}
+
+// runMigrateCommand runs the "migrate status" or "migrate up" command and returns the exit code
+func runMigrateCommand(command string) int {
+	var err error
+	switch command {
+	case "status":
+		store, err = openStore(config.DBConfig)
+		if err == nil {
+			db = store.DB()
+			err = printMigrationStatus()
+		}
+	case "up":
+		err = initDB()
+		if err == nil {
+			slog.Info("Migrations applied", "schema_version", schemaVersion())
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [-config path] migrate status|up\n", os.Args[0])
+		return 2
+	}
+	if store != nil {
+		store.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
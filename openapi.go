@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec documents the /api endpoints for the frontend and other clients.
+// It is kept by hand: update it with every change of an endpoint.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// GET /api/openapi.json - Returns the OpenAPI description of the API
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A minimal PDF writer: A4 pages of text in the standard Helvetica fonts, lines and
+// filled rectangles. It needs no font file and no external library. Text is encoded
+// as WinAnsi, which covers the accents of French names; other characters print as "?".
+
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+)
+
+// winAnsiSpecials maps the characters of WinAnsi codes 0x80 to 0x9F
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88,
+	'‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B,
+	'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F, '−': '-',
+}
+
+// pdfString returns a PDF string literal of a text in WinAnsi
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range s {
+		var c byte
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			c = byte(r)
+		case r < 0x20:
+			c = ' '
+		case r < 0x7F || (r >= 0xA0 && r <= 0xFF):
+			c = byte(r)
+		default:
+			special, ok := winAnsiSpecials[r]
+			if !ok {
+				special = '?'
+			}
+			c = special
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// pdfNumber formats a coordinate
+func pdfNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 32)
+}
+
+// pdfPage is the content stream of a page, in points from the bottom left corner
+type pdfPage struct {
+	content strings.Builder
+}
+
+// color sets the colour of the next text, lines and shapes, from 0 to 1
+func (p *pdfPage) color(red, green, blue float64) {
+	rgb := pdfNumber(red) + " " + pdfNumber(green) + " " + pdfNumber(blue)
+	fmt.Fprintf(&p.content, "%s rg %s RG\n", rgb, rgb)
+}
+
+// text writes a line of text at a baseline
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s Td %s Tj ET\n", font, pdfNumber(size), pdfNumber(x), pdfNumber(y), pdfString(s))
+}
+
+// line draws a segment
+func (p *pdfPage) line(x1, y1, x2, y2, width float64) {
+	p.polyline([][2]float64{{x1, y1}, {x2, y2}}, width)
+}
+
+// polyline draws connected segments
+func (p *pdfPage) polyline(points [][2]float64, width float64) {
+	if len(points) < 2 {
+		return
+	}
+	fmt.Fprintf(&p.content, "%s w ", pdfNumber(width))
+	for i, point := range points {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		fmt.Fprintf(&p.content, "%s %s %s ", pdfNumber(point[0]), pdfNumber(point[1]), op)
+	}
+	p.content.WriteString("S\n")
+}
+
+// rect fills a rectangle
+func (p *pdfPage) rect(x, y, width, height float64) {
+	fmt.Fprintf(&p.content, "%s %s %s %s re f\n", pdfNumber(x), pdfNumber(y), pdfNumber(width), pdfNumber(height))
+}
+
+// writePDF writes a document of pages
+func writePDF(w io.Writer, title string, pages []*pdfPage) error {
+	var buf bytes.Buffer
+	var offsets []int
+	// object starts object n, numbered from 1 in writing order
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1 to 5 are the catalog, the page tree, the fonts and the document
+	// information, then come a page and its content for each page
+	buf.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = strconv.Itoa(6+2*i) + " 0 R"
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title %s /Producer (flashCards) >>", pdfString(title)))
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 7+2*i))
+		content := page.content.String()
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scores and badges can be limited to a time window: from/to dates, or a named
+// period, in the timezone of the group. "week" starts on Monday and "month" on the
+// first day of the month; "term" is the term of the group including today, or the term
+// named by the term parameter. Terms are school terms set by the group admin, from
+// start_date to end_date included.
+
+// timeWindow bounds results in time, unbounded on a nil side. To is excluded.
+type timeWindow struct {
+	From *time.Time
+	To   *time.Time
+}
+
+// bounded reports whether the window has a bound
+func (tw timeWindow) bounded() bool {
+	return tw.From != nil || tw.To != nil
+}
+
+// contains reports whether a time is within the window
+func (tw timeWindow) contains(t time.Time) bool {
+	return (tw.From == nil || !t.Before(*tw.From)) && (tw.To == nil || t.Before(*tw.To))
+}
+
+// conditions returns the SQL conditions of the window on a time column
+func (tw timeWindow) conditions(column string) (string, []any) {
+	cond := "1 = 1"
+	var args []any
+	if tw.From != nil {
+		cond += " AND " + column + " >= ?"
+		args = append(args, formatDBTime(*tw.From))
+	}
+	if tw.To != nil {
+		cond += " AND " + column + " < ?"
+		args = append(args, formatDBTime(*tw.To))
+	}
+	return cond, args
+}
+
+// GroupTerm is a school term of a group
+type GroupTerm struct {
+	ID        int64  `json:"id"`
+	GroupID   int64  `json:"group_id"`
+	Name      string `json:"name"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+}
+
+// window returns the bounds of a term in a location
+func (term GroupTerm) window(loc *time.Location) timeWindow {
+	start, _ := time.ParseInLocation(time.DateOnly, term.StartDate, loc)
+	end, _ := time.ParseInLocation(time.DateOnly, term.EndDate, loc)
+	end = end.AddDate(0, 0, 1)
+	return timeWindow{From: &start, To: &end}
+}
+
+// validateGroupTerm checks and normalises a term
+func validateGroupTerm(term *GroupTerm) *APIError {
+	term.Name = strings.TrimSpace(term.Name)
+	if term.Name == "" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeMissingField, Field: "name", Message: "name required"}
+	}
+	if len(term.Name) > 64 {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "name", Message: "name too long"}
+	}
+	start, err := time.Parse(time.DateOnly, term.StartDate)
+	if err != nil {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "start_date", Message: "start_date must be YYYY-MM-DD"}
+	}
+	end, err := time.Parse(time.DateOnly, term.EndDate)
+	if err != nil {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "end_date", Message: "end_date must be YYYY-MM-DD"}
+	}
+	if end.Before(start) {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "end_date", Message: "end_date before start_date"}
+	}
+	return nil
+}
+
+// periodWindow returns the window of a named period including now, in a location
+func periodWindow(period string, now time.Time, loc *time.Location) timeWindow {
+	year, month, day := now.In(loc).Date()
+	var from, to time.Time
+	switch period {
+	case "week":
+		today := time.Date(year, month, day, 0, 0, 0, 0, loc)
+		from = today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+		to = from.AddDate(0, 0, 7)
+	case "month":
+		from = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		to = from.AddDate(0, 1, 0)
+	}
+	return timeWindow{From: &from, To: &to}
+}
+
+// requestWindow reads the time window of a request: from/to, or period and term. The
+// dates and periods are in the timezone of the group, the server default without one.
+func requestWindow(w http.ResponseWriter, r *http.Request, groupID *int64) (timeWindow, bool) {
+	q := r.URL.Query()
+	period := strings.TrimSpace(q.Get("period"))
+	termName := strings.TrimSpace(q.Get("term"))
+	if termName != "" {
+		if period != "" && period != "term" {
+			writeFieldError(w, codeInvalidField, "term", "term requires period=term")
+			return timeWindow{}, false
+		}
+		period = "term"
+	}
+	if period != "" && (q.Get("from") != "" || q.Get("to") != "") {
+		writeFieldError(w, codeInvalidField, "period", "period cannot be combined with from or to")
+		return timeWindow{}, false
+	}
+
+	var group *Group
+	if groupID != nil {
+		var err error
+		if group, err = store.GroupByID(*groupID); err != nil {
+			slog.Error("Failed to query group", "error", err)
+			writeDatabaseError(w)
+			return timeWindow{}, false
+		}
+	}
+	timezone := ""
+	if group != nil {
+		timezone = group.Timezone
+	}
+	loc := groupLocation(timezone)
+	now := time.Now()
+
+	if period == "" {
+		var tw timeWindow
+		for _, bound := range []struct {
+			param string
+			upper bool
+			dest  **time.Time
+		}{{"from", false, &tw.From}, {"to", true, &tw.To}} {
+			value := q.Get(bound.param)
+			if value == "" {
+				continue
+			}
+			t, err := parseDateParam(value, bound.upper, loc)
+			if err != nil {
+				writeFieldError(w, codeInvalidField, bound.param, "invalid "+bound.param)
+				return timeWindow{}, false
+			}
+			*bound.dest = &t
+		}
+		return tw, true
+	}
+
+	switch period {
+	case "week", "month":
+		return periodWindow(period, now, loc), true
+	case "term":
+		if group == nil {
+			writeFieldError(w, codeMissingField, "group_id", "period=term requires a group")
+			return timeWindow{}, false
+		}
+		terms, err := store.GroupTerms(group.ID)
+		if err != nil {
+			slog.Error("Failed to query group terms", "error", err)
+			writeDatabaseError(w)
+			return timeWindow{}, false
+		}
+		for _, term := range terms {
+			if termName != "" && term.Name == termName {
+				return term.window(loc), true
+			}
+			if tw := term.window(loc); termName == "" && tw.contains(now) {
+				return tw, true
+			}
+		}
+		if termName != "" {
+			writeError(w, http.StatusNotFound, codeNotFound, "term not found")
+		} else {
+			writeError(w, http.StatusNotFound, codeNotFound, "no term includes today")
+		}
+		return timeWindow{}, false
+	}
+	writeFieldError(w, codeInvalidField, "period", "period must be week, month or term")
+	return timeWindow{}, false
+}
+
+// initGroupTerms creates the group_terms table
+func initGroupTerms(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS group_terms (
+			id ` + tx.autoIncrementID() + `,
+			group_id BIGINT NOT NULL REFERENCES groups(id),
+			name TEXT NOT NULL,
+			start_date TEXT NOT NULL,
+			end_date TEXT NOT NULL,
+			UNIQUE(group_id, name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create group_terms table: %w", err)
+	}
+	return nil
+}
+
+// GET /api/groups/{id}/terms - List the terms of a group
+func listGroupTerms(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	terms, err := store.GroupTerms(groupID)
+	if err != nil {
+		slog.Error("Failed to query group terms", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if terms == nil {
+		terms = []GroupTerm{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(terms)
+}
+
+// POST /api/groups/{id}/terms - Add a term to a group (admin)
+func createGroupTerm(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+
+	var term GroupTerm
+	if err := json.NewDecoder(r.Body).Decode(&term); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if err := validateGroupTerm(&term); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	term.GroupID = groupID
+
+	created, err := store.CreateGroupTerm(&term)
+	if err != nil {
+		slog.Error("Failed to create group term", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !created {
+		writeAPIError(w, &APIError{Status: http.StatusConflict, Code: codeConflict, Field: "name", Message: "term already exists"})
+		return
+	}
+	slog.Info("Group term created", "group_id", groupID, "term", term.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(term)
+}
+
+// DELETE /api/groups/{id}/terms/{termID} - Remove a term of a group (admin)
+func deleteGroupTerm(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	termID, err := strconv.ParseInt(r.PathValue("termID"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "termID", "invalid term id")
+		return
+	}
+
+	deleted, err := store.DeleteGroupTerm(groupID, termID)
+	if err != nil {
+		slog.Error("Failed to delete group term", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, codeNotFound, "term not found")
+		return
+	}
+	slog.Info("Group term deleted", "group_id", groupID, "term_id", termID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestWindowInGroupTimezone(t *testing.T) {
+	useTestStore(t)
+	group, err := store.CreateGroup("Paris", "paris-key", nil, "Europe/Paris")
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	paris, _ := time.LoadLocation("Europe/Paris")
+
+	tests := []struct {
+		query    string
+		groupID  *int64
+		from, to time.Time
+	}{
+		// Days start at midnight in the group timezone, to includes its whole day
+		{"from=2026-03-01&to=2026-03-31", &group.ID,
+			time.Date(2026, 3, 1, 0, 0, 0, 0, paris), time.Date(2026, 4, 1, 0, 0, 0, 0, paris)},
+		// Timestamps are kept as given
+		{"from=2026-03-01T08:00:00Z", &group.ID, time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC), time.Time{}},
+		// Without a group, the server default timezone
+		{"from=2026-03-01&to=2026-03-01", nil,
+			time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		window, ok := requestWindow(w, httptest.NewRequest("GET", "/api/scores?"+tt.query, nil), tt.groupID)
+		if !ok {
+			t.Fatalf("requestWindow(%s) failed: %s", tt.query, w.Body)
+		}
+		if window.From == nil || !window.From.Equal(tt.from) {
+			t.Errorf("requestWindow(%s) from = %v, want %v", tt.query, window.From, tt.from)
+		}
+		if (window.To == nil) != tt.to.IsZero() || (window.To != nil && !window.To.Equal(tt.to)) {
+			t.Errorf("requestWindow(%s) to = %v, want %v", tt.query, window.To, tt.to)
+		}
+	}
+}
+
+func TestWindowText(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, paris)
+	to := time.Date(2026, 4, 1, 0, 0, 0, 0, paris)
+	if got, want := windowText(timeWindow{From: &from, To: &to}, paris), "Du "+frenchDate("2026-03-01")+" au "+frenchDate("2026-03-31"); got != want {
+		t.Errorf("windowText = %q, want %q", got, want)
+	}
+}
+
+func TestAnswersWindowInGroupTimezone(t *testing.T) {
+	useTestStore(t)
+	group, err := store.CreateGroup("Paris", "paris-key", nil, "Europe/Paris")
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	user, err := createUser(group.ID, "Ann")
+	if err != nil {
+		t.Fatalf("createUser: %v", err)
+	}
+	// 00:30 on March 1st in Paris, still February in UTC
+	answeredAt := time.Date(2026, 2, 28, 23, 30, 0, 0, time.UTC)
+	_, err = db.Exec(`
+		INSERT INTO answer_events (session_id, position, user_id, user_name, group_id, exercise_type, question, fact_key, question_type, correct, response_ms, created_at)
+		VALUES ('s1', 0, ?, ?, ?, 'mul', '7 x 8', 'mul:7:8', 'mul', 1, 1200, ?)
+	`, user.ID, user.Name, group.ID, formatDBTime(answeredAt))
+	if err != nil {
+		t.Fatalf("inserting an answer: %v", err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/api/answers?from=2026-03-01", `"question":"7 x 8"`},
+		{"/api/answers?to=2026-02-28", "[]"},
+		{"/api/mastery?tables=7&from=2026-03-01", `"attempts":1`},
+		{"/api/mastery?tables=7&to=2026-02-28", `"attempts":0`},
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set(groupKeyHeader, group.SecretKey)
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(tt.path, "/api/answers") {
+			getAnswers(w, req)
+		} else {
+			getMastery(w, req)
+		}
+		if w.Code != 200 || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("GET %s = %d %s, want %s", tt.path, w.Code, w.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The progress of a user is a time series of their results, bucketed by day or by
+// week (from Monday) in the timezone of their group. Only the buckets with results
+// are listed.
+
+// ProgressPoint is the activity of a user over a bucket
+type ProgressPoint struct {
+	// Start is the first day of the bucket
+	Start     string `json:"start"`
+	Sessions  int    `json:"sessions"`
+	Questions int    `json:"questions"`
+	Correct   int    `json:"correct"`
+	// Accuracy is Correct / Questions
+	Accuracy float64 `json:"accuracy"`
+	// MeanTimeSeconds is the mean answer time over the timed results, nil without any
+	MeanTimeSeconds *float64 `json:"mean_time_seconds"`
+	timedQuestions  int
+	timeSum         float64
+}
+
+// UserProgress is the progress of a user
+type UserProgress struct {
+	UserID   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+	GroupID  int64  `json:"group_id"`
+	// ExerciseType is empty for every exercise type
+	ExerciseType string          `json:"exercise_type,omitempty"`
+	Bucket       string          `json:"bucket"`
+	Timezone     string          `json:"timezone"`
+	Points       []ProgressPoint `json:"points"`
+}
+
+// progressBucket returns the first day of the bucket of a time
+func progressBucket(t time.Time, loc *time.Location, bucket string) time.Time {
+	day := practiceDay(t, loc)
+	if bucket == "week" {
+		day = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+// progressPoints buckets runs in chronological order
+func progressPoints(runs []LeaderboardRun, loc *time.Location, bucket string) []ProgressPoint {
+	points := []ProgressPoint{}
+	for _, run := range runs {
+		start := progressBucket(run.CreatedAt, loc, bucket).Format(time.DateOnly)
+		if len(points) == 0 || points[len(points)-1].Start != start {
+			points = append(points, ProgressPoint{Start: start})
+		}
+		points[len(points)-1].add(run)
+	}
+	for i := range points {
+		points[i].finish()
+	}
+	return points
+}
+
+// add counts a run in a point
+func (point *ProgressPoint) add(run LeaderboardRun) {
+	point.Sessions++
+	point.Questions += run.Total
+	point.Correct += run.Score
+	if run.timed() {
+		point.timedQuestions += run.Total
+		point.timeSum += *run.MeanTimeSeconds * float64(run.Total)
+	}
+}
+
+// finish computes the accuracy and mean time of a point once its runs are added
+func (point *ProgressPoint) finish() {
+	if point.Questions > 0 {
+		point.Accuracy = float64(point.Correct) / float64(point.Questions)
+	}
+	if point.timedQuestions > 0 {
+		meanTime := point.timeSum / float64(point.timedQuestions)
+		point.MeanTimeSeconds = &meanTime
+	}
+}
+
+// GET /api/users/{id}/progress?type=T&bucket=day|week&from=D&to=D&period=P - Accuracy, mean time, sessions
+// and questions of a user over time
+func getUserProgress(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "id", "invalid user id")
+		return
+	}
+
+	exerciseType := strings.TrimSpace(q.Get("type"))
+	if exerciseType != "" && !exerciseTypes[exerciseType] {
+		writeFieldError(w, codeInvalidField, "type", "invalid type")
+		return
+	}
+	bucket := q.Get("bucket")
+	if bucket == "" {
+		bucket = "day"
+	}
+	if bucket != "day" && bucket != "week" {
+		writeFieldError(w, codeInvalidField, "bucket", "bucket must be day or week")
+		return
+	}
+
+	user, err := loadUser(userID)
+	if err == errUserNotFound || (err == nil && groupID != nil && user.GroupID != *groupID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	group, err := store.GroupByID(user.GroupID)
+	if err != nil {
+		slog.Error("Failed to query group", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	window, ok := requestWindow(w, r, &user.GroupID)
+	if !ok {
+		return
+	}
+
+	runs, err := store.UserRuns(user.ID, exerciseType, window)
+	if err != nil {
+		slog.Error("Failed to query results", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	loc := groupLocation(group.Timezone)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserProgress{
+		UserID:       user.ID,
+		UserName:     user.Name,
+		GroupID:      user.GroupID,
+		ExerciseType: exerciseType,
+		Bucket:       bucket,
+		Timezone:     loc.String(),
+		Points:       progressPoints(runs, loc, bucket),
+	})
+}
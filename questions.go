@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Flashcard is a fully-formed question. Question and Answer are the display
+// strings used by the browser; Payload carries the typed data so that any
+// client can check an answer without parsing the question text.
+type Flashcard struct {
+	Question   string           `json:"question"`
+	Answer     string           `json:"answer"`
+	TimesWrong int              `json:"times_wrong"`
+	Type       string           `json:"type"`
+	Payload    FlashcardPayload `json:"payload"`
+}
+
+// FlashcardPayload describes the operation behind a flashcard.
+// For "fact" cards, Operands holds the product and ValidFactors the accepted pairs.
+type FlashcardPayload struct {
+	Operands     []int    `json:"operands"`
+	Operator     string   `json:"operator"`
+	Answer       *int     `json:"answer,omitempty"`
+	ValidFactors [][2]int `json:"valid_factors,omitempty"`
+}
+
+// exerciseTypes lists the exercise types understood by the server
+var exerciseTypes = map[string]bool{
+	"mul":  true,
+	"add":  true,
+	"sub":  true,
+	"fact": true,
+	"mega": true,
+}
+
+// maxTable is the highest table available in every exercise type
+const maxTable = 12
+
+// Time allowed to answer a question, matching the limits of the browser quiz
+const (
+	timeLimit     = 6 * time.Second
+	timeLimitFact = 9 * time.Second
+)
+
+// GET /api/flashcards?type=X&tables=1,2,3 - Returns the full deck for an exercise type
+func getFlashcards(w http.ResponseWriter, r *http.Request) {
+	exerciseType := strings.TrimSpace(r.URL.Query().Get("type"))
+	if exerciseType == "" {
+		exerciseType = "mul"
+	}
+	if !exerciseTypes[exerciseType] {
+		writeFieldError(w, codeInvalidField, "type", "invalid type")
+		return
+	}
+
+	// Récupérer les tables sélectionnées depuis les paramètres de la requête
+	selectedTables, err := parseTables(r.URL.Query().Get("tables"))
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "tables", err.Error())
+		return
+	}
+
+	// Générer les flashcards en fonction des tables sélectionnées
+	flashcards, err := generateFlashcards(exerciseType, selectedTables)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "type", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flashcards)
+}
+
+// parseTables parses a comma-separated list of tables, ignoring invalid entries.
+// An empty list selects every table; a list without any valid table is an error.
+func parseTables(tablesParam string) ([]int, error) {
+	var selectedTables []int
+	if tablesParam != "" {
+		for _, t := range strings.Split(tablesParam, ",") {
+			table, err := strconv.Atoi(strings.TrimSpace(t))
+			if err == nil && table >= 1 && table <= maxTable {
+				selectedTables = append(selectedTables, table)
+			}
+		}
+	}
+	if len(selectedTables) == 0 {
+		if tablesParam != "" {
+			return nil, fmt.Errorf("tables must be between 1 and %d", maxTable)
+		}
+		// Si aucun paramètre, utiliser toutes les tables
+		selectedTables = allTables()
+	}
+	return selectedTables, nil
+}
+
+// allTables returns the tables 1 to maxTable
+func allTables() []int {
+	tables := make([]int, 0, maxTable)
+	for i := 1; i <= maxTable; i++ {
+		tables = append(tables, i)
+	}
+	return tables
+}
+
+// generateFlashcards builds the deck for an exercise type.
+// Megamix ignores the selected tables and mixes every type over all tables.
+func generateFlashcards(exerciseType string, selectedTables []int) ([]Flashcard, error) {
+	switch exerciseType {
+	case "mul", "add", "sub":
+		return generateOperationFlashcards(exerciseType, selectedTables), nil
+	case "fact":
+		return generateFactorFlashcards(selectedTables), nil
+	case "mega":
+		return generateMegamixFlashcards(), nil
+	default:
+		return nil, fmt.Errorf("unknown exercise type %q", exerciseType)
+	}
+}
+
+// generateOperationFlashcards builds "a op b = ?" cards for mul, add and sub
+func generateOperationFlashcards(exerciseType string, selectedTables []int) []Flashcard {
+	var flashcards []Flashcard
+	for i := 1; i <= 10; i++ {
+		for _, table := range selectedTables {
+			flashcards = append(flashcards, newOperationFlashcard(exerciseType, table, i))
+		}
+	}
+	return flashcards
+}
+
+// newOperationFlashcard builds a single mul, add or sub card.
+// Subtractions are ordered so that the result is never negative.
+func newOperationFlashcard(exerciseType string, a, b int) Flashcard {
+	var operator string
+	var result int
+	switch exerciseType {
+	case "add":
+		operator = "+"
+		result = a + b
+	case "sub":
+		operator = "-"
+		if b > a {
+			a, b = b, a
+		}
+		result = a - b
+	default:
+		operator = "x"
+		result = a * b
+	}
+
+	return Flashcard{
+		Question: fmt.Sprintf("%d %s %d = ?", a, operator, b),
+		Answer:   strconv.Itoa(result),
+		Type:     exerciseType,
+		Payload: FlashcardPayload{
+			Operands: []int{a, b},
+			Operator: operator,
+			Answer:   &result,
+		},
+	}
+}
+
+// generateFactorFlashcards builds "n = ? x ?" cards for each unique product of the
+// selected tables, skipping products without a valid factor pair
+func generateFactorFlashcards(selectedTables []int) []Flashcard {
+	var flashcards []Flashcard
+	seen := make(map[int]bool)
+	for i := 1; i <= 10; i++ {
+		for _, table := range selectedTables {
+			product := table * i
+			if seen[product] {
+				continue
+			}
+			seen[product] = true
+
+			validFactors := getFactorPairs(product)
+			if len(validFactors) == 0 {
+				continue
+			}
+			flashcards = append(flashcards, Flashcard{
+				Question: fmt.Sprintf("%d = ? x ?", product),
+				Type:     "fact",
+				Payload: FlashcardPayload{
+					Operands:     []int{product},
+					Operator:     "factor",
+					ValidFactors: validFactors,
+				},
+			})
+		}
+	}
+	return flashcards
+}
+
+// generateMegamixFlashcards mixes mul, add, sub and fact cards over all tables
+func generateMegamixFlashcards() []Flashcard {
+	tables := allTables()
+	var flashcards []Flashcard
+	flashcards = append(flashcards, generateOperationFlashcards("mul", tables)...)
+	flashcards = append(flashcards, generateOperationFlashcards("add", tables)...)
+	flashcards = append(flashcards, generateOperationFlashcards("sub", tables)...)
+	flashcards = append(flashcards, generateFactorFlashcards(tables)...)
+	return flashcards
+}
+
+// getFactorPairs returns every factor pair of n where both factors are <= maxTable.
+// The pair 1 x n is excluded unless it is the only option.
+// Ex: getFactorPairs(12) returns [[2,6], [3,4]], getFactorPairs(7) returns [[1,7]]
+func getFactorPairs(n int) [][2]int {
+	var pairs [][2]int
+	for i := 1; i*i <= n; i++ {
+		if n%i != 0 {
+			continue
+		}
+		other := n / i
+		if i <= maxTable && other <= maxTable {
+			pairs = append(pairs, [2]int{i, other})
+		}
+	}
+	if len(pairs) > 1 {
+		filtered := pairs[:0]
+		for _, pair := range pairs {
+			if pair[0] != 1 {
+				filtered = append(filtered, pair)
+			}
+		}
+		pairs = filtered
+	}
+	return pairs
+}
+
+// questionTimeLimit returns the time allowed to answer a flashcard
+func questionTimeLimit(card Flashcard) time.Duration {
+	if card.Type == "fact" {
+		return timeLimitFact
+	}
+	return timeLimit
+}
+
+// checkAnswer reports whether the given answer is correct for a flashcard.
+// Factorisation answers accept "3,4", "3x4", "3*4" or "3 4", in any order.
+func checkAnswer(card Flashcard, answer string) bool {
+	answer = strings.TrimSpace(answer)
+	if card.Type != "fact" {
+		return answer != "" && strings.EqualFold(answer, card.Answer)
+	}
+
+	parts := strings.FieldsFunc(strings.ToLower(answer), func(r rune) bool {
+		return r == ',' || r == 'x' || r == '*' || r == '×' || unicode.IsSpace(r)
+	})
+	if len(parts) != 2 {
+		return false
+	}
+	a, errA := strconv.Atoi(parts[0])
+	b, errB := strconv.Atoi(parts[1])
+	if errA != nil || errB != nil {
+		return false
+	}
+	for _, pair := range card.Payload.ValidFactors {
+		if (pair[0] == a && pair[1] == b) || (pair[0] == b && pair[1] == a) {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedAnswer returns the correct answer as shown to the user,
+// e.g. "56" or "2 x 6 ou 3 x 4" for factorisation
+func expectedAnswer(card Flashcard) string {
+	if card.Type != "fact" {
+		return card.Answer
+	}
+	parts := make([]string, 0, len(card.Payload.ValidFactors))
+	for _, pair := range card.Payload.ValidFactors {
+		parts = append(parts, fmt.Sprintf("%d x %d", pair[0], pair[1]))
+	}
+	return strings.Join(parts, " ou ")
+}
+
+// withoutAnswer returns a copy of the flashcard with the expected answer removed,
+// for decks whose answers are checked by the server
+func withoutAnswer(card Flashcard) Flashcard {
+	card.Answer = ""
+	card.Payload.Answer = nil
+	card.Payload.ValidFactors = nil
+	return card
+}
+
+// selectWeightedFlashcards picks count cards at random without replacement.
+// weights gives the weight of a commutative fact key (see reviewWeights); the others weigh 1.
+func selectWeightedFlashcards(cards []Flashcard, weights map[string]int, count int) []Flashcard {
+	if len(cards) <= count {
+		selected := append([]Flashcard(nil), cards...)
+		rand.Shuffle(len(selected), func(i, j int) { selected[i], selected[j] = selected[j], selected[i] })
+		return selected
+	}
+
+	remaining := append([]Flashcard(nil), cards...)
+	cardWeights := make([]int, len(remaining))
+	totalWeight := 0
+	for i, card := range remaining {
+		cardWeights[i] = 1
+		if weight, ok := weights[commutativeFactKey(cardFactKey(card))]; ok && weight > 0 {
+			cardWeights[i] = weight
+		}
+		totalWeight += cardWeights[i]
+	}
+
+	selected := make([]Flashcard, 0, count)
+	for len(selected) < count && len(remaining) > 0 {
+		pick := rand.IntN(totalWeight)
+		for i := range remaining {
+			pick -= cardWeights[i]
+			if pick < 0 {
+				selected = append(selected, remaining[i])
+				totalWeight -= cardWeights[i]
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				cardWeights = append(cardWeights[:i], cardWeights[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// The weighted draw already yields a random order
+	return selected
+}
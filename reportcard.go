@@ -0,0 +1,548 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A report card is a one-page PDF summary of a pupil for parent-teacher meetings: best
+// scores per exercise type, badges, specialist badges, most-missed facts and a chart of
+// the accuracy over time. The time window (see requestWindow) applies to the scores,
+// badges and chart; specialist badges and missed facts are the current ones. Like the
+// app, report cards are written in French.
+
+const (
+	// reportCardBadges, reportCardSpecialists and reportCardFacts bound the lists of a
+	// report card, for it to fit on one page
+	reportCardBadges      = 16
+	reportCardSpecialists = 8
+	reportCardFacts       = 10
+	// reportCardDays is the longest span of results charted by day, by week beyond
+	reportCardDays = 31
+)
+
+// reportCardTypeNames are the names of the exercise types, in report card order
+var reportCardTypeNames = []struct{ Type, Name string }{
+	{"mul", "Multiplications"},
+	{"add", "Additions"},
+	{"sub", "Soustractions"},
+	{"fact", "Exo Mama"},
+	{"mega", "Megamix"},
+}
+
+// reportCardBadgeNames are the names of the badge levels
+var reportCardBadgeNames = map[string]string{
+	"diamond": "Diamant",
+	"gold":    "Or",
+	"silver":  "Argent",
+	"bronze":  "Bronze",
+}
+
+// reportCard is the content of the report card of a user
+type reportCard struct {
+	User   User
+	Group  *Group
+	Window timeWindow
+	// Runs are the results of the window, in chronological order
+	Runs       []LeaderboardRun
+	Badges     []UserBadge
+	Specialist []SpecialistBadge
+	// Errors are the most missed facts, most missed first
+	Errors []UserError
+}
+
+// buildReportCards gathers the report cards of users of a group within a window
+func buildReportCards(group *Group, users []User, window timeWindow) ([]reportCard, error) {
+	runs, err := store.LeaderboardRuns(&group.ID, "", window)
+	if err != nil {
+		return nil, err
+	}
+	badges, err := userBadges(&group.ID, window)
+	if err != nil {
+		return nil, err
+	}
+	specialists, err := store.SpecialistBadges(&group.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	cards := make([]reportCard, len(users))
+	index := make(map[int64]*reportCard, len(users))
+	for i, user := range users {
+		cards[i] = reportCard{User: user, Group: group, Window: window}
+		index[user.ID] = &cards[i]
+	}
+	for _, run := range runs {
+		if card, ok := index[run.UserID]; ok {
+			card.Runs = append(card.Runs, run)
+		}
+	}
+	for _, badge := range badges {
+		if card, ok := index[badge.UserID]; ok {
+			card.Badges = append(card.Badges, badge)
+		}
+	}
+	for _, specialist := range specialists {
+		if card, ok := index[specialist.UserID]; ok && specialist.BadgeEarned {
+			card.Specialist = append(card.Specialist, specialist)
+		}
+	}
+
+	for i := range cards {
+		card := &cards[i]
+		// Runs come ordered by exercise type first
+		sort.SliceStable(card.Runs, func(i, j int) bool {
+			if !card.Runs[i].CreatedAt.Equal(card.Runs[j].CreatedAt) {
+				return card.Runs[i].CreatedAt.Before(card.Runs[j].CreatedAt)
+			}
+			return card.Runs[i].ID < card.Runs[j].ID
+		})
+		if card.Errors, err = missedFacts(card.User.ID, reportCardFacts); err != nil {
+			return nil, err
+		}
+	}
+	return cards, nil
+}
+
+// missedFacts returns the facts a user missed most over every exercise type. The errors
+// of a fact asked in several types (such as in Megamix) or in both orders ("7 x 8" and
+// "8 x 7") add up, under the question missed most.
+func missedFacts(userID int64, limit int) ([]UserError, error) {
+	var missed []UserError
+	index := make(map[string]int)
+	// most is the error count of the question shown for each fact
+	var most []int
+	for _, exerciseType := range reportCardTypeNames {
+		errors, err := store.UserErrors(userID, exerciseType.Type)
+		if err != nil {
+			return nil, err
+		}
+		for _, ue := range errors {
+			key := commutativeFactKey(ue.FactKey)
+			if key == "" {
+				key = ue.Question
+			}
+			if i, ok := index[key]; ok {
+				missed[i].ErrorCount += ue.ErrorCount
+				if ue.ErrorCount > most[i] {
+					missed[i].Question, missed[i].FactKey, most[i] = ue.Question, ue.FactKey, ue.ErrorCount
+				}
+				continue
+			}
+			index[key] = len(missed)
+			missed = append(missed, ue)
+			most = append(most, ue.ErrorCount)
+		}
+	}
+	sort.SliceStable(missed, func(i, j int) bool {
+		return missed[i].ErrorCount > missed[j].ErrorCount
+	})
+	return missed[:min(limit, len(missed))], nil
+}
+
+// reportCardTypeName returns the name of an exercise type
+func reportCardTypeName(exerciseType string) string {
+	for _, t := range reportCardTypeNames {
+		if t.Type == exerciseType {
+			return t.Name
+		}
+	}
+	return exerciseType
+}
+
+// frenchDecimal formats a number with a decimal comma
+func frenchDecimal(f float64, decimals int) string {
+	return strings.Replace(strconv.FormatFloat(f, 'f', decimals, 64), ".", ",", 1)
+}
+
+// frenchDate formats the day of a time or of a "YYYY-MM-DD..." text as DD/MM/YYYY
+func frenchDate(day string) string {
+	if len(day) < len(time.DateOnly) {
+		return day
+	}
+	t, err := time.Parse(time.DateOnly, day[:len(time.DateOnly)])
+	if err != nil {
+		return day
+	}
+	return t.Format("02/01/2006")
+}
+
+// truncateText shortens a text to a number of characters
+func truncateText(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// windowDay returns the day of a window bound in a location
+func windowDay(t time.Time, loc *time.Location) string {
+	return frenchDate(t.In(loc).Format(time.DateOnly))
+}
+
+// windowText describes a window in a location
+func windowText(window timeWindow, loc *time.Location) string {
+	var from, to string
+	if window.From != nil {
+		from = windowDay(*window.From, loc)
+	}
+	if window.To != nil {
+		// To is excluded: the period ends the day before
+		to = windowDay(window.To.In(loc).AddDate(0, 0, -1), loc)
+	}
+	switch {
+	case from != "" && to != "":
+		return "Du " + from + " au " + to
+	case from != "":
+		return "Depuis le " + from
+	case to != "":
+		return "Jusqu'au " + to
+	}
+	return "Tous les résultats"
+}
+
+// reportCardColumns writes lines in two columns from the top of a section and returns
+// the baseline below them
+func reportCardColumns(page *pdfPage, y float64, lines []string) float64 {
+	rows := (len(lines) + 1) / 2
+	for i, line := range lines {
+		x := 50.0
+		if i >= rows {
+			x = 310
+		}
+		page.text(x, y-float64(i%rows)*14, 10, false, truncateText(line, 46))
+	}
+	return y - float64(rows)*14 - 8
+}
+
+// renderReportCard lays out a report card on a page
+func renderReportCard(card reportCard, now time.Time) *pdfPage {
+	page := &pdfPage{}
+	loc := groupLocation(card.Group.Timezone)
+	grey := func() { page.color(0.4, 0.4, 0.4) }
+	black := func() { page.color(0, 0, 0) }
+	section := func(y float64, title string) float64 {
+		black()
+		page.text(50, y, 13, true, title)
+		return y - 18
+	}
+
+	// Header
+	black()
+	page.text(50, 790, 20, true, truncateText("Bulletin de "+card.User.Name, 40))
+	grey()
+	page.text(50, 770, 11, false, truncateText("Groupe "+card.Group.Name, 60))
+	page.text(50, 755, 11, false, windowText(card.Window, loc))
+	page.text(400, 755, 9, false, "Édité le "+frenchDate(now.In(loc).Format(time.DateOnly)))
+	page.line(50, 745, pdfPageWidth-50, 745, 0.5)
+	y := 720.0
+
+	// Best score, sessions and accuracy of each exercise type
+	y = section(y, "Meilleurs scores")
+	if len(card.Runs) == 0 {
+		grey()
+		page.text(50, y, 10, false, "Aucun résultat sur la période.")
+		y -= 22
+	} else {
+		columns := []float64{50, 170, 280, 380, 460}
+		grey()
+		for i, header := range []string{"Exercice", "Meilleur score", "Temps moyen", "Séances", "Réussite"} {
+			page.text(columns[i], y, 9, true, header)
+		}
+		y -= 15
+		black()
+		for _, exerciseType := range reportCardTypeNames {
+			var point ProgressPoint
+			var best *LeaderboardRun
+			for i, run := range card.Runs {
+				if run.ExerciseType != exerciseType.Type {
+					continue
+				}
+				point.add(run)
+				if best == nil || betterRun(run, *best) {
+					best = &card.Runs[i]
+				}
+			}
+			if best == nil {
+				continue
+			}
+			point.finish()
+			meanTime := "-"
+			if best.timed() {
+				meanTime = frenchDecimal(*best.MeanTimeSeconds, 1) + " s"
+			}
+			cells := []string{exerciseType.Name, fmt.Sprintf("%d / %d", best.Score, best.Total), meanTime,
+				strconv.Itoa(point.Sessions), frenchDecimal(point.Accuracy*100, 0) + " %"}
+			for i, cell := range cells {
+				page.text(columns[i], y, 10, false, cell)
+			}
+			y -= 15
+		}
+		y -= 7
+	}
+
+	// Badges of the window, best first
+	y = section(y, "Badges")
+	var lines []string
+	for _, badge := range card.Badges {
+		name, ok := reportCardBadgeNames[badge.BadgeType]
+		if !ok {
+			name = badge.BadgeType
+		}
+		line := name + " · " + reportCardTypeName(badge.ExerciseType)
+		switch {
+		case badge.Name != "":
+			line += ", " + badge.Name
+		case badge.IsTenTables:
+			line += ", 10 tables"
+		}
+		if badge.TableNumber > 0 {
+			line += fmt.Sprintf(", table de %d", badge.TableNumber)
+		}
+		if badge.Count > 1 {
+			line += fmt.Sprintf(" (x%d)", badge.Count)
+		}
+		lines = append(lines, line)
+	}
+	y = reportCardList(page, y, lines, reportCardBadges, "Pas encore de badge.")
+
+	// Specialist badges held
+	y = section(y, "Badges de spécialiste")
+	lines = nil
+	for _, specialist := range card.Specialist {
+		line := reportCardTypeName(specialist.ExerciseType)
+		if specialist.Unit != specialistUnitRun {
+			line = fmt.Sprintf("Table de %d · %s", specialist.TableNumber, line)
+		}
+		if specialist.Dimmed {
+			line += ", à reconquérir"
+		}
+		lines = append(lines, line)
+	}
+	y = reportCardList(page, y, lines, reportCardSpecialists, "Pas encore de badge de spécialiste.")
+
+	// Most missed facts
+	y = section(y, "Calculs les plus souvent manqués")
+	lines = nil
+	for _, ue := range card.Errors {
+		plural := ""
+		if ue.ErrorCount > 1 {
+			plural = "s"
+		}
+		lines = append(lines, fmt.Sprintf("%s   (%d erreur%s)", ue.Question, ue.ErrorCount, plural))
+	}
+	y = reportCardList(page, y, lines, reportCardFacts, "Aucune erreur enregistrée.")
+
+	// Accuracy over time, by day or by week for longer spans
+	bucket := "day"
+	if len(card.Runs) > 0 && card.Runs[len(card.Runs)-1].CreatedAt.Sub(card.Runs[0].CreatedAt) > reportCardDays*24*time.Hour {
+		bucket = "week"
+	}
+	title := "Réussite par jour"
+	if bucket == "week" {
+		title = "Réussite par semaine"
+	}
+	y = section(y, title)
+	points := progressPoints(card.Runs, loc, bucket)
+	if len(points) == 0 {
+		grey()
+		page.text(50, y, 10, false, "Aucun résultat sur la période.")
+		return page
+	}
+	height := min(y-75, 220)
+	renderProgressChart(page, points, 80, y-5-height, pdfPageWidth-50-80, height)
+	return page
+}
+
+// reportCardList writes the first lines of a list in two columns, noting the lines
+// left out, or a text when the list is empty
+func reportCardList(page *pdfPage, y float64, lines []string, limit int, empty string) float64 {
+	if len(lines) == 0 {
+		page.color(0.4, 0.4, 0.4)
+		page.text(50, y, 10, false, empty)
+		return y - 22
+	}
+	page.color(0, 0, 0)
+	if len(lines) > limit {
+		more := len(lines) - limit + 1
+		lines = append(lines[:limit-1:limit-1], fmt.Sprintf("et %d autres", more))
+	}
+	return reportCardColumns(page, y, lines)
+}
+
+// renderProgressChart draws the accuracy of progress points in a box, from 0 to 100 %
+func renderProgressChart(page *pdfPage, points []ProgressPoint, x, y, width, height float64) {
+	// Grid and axis labels
+	page.color(0.8, 0.8, 0.8)
+	for _, percent := range []float64{0, 50, 100} {
+		lineY := y + height*percent/100
+		page.line(x, lineY, x+width, lineY, 0.5)
+	}
+	page.color(0.4, 0.4, 0.4)
+	for _, percent := range []float64{0, 50, 100} {
+		page.text(x-30, y+height*percent/100-3, 8, false, fmt.Sprintf("%.0f %%", percent))
+	}
+
+	// Points evenly spaced, the only one centred
+	coords := make([][2]float64, len(points))
+	for i, point := range points {
+		px := x + width/2
+		if len(points) > 1 {
+			px = x + width*float64(i)/float64(len(points)-1)
+		}
+		coords[i] = [2]float64{px, y + height*point.Accuracy}
+	}
+	labels := []int{0, len(points) / 2, len(points) - 1}
+	for i, index := range labels {
+		if i > 0 && index == labels[i-1] {
+			continue
+		}
+		page.text(coords[index][0]-22, y-14, 8, false, frenchDate(points[index].Start))
+	}
+
+	page.color(0.16, 0.39, 0.78)
+	page.polyline(coords, 1.5)
+	for _, coord := range coords {
+		page.rect(coord[0]-2, coord[1]-2, 4, 4)
+	}
+}
+
+// reportCardFilename returns the file name of the report card of a user
+func reportCardFilename(user User) string {
+	var b strings.Builder
+	for _, r := range normalizeUserName(user.Name) {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		return fmt.Sprintf("report-card-%d.pdf", user.ID)
+	}
+	return fmt.Sprintf("report-card-%d-%s.pdf", user.ID, name)
+}
+
+// writeReportCard writes the PDF of a report card
+func writeReportCard(w io.Writer, card reportCard, now time.Time) error {
+	return writePDF(w, "Bulletin de "+card.User.Name, []*pdfPage{renderReportCard(card, now)})
+}
+
+// GET /api/users/{id}/report-card?from=D&to=D&period=P&term=T - Report card of a user as a PDF
+func getUserReportCard(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "id", "invalid user id")
+		return
+	}
+
+	user, err := loadUser(userID)
+	if err == errUserNotFound || (err == nil && groupID != nil && user.GroupID != *groupID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	group, err := store.GroupByID(user.GroupID)
+	if err != nil {
+		slog.Error("Failed to query group", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	window, ok := requestWindow(w, r, &user.GroupID)
+	if !ok {
+		return
+	}
+
+	cards, err := buildReportCards(group, []User{*user}, window)
+	if err != nil {
+		slog.Error("Failed to query report card", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeReportCard(&buf, cards[0], time.Now()); err != nil {
+		slog.Error("Failed to write report card", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, reportCardFilename(*user)))
+	w.Write(buf.Bytes())
+}
+
+// GET /api/groups/{id}/report-cards?from=D&to=D&period=P&term=T - Report cards of the members of a group,
+// as a zip of PDFs
+func getGroupReportCards(w http.ResponseWriter, r *http.Request) {
+	groupID, _ := groupIDFromPath(w, r)
+	group, err := store.GroupByID(groupID)
+	if err == errGroupNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to query group", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	window, ok := requestWindow(w, r, &groupID)
+	if !ok {
+		return
+	}
+
+	users, err := groupUsers(groupID)
+	if err != nil {
+		slog.Error("Failed to query users", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	cards, err := buildReportCards(group, users, window)
+	if err != nil {
+		slog.Error("Failed to query report cards", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="report-cards-group-%d.zip"`, groupID))
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	for _, card := range cards {
+		var buf bytes.Buffer
+		if err := writeReportCard(&buf, card, now); err != nil {
+			slog.Error("Failed to write report card", "error", err)
+			return
+		}
+		f, err := zw.Create(reportCardFilename(card.User))
+		if err != nil {
+			slog.Error("Failed to write report cards", "error", err)
+			return
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			slog.Error("Failed to write report cards", "error", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		slog.Error("Failed to write report cards", "error", err)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spaced repetition follows the SM-2 algorithm: each fact of each user has an ease
+// factor, an interval and a due date. A correct answer pushes the due date further
+// away (faster answers more so), a wrong answer makes the fact due again immediately.
+// Facts are scheduled by fact key, so a Megamix answer updates the same fact as a
+// multiplication answer, whatever the wording of the question.
+
+const (
+	reviewInitialEase = 2.5
+	reviewMinEase     = 1.3
+	// Number of facts returned by /api/review-deck when no count is given
+	reviewDeckSize = 40
+)
+
+// initReviewTables creates the review_schedule table
+func initReviewTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS review_schedule (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			ease REAL NOT NULL DEFAULT 2.5,
+			interval_days REAL NOT NULL DEFAULT 0,
+			repetitions INTEGER NOT NULL DEFAULT 0,
+			lapses INTEGER NOT NULL DEFAULT 0,
+			due_at DATETIME NOT NULL,
+			last_reviewed_at DATETIME,
+			group_id INTEGER REFERENCES groups(id),
+			UNIQUE(user_name, exercise_type, question)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create review_schedule table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_review_schedule_due
+		ON review_schedule(user_name, due_at)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create review_schedule index: %w", err)
+	}
+
+	return nil
+}
+
+// keyReviewScheduleByFact recreates review_schedule unique per user and fact key,
+// keeping the most recently reviewed state of each fact
+func keyReviewScheduleByFact(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE review_schedule_new (
+			id ` + tx.autoIncrementID() + `,
+			user_id BIGINT NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			fact_key TEXT NOT NULL,
+			question TEXT NOT NULL,
+			ease DOUBLE PRECISION NOT NULL DEFAULT 2.5,
+			interval_days DOUBLE PRECISION NOT NULL DEFAULT 0,
+			repetitions INTEGER NOT NULL DEFAULT 0,
+			lapses INTEGER NOT NULL DEFAULT 0,
+			due_at TIMESTAMP NOT NULL,
+			last_reviewed_at TIMESTAMP,
+			group_id BIGINT REFERENCES groups(id),
+			UNIQUE(user_id, fact_key)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create review_schedule_new table: %w", err)
+	}
+
+	// Read every state first, most recent first: the inserts cannot run while rows are open
+	rows, err := tx.Query(`
+		SELECT id, user_id, question
+		FROM review_schedule
+		ORDER BY last_reviewed_at IS NULL, last_reviewed_at DESC, id DESC
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to read review_schedule: %w", err)
+	}
+	type scheduledFact struct {
+		userID int64
+		key    string
+	}
+	kept := make(map[scheduledFact]int64)
+	var order []scheduledFact
+	for rows.Next() {
+		var id, userID int64
+		var question string
+		if err := rows.Scan(&id, &userID, &question); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read review_schedule: %w", err)
+		}
+		fact := scheduledFact{userID, reviewFactKey(question)}
+		if _, ok := kept[fact]; !ok {
+			kept[fact] = id
+			order = append(order, fact)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read review_schedule: %w", err)
+	}
+
+	for _, fact := range order {
+		_, err := tx.Exec(`
+			INSERT INTO review_schedule_new (user_id, user_name, exercise_type, fact_key, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id)
+			SELECT user_id, user_name, exercise_type, ?, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id
+			FROM review_schedule WHERE id = ?
+		`, fact.key, kept[fact])
+		if err != nil {
+			return fmt.Errorf("failed to copy review_schedule: %w", err)
+		}
+	}
+
+	for _, stmt := range []string{
+		`DROP TABLE review_schedule`,
+		`ALTER TABLE review_schedule_new RENAME TO review_schedule`,
+		`CREATE INDEX idx_review_schedule_user_due ON review_schedule(user_id, due_at)`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to replace review_schedule: %w", err)
+		}
+	}
+
+	slog.Info("Keyed review schedule by fact", "facts", len(order))
+	return nil
+}
+
+// reviewFactKey returns the key scheduling a question: its fact key, or the question
+// itself when it is not a known fact
+func reviewFactKey(question string) string {
+	if key, ok := parseFactKey(question); ok {
+		return key
+	}
+	return question
+}
+
+// reviewState is the scheduling state of a fact for a user
+type reviewState struct {
+	Ease         float64
+	IntervalDays float64
+	Repetitions  int
+	Lapses       int
+	DueAt        time.Time
+}
+
+// answerQuality grades an answer on the SM-2 scale (0-5): wrong answers and
+// timeouts fail, correct answers are graded by speed relative to the time limit
+func answerQuality(correct bool, responseMs *int64, limit time.Duration) int {
+	if !correct {
+		if responseMs != nil && *responseMs >= limit.Milliseconds() {
+			return 0 // timeout
+		}
+		return 1
+	}
+	if responseMs == nil {
+		return 4
+	}
+	ratio := float64(*responseMs) / float64(limit.Milliseconds())
+	switch {
+	case ratio < 0.4:
+		return 5
+	case ratio < 0.75:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// nextReviewState applies an answer of the given quality to a scheduling state
+func nextReviewState(state reviewState, quality int, now time.Time) reviewState {
+	if quality < 3 {
+		// Lapse: the fact is learnt again from the start and is due right away
+		state.Repetitions = 0
+		state.Lapses++
+		state.IntervalDays = 0
+	} else {
+		state.Repetitions++
+		switch state.Repetitions {
+		case 1:
+			state.IntervalDays = 1
+		case 2:
+			state.IntervalDays = 3
+		default:
+			state.IntervalDays = math.Round(state.IntervalDays*state.Ease*10) / 10
+		}
+	}
+
+	q := float64(5 - quality)
+	state.Ease = max(reviewMinEase, state.Ease+0.1-q*(0.08+q*0.02))
+	state.DueAt = now.Add(time.Duration(state.IntervalDays * 24 * float64(time.Hour)))
+	return state
+}
+
+// updateReviewSchedule records an answer in the schedule of a fact. The row of the
+// fact is created first, then read locked and updated, so that two answers to the
+// same fact committed together both count.
+func updateReviewSchedule(tx *Tx, ev AnswerEvent) error {
+	key := reviewFactKey(ev.Question)
+	now := time.Now().UTC()
+	_, err := tx.Exec(`
+		INSERT INTO review_schedule (user_id, user_name, exercise_type, fact_key, question, ease, due_at, group_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, fact_key) DO NOTHING
+	`, ev.UserID, ev.UserName, ev.QuestionType, key, ev.Question, reviewInitialEase, now, ev.GroupID)
+	if err != nil {
+		return err
+	}
+
+	var state reviewState
+	err = tx.QueryRow(`
+		SELECT ease, interval_days, repetitions, lapses
+		FROM review_schedule
+		WHERE user_id = ? AND fact_key = ?`+tx.forUpdate(),
+		ev.UserID, key).Scan(&state.Ease, &state.IntervalDays, &state.Repetitions, &state.Lapses)
+	if err != nil {
+		return err
+	}
+
+	limit := timeLimit
+	if ev.QuestionType == "fact" {
+		limit = timeLimitFact
+	}
+	state = nextReviewState(state, answerQuality(ev.Correct, ev.ResponseMs, limit), now)
+
+	_, err = tx.Exec(`
+		UPDATE review_schedule
+		SET exercise_type = ?, question = ?, ease = ?, interval_days = ?, repetitions = ?, lapses = ?,
+			due_at = ?, last_reviewed_at = ?, user_name = ?, group_id = COALESCE(?, group_id)
+		WHERE user_id = ? AND fact_key = ?
+	`, ev.QuestionType, ev.Question, state.Ease, state.IntervalDays, state.Repetitions, state.Lapses,
+		state.DueAt, now, ev.UserName, ev.GroupID, ev.UserID, key)
+	return err
+}
+
+// loadReviewStates returns the scheduling state of every fact a user has answered, by fact key
+func loadReviewStates(userID int64) (map[string]reviewState, error) {
+	rows, err := db.Query(`
+		SELECT fact_key, ease, interval_days, repetitions, lapses, due_at
+		FROM review_schedule
+		WHERE user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]reviewState)
+	for rows.Next() {
+		var key string
+		var state reviewState
+		if err := rows.Scan(&key, &state.Ease, &state.IntervalDays, &state.Repetitions, &state.Lapses, &state.DueAt); err != nil {
+			return nil, err
+		}
+		states[key] = state
+	}
+	return states, rows.Err()
+}
+
+// reviewWeights returns the selection weight of each fact for a user's next deck, by
+// commutative fact key: "7 x 8" and "8 x 7" share their weight.
+// Facts due for review weigh more, and more so when they were often forgotten;
+// facts not due yet weigh 1. Facts never scheduled fall back to their error count.
+func reviewWeights(userID int64, exerciseType string) (map[string]int, error) {
+	errorCounts, err := userErrorCounts(userID, exerciseType)
+	if err != nil {
+		return nil, err
+	}
+	weights := make(map[string]int, len(errorCounts))
+	for key, count := range groupFactCounts(errorCounts) {
+		weights[key] = min(2*count, 5)
+	}
+
+	states, err := loadReviewStates(userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stateWeights := make(map[string]int, len(states))
+	for factKey, state := range states {
+		key := commutativeFactKey(factKey)
+		weight := 1
+		if !state.DueAt.After(now) {
+			weight = min(2+state.Lapses, 5)
+		}
+		// Both forms of a fact scheduled: the one due the most wins
+		stateWeights[key] = max(stateWeights[key], weight)
+	}
+	for key, weight := range stateWeights {
+		weights[key] = weight
+	}
+	return weights, nil
+}
+
+// ReviewCard is a flashcard with its scheduling state for the user
+type ReviewCard struct {
+	Flashcard
+	New          bool    `json:"new"`
+	DueAt        string  `json:"due_at,omitempty"`
+	IntervalDays float64 `json:"interval_days"`
+	Ease         float64 `json:"ease"`
+	Repetitions  int     `json:"repetitions"`
+	Lapses       int     `json:"lapses"`
+}
+
+// GET /api/review-deck?name=X&group_id=G&type=Y&count=N&tables=1,2 - Returns the facts due for review
+func getReviewDeck(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	exerciseType := strings.TrimSpace(r.URL.Query().Get("type"))
+
+	if name == "" && r.URL.Query().Get("user_id") == "" {
+		writeFieldError(w, codeMissingField, "name", "name required")
+		return
+	}
+	if exerciseType == "" {
+		exerciseType = "mul"
+	}
+	if !exerciseTypes[exerciseType] {
+		writeFieldError(w, codeInvalidField, "type", "invalid type")
+		return
+	}
+
+	count := reviewDeckSize
+	if countParam := r.URL.Query().Get("count"); countParam != "" {
+		n, err := strconv.Atoi(countParam)
+		if err != nil || n < 1 || n > sessionQuestionsMax {
+			writeFieldError(w, codeInvalidField, "count", "invalid count")
+			return
+		}
+		count = n
+	}
+
+	tables, err := parseTables(r.URL.Query().Get("tables"))
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "tables", err.Error())
+		return
+	}
+	cards, err := generateFlashcards(exerciseType, tables)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "type", err.Error())
+		return
+	}
+
+	// A user who never played has every fact new
+	states := map[string]reviewState{}
+	user, err := queryUser(r, groupID)
+	if err == nil {
+		states, err = loadReviewStates(user.ID)
+	} else if err == errUserNotFound || err == errGroupNotFound {
+		err = nil
+	}
+	if err != nil {
+		slog.Error("Failed to query review schedule", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	// Due facts come first, most overdue first, then facts never answered
+	now := time.Now()
+	var due, unseen []ReviewCard
+	for _, card := range cards {
+		state, ok := states[reviewFactKey(card.Question)]
+		if !ok {
+			unseen = append(unseen, ReviewCard{Flashcard: card, New: true, Ease: reviewInitialEase})
+			continue
+		}
+		if state.DueAt.After(now) {
+			continue
+		}
+		due = append(due, ReviewCard{
+			Flashcard:    card,
+			DueAt:        state.DueAt.UTC().Format(time.RFC3339),
+			IntervalDays: state.IntervalDays,
+			Ease:         state.Ease,
+			Repetitions:  state.Repetitions,
+			Lapses:       state.Lapses,
+		})
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].DueAt < due[j].DueAt
+	})
+	rand.Shuffle(len(unseen), func(i, j int) { unseen[i], unseen[j] = unseen[j], unseen[i] })
+
+	deck := append(due, unseen...)
+	if len(deck) > count {
+		deck = deck[:count]
+	}
+	if deck == nil {
+		deck = []ReviewCard{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deck)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAnswerQuality(t *testing.T) {
+	ms := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name       string
+		correct    bool
+		responseMs *int64
+		want       int
+	}{
+		{"timeout", false, ms(10000), 0},
+		{"wrong", false, ms(3000), 1},
+		{"wrong without time", false, nil, 1},
+		{"correct without time", true, nil, 4},
+		{"fast", true, ms(3999), 5},
+		{"steady", true, ms(4000), 4},
+		{"slow", true, ms(7500), 3},
+		{"at the limit", true, ms(10000), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := answerQuality(tt.correct, tt.responseMs, 10*time.Second); got != tt.want {
+				t.Errorf("answerQuality = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextReviewState(t *testing.T) {
+	now := time.Date(2026, 3, 1, 17, 0, 0, 0, time.UTC)
+	state := reviewState{Ease: reviewInitialEase}
+	// Each answer applies to the state left by the previous one
+	steps := []struct {
+		quality     int
+		ease        float64
+		interval    float64
+		repetitions int
+		lapses      int
+	}{
+		{5, 2.6, 1, 1, 0},
+		{5, 2.7, 3, 2, 0},
+		{5, 2.8, 8.1, 3, 0},
+		{4, 2.8, 22.7, 4, 0},
+		{3, 2.66, 63.6, 5, 0},
+		{1, 2.12, 0, 0, 1},
+		{0, 1.32, 0, 0, 2},
+		{0, reviewMinEase, 0, 0, 3},
+		{5, 1.4, 1, 1, 3},
+	}
+	for i, step := range steps {
+		state = nextReviewState(state, step.quality, now)
+		if math.Abs(state.Ease-step.ease) > 1e-9 || state.IntervalDays != step.interval ||
+			state.Repetitions != step.repetitions || state.Lapses != step.lapses {
+			t.Fatalf("answer %d of quality %d: state = %+v, want ease %v, interval %v, repetitions %d, lapses %d",
+				i+1, step.quality, state, step.ease, step.interval, step.repetitions, step.lapses)
+		}
+		if want := now.Add(time.Duration(step.interval * 24 * float64(time.Hour))); !state.DueAt.Equal(want) {
+			t.Fatalf("answer %d: due at %v, want %v", i+1, state.DueAt, want)
+		}
+	}
+}
+
+func TestReviewScheduleConcurrentAnswers(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		_, user := testUser(t, "Review", "Ann")
+		const answers = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, answers)
+		for i := range answers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- logAnswerEvent(AnswerEvent{
+					SessionID: fmt.Sprintf("s%d", i), Position: new(int), UserID: user.ID, UserName: user.Name,
+					ExerciseType: "mul", Question: "7 x 8", GivenAnswer: "56", Correct: true,
+				})
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("logAnswerEvent: %v", err)
+			}
+		}
+
+		states, err := loadReviewStates(user.ID)
+		if err != nil {
+			t.Fatalf("loadReviewStates: %v", err)
+		}
+		if got := states["mul:7:8"].Repetitions; got != answers {
+			t.Errorf("repetitions = %d, want %d", got, answers)
+		}
+	})
+}
+
+func TestReviewDeckPadding(t *testing.T) {
+	useTestStore(t)
+	group, user := testUser(t, "Review", "Ann")
+	now := time.Now().UTC()
+	for _, fact := range []struct {
+		question string
+		dueAt    time.Time
+	}{
+		{"7 x 8 = ?", now.Add(-time.Hour)},
+		{"7 x 3 = ?", now.Add(-48 * time.Hour)},
+		{"7 x 9 = ?", now.Add(24 * time.Hour)},
+	} {
+		_, err := db.Exec(`
+			INSERT INTO review_schedule (user_id, user_name, exercise_type, fact_key, question, due_at, group_id)
+			VALUES (?, ?, 'mul', ?, ?, ?, ?)
+		`, user.ID, user.Name, reviewFactKey(fact.question), fact.question, fact.dueAt, group.ID)
+		if err != nil {
+			t.Fatalf("scheduling %s: %v", fact.question, err)
+		}
+	}
+	cards, err := generateFlashcards("mul", []int{7})
+	if err != nil {
+		t.Fatalf("generateFlashcards: %v", err)
+	}
+
+	deck := func(count int) []ReviewCard {
+		t.Helper()
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/review-deck?name=Ann&tables=7&count=%d", count), nil)
+		req.Header.Set(groupKeyHeader, group.SecretKey)
+		w := httptest.NewRecorder()
+		getReviewDeck(w, req)
+		if w.Code != 200 {
+			t.Fatalf("GET /api/review-deck = %d %s", w.Code, w.Body)
+		}
+		var deck []ReviewCard
+		if err := json.Unmarshal(w.Body.Bytes(), &deck); err != nil {
+			t.Fatalf("decoding the deck: %v", err)
+		}
+		return deck
+	}
+
+	// The due facts come first, most overdue first, then new facts pad the deck
+	short := deck(4)
+	if len(short) != 4 || short[0].Question != "7 x 3 = ?" || short[1].Question != "7 x 8 = ?" || short[0].New || short[1].New {
+		t.Fatalf("deck = %+v, want 7 x 3 and 7 x 8 due first", short)
+	}
+	for _, card := range short[2:] {
+		if !card.New {
+			t.Errorf("padding card %s not new", card.Question)
+		}
+	}
+
+	// A fact not due yet never pads the deck, even when it is short of count
+	full := deck(sessionQuestionsMax)
+	if len(full) != len(cards)-1 {
+		t.Errorf("deck of %d cards, want %d", len(full), len(cards)-1)
+	}
+	for _, card := range full {
+		if card.Question == "7 x 9 = ?" {
+			t.Error("7 x 9, not due yet, is in the deck")
+		}
+	}
+}
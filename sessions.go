@@ -0,0 +1,836 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quiz sessions keep the deck and the expected answers on the server: the client
+// only receives the questions, submits each answer, and the final user_results row
+// is computed from the answers checked and timed by the server. A session is recorded
+// once every question is answered, or when the pupil ends it early with the questions
+// answered so far; a perfect Megamix session of 100 questions can first be extended to
+// 200 for the diamond challenge.
+
+const (
+	// Default number of questions per session, matching the browser quiz
+	sessionQuestions     = 40
+	sessionQuestionsMega = 100
+	// Maximum number of questions, used by the Megamix diamond challenge
+	sessionQuestionsMax = 200
+	// Sessions can no longer be answered after this delay
+	sessionMaxAge = 2 * time.Hour
+)
+
+// initSessionTables creates the tables holding quiz sessions and their questions
+func initSessionTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS quiz_sessions (
+			id TEXT PRIMARY KEY,
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			tables TEXT,
+			question_count INTEGER NOT NULL,
+			group_id INTEGER REFERENCES groups(id),
+			created_at DATETIME NOT NULL,
+			completed_at DATETIME
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create quiz_sessions table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS session_questions (
+			session_id TEXT NOT NULL REFERENCES quiz_sessions(id),
+			position INTEGER NOT NULL,
+			question TEXT NOT NULL,
+			card TEXT NOT NULL,
+			asked_at DATETIME,
+			answered_at DATETIME,
+			given_answer TEXT,
+			correct INTEGER,
+			response_ms INTEGER,
+			PRIMARY KEY (session_id, position)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create session_questions table: %w", err)
+	}
+
+	return nil
+}
+
+// generateSessionID generates a random 32-character hex string for session IDs
+func generateSessionID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// POST /api/sessions - Start a quiz session
+type createSessionRequest struct {
+	UserID       *int64 `json:"user_id,omitempty"`
+	Name         string `json:"name"`
+	ExerciseType string `json:"exercise_type"`
+	Tables       []int  `json:"tables,omitempty"`
+	Count        int    `json:"count,omitempty"`
+	GroupID      *int64 `json:"group_id,omitempty"`
+}
+
+type sessionResponse struct {
+	SessionID    string `json:"session_id"`
+	ExerciseType string `json:"exercise_type"`
+	Tables       []int  `json:"tables"`
+	Total        int    `json:"total"`
+	// First is the position of the first card of the deck, 100 for a diamond challenge extension
+	First int         `json:"first,omitempty"`
+	Deck  []Flashcard `json:"deck"`
+}
+
+func createSession(w http.ResponseWriter, r *http.Request) {
+	var req createSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+
+	if req.UserID == nil && strings.TrimSpace(req.Name) == "" {
+		writeFieldError(w, codeMissingField, "name", "name required")
+		return
+	}
+	exerciseType := req.ExerciseType
+	if exerciseType == "" {
+		exerciseType = "mul"
+	}
+	if !exerciseTypes[exerciseType] {
+		writeFieldError(w, codeInvalidField, "exercise_type", "invalid exercise_type")
+		return
+	}
+
+	count := req.Count
+	if count == 0 {
+		count = sessionQuestions
+		if exerciseType == "mega" {
+			count = sessionQuestionsMega
+		}
+	}
+	if count < 1 || count > sessionQuestionsMax {
+		writeFieldError(w, codeInvalidField, "count", "invalid count")
+		return
+	}
+
+	tables := allTables()
+	if exerciseType != "mega" && len(req.Tables) > 0 {
+		var err error
+		if tables, err = parseTables(joinInts(req.Tables)); err != nil {
+			writeFieldError(w, codeInvalidField, "tables", err.Error())
+			return
+		}
+	}
+	allCards, err := generateFlashcards(exerciseType, tables)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "exercise_type", err.Error())
+		return
+	}
+
+	user := requestUser(w, r, req.UserID, req.GroupID, req.Name)
+	if user == nil {
+		return
+	}
+
+	weights, err := reviewWeights(user.ID, exerciseType)
+	if err != nil {
+		slog.Error("Failed to query review schedule", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	deck := selectWeightedFlashcards(allCards, weights, count)
+
+	sessionID, err := generateSessionID()
+	if err != nil {
+		slog.Error("Failed to generate session ID", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+
+	if err := insertSession(sessionID, user, exerciseType, tables, deck); err != nil {
+		slog.Error("Failed to create session", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	publicDeck := make([]Flashcard, len(deck))
+	for i, card := range deck {
+		publicDeck[i] = withoutAnswer(card)
+	}
+
+	slog.Info("Session created", "id", sessionID, "user_id", user.ID, "type", exerciseType, "questions", len(deck))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionResponse{
+		SessionID:    sessionID,
+		ExerciseType: exerciseType,
+		Tables:       tables,
+		Total:        len(deck),
+		Deck:         publicDeck,
+	})
+}
+
+// joinInts formats integers as a comma-separated list
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// userErrorCounts returns the error count per fact key for a user and exercise type,
+// questions without a key being counted by their text
+func userErrorCounts(userID int64, exerciseType string) (map[string]int, error) {
+	errors, err := store.UserErrors(userID, exerciseType)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(errors))
+	for _, ue := range errors {
+		key := ue.FactKey
+		if key == "" {
+			key = ue.Question
+		}
+		counts[key] += ue.ErrorCount
+	}
+	return counts, nil
+}
+
+// insertSession stores a session and its deck in a single transaction
+func insertSession(id string, user *User, exerciseType string, tables []int, deck []Flashcard) error {
+	tablesJSON, err := json.Marshal(tables)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO quiz_sessions (id, user_id, user_name, exercise_type, tables, question_count, group_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, user.ID, user.Name, exerciseType, string(tablesJSON), len(deck), user.GroupID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if err := insertSessionQuestions(tx, id, 0, deck); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertSessionQuestions stores the cards of a deck from a position
+func insertSessionQuestions(tx *Tx, id string, first int, deck []Flashcard) error {
+	for i, card := range deck {
+		cardJSON, err := json.Marshal(card)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO session_questions (session_id, position, question, card)
+			VALUES (?, ?, ?, ?)
+		`, id, first+i, card.Question, string(cardJSON))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quizSession is a session row as stored in quiz_sessions
+type quizSession struct {
+	ID            string
+	User          *User
+	ExerciseType  string
+	Tables        []int
+	QuestionCount int
+	CreatedAt     time.Time
+	CompletedAt   *time.Time
+}
+
+// errSessionNotFound is returned when a session ID is unknown
+var errSessionNotFound = fmt.Errorf("session not found")
+
+func loadSession(id string) (*quizSession, error) {
+	var s quizSession
+	var userID int64
+	var tablesJSON string
+	var completedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT id, user_id, exercise_type, COALESCE(tables, ''), question_count, created_at, completed_at
+		FROM quiz_sessions
+		WHERE id = ?
+	`, id).Scan(&s.ID, &userID, &s.ExerciseType, &tablesJSON, &s.QuestionCount, &s.CreatedAt, &completedAt)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tablesJSON != "" {
+		_ = json.Unmarshal([]byte(tablesJSON), &s.Tables)
+	}
+	if completedAt.Valid {
+		s.CompletedAt = &completedAt.Time
+	}
+
+	s.User, err = loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GET /api/sessions/{id} - Returns the progress of a session
+type sessionStatus struct {
+	SessionID    string `json:"session_id"`
+	ExerciseType string `json:"exercise_type"`
+	Score        int    `json:"score"`
+	Answered     int    `json:"answered"`
+	Total        int    `json:"total"`
+	Completed    bool   `json:"completed"`
+}
+
+func sessionProgress(s *quizSession) (sessionStatus, error) {
+	status := sessionStatus{
+		SessionID:    s.ID,
+		ExerciseType: s.ExerciseType,
+		Total:        s.QuestionCount,
+		Completed:    s.CompletedAt != nil,
+	}
+	err := db.QueryRow(`
+		SELECT COUNT(answered_at), COALESCE(SUM(correct), 0)
+		FROM session_questions
+		WHERE session_id = ?
+	`, s.ID).Scan(&status.Answered, &status.Score)
+	return status, err
+}
+
+func getSession(w http.ResponseWriter, r *http.Request) {
+	s, err := loadSession(r.PathValue("id"))
+	if err == errSessionNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load session", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	status, err := sessionProgress(s)
+	if err != nil {
+		slog.Error("Failed to load session progress", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// loadOpenSession loads a session that can still be answered, writing the error response otherwise
+func loadOpenSession(w http.ResponseWriter, id string) *quizSession {
+	s, err := loadSession(id)
+	if err == errSessionNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "session not found")
+		return nil
+	}
+	if err != nil {
+		slog.Error("Failed to load session", "error", err)
+		writeDatabaseError(w)
+		return nil
+	}
+	if s.CompletedAt != nil {
+		writeError(w, http.StatusConflict, codeConflict, "session already completed")
+		return nil
+	}
+	if time.Since(s.CreatedAt) > sessionMaxAge {
+		writeError(w, http.StatusGone, codeSessionExpired, "session expired")
+		return nil
+	}
+	return s
+}
+
+// POST /api/sessions/{id}/questions/{position}/start - Starts the timer of a question.
+// Clients call it when the question is displayed; without it, the timer starts when
+// the previous question was answered.
+func startSessionQuestion(w http.ResponseWriter, r *http.Request) {
+	s := loadOpenSession(w, r.PathValue("id"))
+	if s == nil {
+		return
+	}
+	position, err := strconv.Atoi(r.PathValue("position"))
+	if err != nil || position < 0 || position >= s.QuestionCount {
+		writeFieldError(w, codeInvalidField, "position", "invalid position")
+		return
+	}
+
+	// Only the first call starts the timer, so it cannot be restarted to gain time
+	_, err = db.Exec(`
+		UPDATE session_questions
+		SET asked_at = ?
+		WHERE session_id = ? AND position = ? AND asked_at IS NULL AND answered_at IS NULL
+	`, time.Now().UTC(), s.ID, position)
+	if err != nil {
+		slog.Error("Failed to start session question", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// POST /api/sessions/{id}/answers - Submit the answer to a question
+type sessionAnswerRequest struct {
+	Position int    `json:"position"`
+	Answer   string `json:"answer"`
+}
+
+type sessionAnswerResponse struct {
+	Position     int      `json:"position"`
+	Correct      bool     `json:"correct"`
+	TimedOut     bool     `json:"timed_out"`
+	Expected     string   `json:"expected"`
+	ValidFactors [][2]int `json:"valid_factors,omitempty"`
+	ResponseMs   int64    `json:"response_ms"`
+	Score        int      `json:"score"`
+	Answered     int      `json:"answered"`
+	Total        int      `json:"total"`
+	Completed    bool     `json:"completed"`
+	// Extendable is set on a perfect Megamix session of 100 questions: the client
+	// either extends it to 200 (diamond challenge) or finishes it
+	Extendable bool           `json:"extendable,omitempty"`
+	Result     *sessionResult `json:"result,omitempty"`
+}
+
+// sessionResult is the result recorded for a completed session, with what it unlocked
+type sessionResult struct {
+	Attempt
+	// NewBadges are the badges this session unlocked for the first time
+	NewBadges []NewBadge `json:"new_badges"`
+	// SpecialistProgress is set on the runs tracked by a specialist rule
+	SpecialistProgress *SpecialistProgress `json:"specialist_progress,omitempty"`
+}
+
+// extendableSession reports whether a fully answered session can be extended for the
+// Megamix diamond challenge
+func extendableSession(s *quizSession, status sessionStatus) bool {
+	return s.ExerciseType == "mega" && s.QuestionCount == sessionQuestionsMega &&
+		status.Answered == status.Total && status.Score == status.Total
+}
+
+func postSessionAnswer(w http.ResponseWriter, r *http.Request) {
+	s := loadOpenSession(w, r.PathValue("id"))
+	if s == nil {
+		return
+	}
+
+	var req sessionAnswerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if req.Position < 0 || req.Position >= s.QuestionCount {
+		writeFieldError(w, codeInvalidField, "position", "invalid position")
+		return
+	}
+
+	now := time.Now().UTC()
+	var cardJSON string
+	var askedAt, answeredAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT card, asked_at, answered_at
+		FROM session_questions
+		WHERE session_id = ? AND position = ?
+	`, s.ID, req.Position).Scan(&cardJSON, &askedAt, &answeredAt)
+	if err != nil {
+		slog.Error("Failed to load session question", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if answeredAt.Valid {
+		writeError(w, http.StatusConflict, codeConflict, "question already answered")
+		return
+	}
+
+	var card Flashcard
+	if err := json.Unmarshal([]byte(cardJSON), &card); err != nil {
+		slog.Error("Failed to decode session question", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+
+	start, err := questionStartTime(s, askedAt)
+	if err != nil {
+		slog.Error("Failed to compute question start time", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	// Answers given after the time limit count as a timeout, like in the browser quiz
+	limit := questionTimeLimit(card)
+	elapsed := now.Sub(start)
+	timedOut := elapsed > limit
+	if timedOut {
+		elapsed = limit
+	}
+	correct := !timedOut && checkAnswer(card, req.Answer)
+
+	recorded, err := recordSessionAnswer(s, req.Position, card, req.Answer, correct, elapsed, now)
+	if err != nil {
+		slog.Error("Failed to record session answer", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !recorded {
+		writeError(w, http.StatusConflict, codeConflict, "question already answered")
+		return
+	}
+
+	status, err := sessionProgress(s)
+	if err != nil {
+		slog.Error("Failed to load session progress", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	resp := sessionAnswerResponse{
+		Position:   req.Position,
+		Correct:    correct,
+		TimedOut:   timedOut,
+		Expected:   expectedAnswer(card),
+		ResponseMs: elapsed.Milliseconds(),
+		Score:      status.Score,
+		Answered:   status.Answered,
+		Total:      status.Total,
+	}
+	if card.Type == "fact" {
+		resp.ValidFactors = card.Payload.ValidFactors
+	}
+
+	// The last answer completes the session, unless it may go on for the diamond challenge
+	if extendableSession(s, status) {
+		resp.Extendable = true
+	} else if status.Answered == status.Total {
+		result, err := completeSession(s)
+		if err != nil {
+			slog.Error("Failed to complete session", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		resp.Completed = true
+		resp.Result = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recordSessionAnswer records the answer to a session question with its error count,
+// answer event and review schedule in a single transaction, so that a failure leaves
+// the question unanswered. It returns false when the question was already answered.
+func recordSessionAnswer(s *quizSession, position int, card Flashcard, answer string, correct bool, elapsed time.Duration, now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	responseMs := elapsed.Milliseconds()
+	result, err := tx.Exec(`
+		UPDATE session_questions
+		SET answered_at = ?, given_answer = ?, correct = ?, response_ms = ?
+		WHERE session_id = ? AND position = ? AND answered_at IS NULL
+	`, now, answer, boolToInt(correct), responseMs, s.ID, position)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if !correct {
+		if err := insertUserError(tx, s.User, s.ExerciseType, card.Question); err != nil {
+			return false, err
+		}
+	}
+	_, err = recordAnswerEvent(tx, AnswerEvent{
+		SessionID:    s.ID,
+		Position:     &position,
+		UserID:       s.User.ID,
+		UserName:     s.User.Name,
+		GroupID:      &s.User.GroupID,
+		ExerciseType: s.ExerciseType,
+		Question:     card.Question,
+		QuestionType: card.Type,
+		GivenAnswer:  answer,
+		Correct:      correct,
+		ResponseMs:   &responseMs,
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if !correct {
+		userErrorsTotal.Inc()
+	}
+	return true, nil
+}
+
+// boolToInt converts a boolean to the 0/1 integer stored in the database
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// questionStartTime returns when the timer of a question started: when it was
+// displayed if the client said so, otherwise when the previous answer was given
+func questionStartTime(s *quizSession, askedAt sql.NullTime) (time.Time, error) {
+	if askedAt.Valid {
+		return askedAt.Time, nil
+	}
+	// The column itself is selected rather than MAX(answered_at): SQLite returns
+	// aggregates as text, which does not scan into a time
+	var lastAnswer time.Time
+	err := db.QueryRow(`
+		SELECT answered_at
+		FROM session_questions
+		WHERE session_id = ? AND answered_at IS NOT NULL
+		ORDER BY answered_at DESC
+		LIMIT 1
+	`, s.ID).Scan(&lastAnswer)
+	if err == sql.ErrNoRows {
+		return s.CreatedAt, nil
+	}
+	return lastAnswer, err
+}
+
+// POST /api/sessions/{id}/finish - Records the result of a session from the questions
+// answered so far: a session the pupil ends or leaves early, a perfect Megamix session
+// declining the diamond challenge, or a session whose completion failed on the last
+// answer. Browsers call it with a beacon when the page is closed mid-quiz.
+func finishSession(w http.ResponseWriter, r *http.Request) {
+	s := loadOpenSession(w, r.PathValue("id"))
+	if s == nil {
+		return
+	}
+
+	status, err := sessionProgress(s)
+	if err != nil {
+		slog.Error("Failed to load session progress", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if status.Answered == 0 {
+		writeError(w, http.StatusConflict, codeConflict, "no question answered")
+		return
+	}
+
+	result, err := completeSession(s)
+	if err != nil {
+		slog.Error("Failed to complete session", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// POST /api/sessions/{id}/extend - Adds the 100 questions of the diamond challenge to a
+// perfect Megamix session
+func extendSession(w http.ResponseWriter, r *http.Request) {
+	s := loadOpenSession(w, r.PathValue("id"))
+	if s == nil {
+		return
+	}
+
+	status, err := sessionProgress(s)
+	if err != nil {
+		slog.Error("Failed to load session progress", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !extendableSession(s, status) {
+		writeError(w, http.StatusConflict, codeConflict, "only a perfect Megamix session of 100 questions can be extended")
+		return
+	}
+
+	allCards, err := generateFlashcards(s.ExerciseType, s.Tables)
+	if err != nil {
+		slog.Error("Failed to generate session questions", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "internal error")
+		return
+	}
+	weights, err := reviewWeights(s.User.ID, s.ExerciseType)
+	if err != nil {
+		slog.Error("Failed to query review schedule", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	deck := selectWeightedFlashcards(allCards, weights, sessionQuestionsMax-s.QuestionCount)
+
+	extended, err := insertSessionExtension(s, deck)
+	if err != nil {
+		slog.Error("Failed to extend session", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !extended {
+		writeError(w, http.StatusConflict, codeConflict, "session already extended")
+		return
+	}
+
+	publicDeck := make([]Flashcard, len(deck))
+	for i, card := range deck {
+		publicDeck[i] = withoutAnswer(card)
+	}
+	slog.Info("Session extended", "id", s.ID, "user_id", s.User.ID, "questions", s.QuestionCount+len(deck))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionResponse{
+		SessionID:    s.ID,
+		ExerciseType: s.ExerciseType,
+		Tables:       s.Tables,
+		Total:        s.QuestionCount + len(deck),
+		First:        s.QuestionCount,
+		Deck:         publicDeck,
+	})
+}
+
+// insertSessionExtension appends questions to a session, false when it was extended
+// or completed concurrently
+func insertSessionExtension(s *quizSession, deck []Flashcard) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE quiz_sessions SET question_count = ?
+		WHERE id = ? AND question_count = ? AND completed_at IS NULL
+	`, s.QuestionCount+len(deck), s.ID, s.QuestionCount)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := insertSessionQuestions(tx, s.ID, s.QuestionCount, deck); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// completeSession marks a session as completed and saves its result, computed from
+// its answers
+func completeSession(s *quizSession) (*sessionResult, error) {
+	// Marking the session first guarantees that concurrent calls save a single result
+	now := time.Now().UTC()
+	result, err := db.Exec(`
+		UPDATE quiz_sessions SET completed_at = ? WHERE id = ? AND completed_at IS NULL
+	`, now, s.ID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("session %s already completed", s.ID)
+	}
+
+	saved, err := saveSessionResult(s, now)
+	if err != nil {
+		// Reopen the session so that the client can retry
+		if _, resetErr := db.Exec(`UPDATE quiz_sessions SET completed_at = NULL WHERE id = ?`, s.ID); resetErr != nil {
+			slog.Error("Failed to reopen session", "session", s.ID, "error", resetErr)
+		}
+		return nil, err
+	}
+	return saved, nil
+}
+
+// saveSessionResult computes the result of a session and saves it
+func saveSessionResult(s *quizSession, completedAt time.Time) (*sessionResult, error) {
+	var score, total int
+	var meanMs float64
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(correct), 0), COUNT(answered_at), COALESCE(AVG(response_ms), 0)
+		FROM session_questions
+		WHERE session_id = ? AND answered_at IS NOT NULL
+	`, s.ID).Scan(&score, &total, &meanMs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := resultRecord{
+		User:            s.User,
+		ExerciseType:    s.ExerciseType,
+		Score:           score,
+		Total:           total,
+		Tables:          s.Tables,
+		MeanTimeSeconds: meanMs / 1000,
+	}
+	outcome, err := saveResult(res)
+	if err != nil {
+		return nil, err
+	}
+
+	tablesJSON := ""
+	if len(s.Tables) > 0 {
+		if b, err := json.Marshal(s.Tables); err == nil {
+			tablesJSON = string(b)
+		}
+	}
+	newBadges := outcome.NewBadges
+	if newBadges == nil {
+		newBadges = []NewBadge{}
+	}
+
+	slog.Info("Session completed", "id", s.ID, "user_id", s.User.ID, "score", score, "total", total)
+	return &sessionResult{
+		Attempt: Attempt{
+			ID:              outcome.ResultID,
+			UserID:          s.User.ID,
+			UserName:        s.User.Name,
+			ExerciseType:    res.ExerciseType,
+			Score:           res.Score,
+			Total:           res.Total,
+			Tables:          tablesJSON,
+			MeanTimeSeconds: res.MeanTimeSeconds,
+			CreatedAt:       completedAt.Format(time.RFC3339),
+		},
+		NewBadges:          newBadges,
+		SpecialistProgress: outcome.Specialist,
+	}, nil
+}
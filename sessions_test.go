@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionTest drives the session endpoints as a pupil of a group
+type sessionTest struct {
+	t    *testing.T
+	mux  *http.ServeMux
+	key  string
+	user *User
+}
+
+func newSessionTest(t *testing.T) *sessionTest {
+	t.Helper()
+	useTestStore(t)
+	group, user := testUser(t, "Class A", "Ann")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/sessions", createSession)
+	mux.HandleFunc("GET /api/sessions/{id}", getSession)
+	mux.HandleFunc("POST /api/sessions/{id}/questions/{position}/start", startSessionQuestion)
+	mux.HandleFunc("POST /api/sessions/{id}/answers", postSessionAnswer)
+	mux.HandleFunc("POST /api/sessions/{id}/finish", finishSession)
+	mux.HandleFunc("POST /api/sessions/{id}/extend", extendSession)
+	return &sessionTest{t: t, mux: mux, key: group.SecretKey, user: user}
+}
+
+// post sends a request with the group key and decodes the response into out
+func (st *sessionTest) post(path string, body any, out any) int {
+	st.t.Helper()
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", path, bytes.NewReader(payload))
+	req.Header.Set(groupKeyHeader, st.key)
+	w := httptest.NewRecorder()
+	st.mux.ServeHTTP(w, req)
+	if out != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			st.t.Fatalf("POST %s: decoding %s: %v", path, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// start creates a session of the user
+func (st *sessionTest) start(exerciseType string, count int) sessionResponse {
+	st.t.Helper()
+	var session sessionResponse
+	req := createSessionRequest{UserID: &st.user.ID, ExerciseType: exerciseType, Tables: []int{2, 3}, Count: count}
+	if code := st.post("/api/sessions", req, &session); code != http.StatusOK {
+		st.t.Fatalf("creating a session: %d", code)
+	}
+	return session
+}
+
+// card returns a question of a session with its answer, as stored on the server
+func (st *sessionTest) card(sessionID string, position int) Flashcard {
+	st.t.Helper()
+	var cardJSON string
+	err := db.QueryRow(`SELECT card FROM session_questions WHERE session_id = ? AND position = ?`, sessionID, position).Scan(&cardJSON)
+	if err != nil {
+		st.t.Fatalf("loading question %d: %v", position, err)
+	}
+	var card Flashcard
+	if err := json.Unmarshal([]byte(cardJSON), &card); err != nil {
+		st.t.Fatalf("decoding question %d: %v", position, err)
+	}
+	return card
+}
+
+// answer submits the right or a wrong answer to a question
+func (st *sessionTest) answer(sessionID string, position int, right bool) (sessionAnswerResponse, int) {
+	st.t.Helper()
+	card := st.card(sessionID, position)
+	answer := "-1"
+	if right {
+		answer = card.Answer
+		if card.Type == "fact" {
+			pair := card.Payload.ValidFactors[0]
+			answer = fmt.Sprintf("%d x %d", pair[0], pair[1])
+		}
+	}
+	var resp sessionAnswerResponse
+	code := st.post("/api/sessions/"+sessionID+"/answers", sessionAnswerRequest{Position: position, Answer: answer}, &resp)
+	return resp, code
+}
+
+func TestSessionHidesAnswers(t *testing.T) {
+	st := newSessionTest(t)
+
+	session := st.start("mul", 5)
+	if session.Total != 5 || len(session.Deck) != 5 {
+		t.Fatalf("session of 5 questions = %+v", session)
+	}
+	for _, card := range session.Deck {
+		if card.Answer != "" || card.Payload.Answer != nil || card.Payload.ValidFactors != nil {
+			t.Errorf("deck card %q carries its answer", card.Question)
+		}
+	}
+
+	// A session is created for a pupil of the group of the credentials
+	st.key = ""
+	if code := st.post("/api/sessions", createSessionRequest{UserID: &st.user.ID}, nil); code != http.StatusUnauthorized {
+		t.Errorf("creating a session without credentials: %d, want 401", code)
+	}
+}
+
+func TestSessionCompletes(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mul", 3)
+
+	for position, right := range []bool{true, false} {
+		resp, code := st.answer(session.SessionID, position, right)
+		if code != http.StatusOK || resp.Correct != right || resp.Completed || resp.Answered != position+1 {
+			t.Fatalf("answer %d = %d, %+v", position, code, resp)
+		}
+	}
+	if _, code := st.answer(session.SessionID, 1, true); code != http.StatusConflict {
+		t.Errorf("second answer to a question: %d, want 409", code)
+	}
+	if code := st.post("/api/sessions/"+session.SessionID+"/answers", sessionAnswerRequest{Position: 3, Answer: "4"}, nil); code != http.StatusBadRequest {
+		t.Errorf("answer out of the deck: %d, want 400", code)
+	}
+
+	// The last answer records the result computed by the server
+	resp, code := st.answer(session.SessionID, 2, true)
+	if code != http.StatusOK || !resp.Completed || resp.Result == nil {
+		t.Fatalf("last answer = %d, %+v", code, resp)
+	}
+	if resp.Result.Score != 2 || resp.Result.Total != 3 || resp.Result.UserID != st.user.ID || resp.Result.Tables != "[2,3]" {
+		t.Errorf("result = %+v", resp.Result.Attempt)
+	}
+	runs, err := store.UserRuns(st.user.ID, "mul", timeWindow{})
+	if err != nil || len(runs) != 1 || runs[0].ID != resp.Result.ID || runs[0].Score != 2 {
+		t.Errorf("saved results = %+v, %v", runs, err)
+	}
+
+	// Every answer is logged, the wrong one counted as an error
+	var events int
+	db.QueryRow(`SELECT COUNT(*) FROM answer_events WHERE session_id = ?`, session.SessionID).Scan(&events)
+	if events != 3 {
+		t.Errorf("%d answer events, want 3", events)
+	}
+	if errs, _ := store.UserErrors(st.user.ID, "mul"); len(errs) != 1 || errs[0].ErrorCount != 1 {
+		t.Errorf("user errors = %+v", errs)
+	}
+
+	if _, code := st.answer(session.SessionID, 0, true); code != http.StatusConflict {
+		t.Errorf("answer to a completed session: %d, want 409", code)
+	}
+	if code := st.post("/api/sessions/"+session.SessionID+"/finish", nil, nil); code != http.StatusConflict {
+		t.Errorf("finishing a completed session: %d, want 409", code)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mul", 2)
+
+	if code := st.post(fmt.Sprintf("/api/sessions/%s/questions/0/start", session.SessionID), nil, nil); code != http.StatusOK {
+		t.Fatalf("starting question 0: %d", code)
+	}
+	// The question was displayed longer than its time limit ago
+	card := st.card(session.SessionID, 0)
+	limit := questionTimeLimit(card)
+	if _, err := db.Exec(`UPDATE session_questions SET asked_at = ? WHERE session_id = ? AND position = 0`,
+		time.Now().UTC().Add(-limit-5*time.Second), session.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	// Starting it again does not restart the timer
+	st.post(fmt.Sprintf("/api/sessions/%s/questions/0/start", session.SessionID), nil, nil)
+
+	resp, code := st.answer(session.SessionID, 0, true)
+	if code != http.StatusOK || !resp.TimedOut || resp.Correct || resp.ResponseMs != limit.Milliseconds() {
+		t.Errorf("late right answer = %d, %+v", code, resp)
+	}
+	if resp.Expected != card.Answer {
+		t.Errorf("expected answer = %q, want %q", resp.Expected, card.Answer)
+	}
+
+	// Without a start, the timer runs from the previous answer
+	resp, _ = st.answer(session.SessionID, 1, true)
+	if resp.TimedOut || !resp.Correct || resp.ResponseMs > limit.Milliseconds() {
+		t.Errorf("timely answer = %+v", resp)
+	}
+}
+
+func TestSessionExpires(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mul", 2)
+	if _, err := db.Exec(`UPDATE quiz_sessions SET created_at = ? WHERE id = ?`,
+		time.Now().UTC().Add(-sessionMaxAge-time.Minute), session.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := st.answer(session.SessionID, 0, true); code != http.StatusGone {
+		t.Errorf("answer to an expired session: %d, want 410", code)
+	}
+	if code := st.post("/api/sessions/unknown/answers", sessionAnswerRequest{}, nil); code != http.StatusNotFound {
+		t.Errorf("answer to an unknown session: %d, want 404", code)
+	}
+}
+
+func TestSessionFinishedEarly(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mul", 5)
+	finish := "/api/sessions/" + session.SessionID + "/finish"
+
+	if code := st.post(finish, nil, nil); code != http.StatusConflict {
+		t.Errorf("finishing without answers: %d, want 409", code)
+	}
+	st.answer(session.SessionID, 0, true)
+	st.answer(session.SessionID, 1, false)
+
+	// The questions answered so far are recorded
+	var result sessionResult
+	if code := st.post(finish, nil, &result); code != http.StatusOK {
+		t.Fatalf("finishing early: %d", code)
+	}
+	if result.Score != 1 || result.Total != 2 {
+		t.Errorf("early result = %+v", result.Attempt)
+	}
+	if _, code := st.answer(session.SessionID, 2, true); code != http.StatusConflict {
+		t.Errorf("answer after finishing: %d, want 409", code)
+	}
+}
+
+func TestSessionDiamondChallenge(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mega", 0)
+	if session.Total != sessionQuestionsMega {
+		t.Fatalf("Megamix session of %d questions, want %d", session.Total, sessionQuestionsMega)
+	}
+	extend := "/api/sessions/" + session.SessionID + "/extend"
+
+	for position := range sessionQuestionsMega - 1 {
+		st.answer(session.SessionID, position, true)
+	}
+	if code := st.post(extend, nil, nil); code != http.StatusConflict {
+		t.Errorf("extending an unfinished session: %d, want 409", code)
+	}
+
+	// A perfect Megamix session waits for the choice of the pupil
+	resp, _ := st.answer(session.SessionID, sessionQuestionsMega-1, true)
+	if !resp.Extendable || resp.Completed || resp.Score != sessionQuestionsMega {
+		t.Fatalf("last Megamix answer = %+v", resp)
+	}
+
+	var extension sessionResponse
+	if code := st.post(extend, nil, &extension); code != http.StatusOK {
+		t.Fatalf("extending: %d", code)
+	}
+	if extension.First != sessionQuestionsMega || extension.Total != sessionQuestionsMax || len(extension.Deck) != sessionQuestionsMax-sessionQuestionsMega {
+		t.Errorf("extension = first %d, total %d, %d cards", extension.First, extension.Total, len(extension.Deck))
+	}
+	if code := st.post(extend, nil, nil); code != http.StatusConflict {
+		t.Errorf("extending twice: %d, want 409", code)
+	}
+
+	resp, _ = st.answer(session.SessionID, sessionQuestionsMega, false)
+	if resp.Extendable || resp.Completed || resp.Total != sessionQuestionsMax {
+		t.Errorf("first diamond answer = %+v", resp)
+	}
+	var result sessionResult
+	if code := st.post("/api/sessions/"+session.SessionID+"/finish", nil, &result); code != http.StatusOK {
+		t.Fatalf("finishing the diamond challenge: %d", code)
+	}
+	if result.Score != sessionQuestionsMega || result.Total != sessionQuestionsMega+1 {
+		t.Errorf("diamond challenge result = %+v", result.Attempt)
+	}
+}
+
+func TestSessionDeclinesDiamondChallenge(t *testing.T) {
+	st := newSessionTest(t)
+	session := st.start("mega", 0)
+	for position := range sessionQuestionsMega {
+		st.answer(session.SessionID, position, true)
+	}
+
+	var result sessionResult
+	if code := st.post("/api/sessions/"+session.SessionID+"/finish", nil, &result); code != http.StatusOK {
+		t.Fatalf("finishing: %d", code)
+	}
+	if result.Score != sessionQuestionsMega || result.Total != sessionQuestionsMega {
+		t.Errorf("result = %+v", result.Attempt)
+	}
+	var earned []string
+	for _, badge := range result.NewBadges {
+		earned = append(earned, badge.ID)
+	}
+	if strings.Join(earned, ",") != "gold" {
+		t.Errorf("new badges of a perfect Megamix = %v", earned)
+	}
+}
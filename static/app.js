@@ -12,7 +12,6 @@ const MAX_OPERATIONS_MEGA = 100; // Nombre d'opérations pour Megamix
 const MAX_OPERATIONS_DIAMOND = 200; // Nombre d'opérations pour le défi Diamant Megamix
 
 let isDiamondChallenge = false; // Indique si on est dans le défi Diamant
-let diamondChallengeScore = 0; // Score cumulé pour le défi Diamant
 
 // Retourne le temps limite en fonction du mode d'exercice
 function getTimeLimit(card) {
@@ -22,14 +21,15 @@ function getTimeLimit(card) {
     }
     return exerciseMode === 'fact' ? TIME_LIMIT_FACT : TIME_LIMIT;
 }
-let responseTimes = []; // Stocke les temps de réponse
-let questionStartTime; // Enregistre l'heure de début de chaque question
+let responseTimes = []; // Stocke les temps de réponse mesurés par le serveur
 let MAX_TABLE = 12; // Nombre maximum de tables disponibles (12 pour multiplications, 10 pour additions)
 let exerciseMode = 'mul'; // 'mul', 'add', 'sub', ou 'fact'
 let selectedTablesChosen = []; // Stocke les tables sélectionnées pour l'affichage final
-let userErrors = []; // Erreurs de l'utilisateur récupérées du serveur
-let resultSent = false; // Empêche l'envoi multiple des résultats
 let userBestScore = { score: 0, total: 0 }; // Meilleur score précédent de l'utilisateur
+let quizSessionId = null; // Identifiant de la partie sur le serveur, qui corrige les réponses
+let questionStarted = null; // Requête de démarrage de la question affichée
+let quizExtendable = false; // Partie Megamix parfaite pouvant passer au défi Diamant
+let quizResult = null; // Résultat enregistré par le serveur à la fin de la partie
 
 // Helpers cookies
 function setCookie(name, value, days) {
@@ -119,13 +119,13 @@ async function fetchGroupBySecretKey(secretKey) {
     }
 }
 
-// Create a new group
-async function createNewGroup(name) {
+// Create a new group, with an optional admin PIN for the teacher or parent
+async function createNewGroup(name, adminPin) {
     try {
         const response = await fetch('/api/groups', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ name: name })
+            body: JSON.stringify({ name: name, admin_pin: adminPin || undefined })
         });
         if (response.ok) {
             return await response.json();
@@ -164,20 +164,9 @@ function updateGroupDisplay() {
     }
 }
 
-// Récupère les erreurs de l'utilisateur depuis le serveur
-async function fetchUserErrors() {
-    const playerName = getCookie('playerName');
-    if (!playerName) return [];
-
-    try {
-        const response = await fetch(`/api/user-errors?name=${encodeURIComponent(playerName)}&type=${encodeURIComponent(exerciseMode)}`);
-        if (response.ok) {
-            return await response.json();
-        }
-    } catch (e) {
-        console.warn('Erreur lors de la récupération des erreurs utilisateur:', e);
-    }
-    return [];
+// Paramètre group_id à ajouter aux requêtes utilisateur
+function groupQueryParam() {
+    return currentGroupId ? `&group_id=${currentGroupId}` : '';
 }
 
 // Récupère le meilleur score de l'utilisateur
@@ -186,7 +175,9 @@ async function fetchUserBestScore() {
     if (!playerName) return { score: 0, total: 0 };
 
     try {
-        const response = await fetch(`/api/user-best?name=${encodeURIComponent(playerName)}&type=${encodeURIComponent(exerciseMode)}`);
+        const response = await fetch(`/api/user-best?name=${encodeURIComponent(playerName)}&type=${encodeURIComponent(exerciseMode)}${groupQueryParam()}`, {
+            headers: groupHeaders()
+        });
         if (response.ok) {
             return await response.json();
         }
@@ -267,64 +258,68 @@ function showCelebration(isPerfect, isNewRecord, isDiamondMegamix = false) {
     });
 }
 
-// Enregistre une erreur pour l'utilisateur
-async function recordUserError(question) {
-    const playerName = getCookie('playerName');
-    if (!playerName) return;
+// En-têtes avec la clé du groupe, qui authentifie l'élève
+function groupHeaders() {
+    return currentGroupSecretKey ? { 'X-Group-Key': currentGroupSecretKey } : {};
+}
 
-    try {
-        const payload = {
-            name: playerName,
-            exercise_type: exerciseMode,
-            question: question
-        };
-        // Include group_id if set
-        if (currentGroupId) {
-            payload.group_id = currentGroupId;
-        }
-        await fetch('/api/user-error', {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify(payload)
-        });
-    } catch (e) {
-        console.warn('Erreur lors de l\'enregistrement de l\'erreur:', e);
-    }
+// En-têtes des requêtes JSON
+function jsonHeaders() {
+    return Object.assign({ 'Content-Type': 'application/json' }, groupHeaders());
 }
 
-// Sélection pondérée des flashcards (les erreurs ont plus de poids)
-function selectWeightedFlashcards(allCards, errors, count) {
-    if (allCards.length === 0) return [];
-    if (allCards.length <= count) return allCards;
+// Démarre une partie sur le serveur, qui choisit les questions et corrige les réponses
+async function createQuizSession(mode, selectedTables) {
+    const payload = {
+        name: getCookie('playerName') || '',
+        exercise_type: mode
+    };
+    if (mode !== 'mega' && Array.isArray(selectedTables) && selectedTables.length > 0) {
+        payload.tables = selectedTables;
+    }
+    // Include group_id if set
+    if (currentGroupId) {
+        payload.group_id = currentGroupId;
+    }
+    const response = await fetch('/api/sessions', {
+        method: 'POST',
+        headers: jsonHeaders(),
+        body: JSON.stringify(payload)
+    });
+    if (!response.ok) throw new Error('HTTP ' + response.status);
+    return await response.json();
+}
 
-    // Créer une map des erreurs par question
-    const errorMap = new Map(errors.map(e => [e.question, e.error_count]));
+// Envoie une requête sur la partie en cours
+async function postQuizSession(path, payload) {
+    const response = await fetch(`/api/sessions/${encodeURIComponent(quizSessionId)}${path}`, {
+        method: 'POST',
+        headers: jsonHeaders(),
+        body: JSON.stringify(payload || {})
+    });
+    if (!response.ok) throw new Error('HTTP ' + response.status);
+    return await response.json();
+}
 
-    // Assigner des poids: erreurs ont 2x le poids par error_count (max 5)
-    const weighted = allCards.map(card => ({
-        card,
-        weight: errorMap.has(card.question)
-            ? Math.min(2 * errorMap.get(card.question), 5)
-            : 1
+// Adapte les questions d'une partie au format utilisé par l'interface
+function sessionCards(session) {
+    const first = session.first || 0;
+    return session.deck.map((card, i) => ({
+        position: first + i,
+        question: card.question,
+        type: card.type
     }));
+}
 
-    // Sélection aléatoire pondérée sans remplacement
-    const selected = [];
-    while (selected.length < count && weighted.length > 0) {
-        const totalWeight = weighted.reduce((sum, w) => sum + w.weight, 0);
-        let random = Math.random() * totalWeight;
-
-        for (let i = 0; i < weighted.length; i++) {
-            random -= weighted[i].weight;
-            if (random <= 0) {
-                selected.push(weighted[i].card);
-                weighted.splice(i, 1);
-                break;
-            }
-        }
+// Construit l'affichage de la réponse correcte renvoyée par le serveur
+function correctAnswerText(answer) {
+    if (Array.isArray(answer.valid_factors) && answer.valid_factors.length > 0) {
+        // Afficher toutes les paires de facteurs valides
+        return answer.valid_factors
+            .map(pair => `${pair[0]} x ${pair[1]}`)
+            .join(' ou ');
     }
-
-    return selected;
+    return answer.expected;
 }
 
 // Fonction pour générer les cases à cocher pour les tables
@@ -351,158 +346,6 @@ function generateCheckboxes() {
     }
 }
 
-// Fonction pour générer les flashcards en fonction des tables sélectionnées
-function generateFlashcards(selectedTables) {
-    const flashcards = [];
-
-    if (exerciseMode === 'fact') {
-        // Mode factorisation: générer des produits uniques
-        const productsSet = new Set();
-        const productsData = [];
-
-        for (let i = 1; i <= 10; i++) {
-            selectedTables.forEach((table) => {
-                const product = table * i;
-                if (!productsSet.has(product)) {
-                    productsSet.add(product);
-                    productsData.push({
-                        product: product,
-                        validFactors: getFactorPairs(product)
-                    });
-                }
-            });
-        }
-
-        productsData.forEach(data => {
-            // Ne pas inclure les produits sans facteurs valides (ex: nombres premiers > 12)
-            if (data.validFactors.length > 0) {
-                flashcards.push({
-                    question: `${data.product} = ? x ?`,
-                    answer: null, // Non utilisé pour le mode fact
-                    validFactors: data.validFactors,
-                    times_wrong: 0
-                });
-            }
-        });
-    } else {
-        // Modes mul, add, sub
-        for (let i = 1; i <= 10; i++) {
-            selectedTables.forEach((table) => {
-                let question;
-                let answer;
-                if (exerciseMode === 'add') {
-                    question = `${table} + ${i} = ?`;
-                    answer = (table + i).toString();
-                } else if (exerciseMode === 'sub') {
-                    // Générer des soustractions sans résultat négatif
-                    if (i <= table) {
-                        question = `${table} - ${i} = ?`;
-                        answer = (table - i).toString();
-                    } else {
-                        question = `${i} - ${table} = ?`;
-                        answer = (i - table).toString();
-                    }
-                } else {
-                    question = `${table} x ${i} = ?`;
-                    answer = (table * i).toString();
-                }
-                const flashcard = {
-                    question: question,
-                    answer: answer,
-                    times_wrong: 0
-                };
-                flashcards.push(flashcard);
-            });
-        }
-    }
-    return flashcards;
-}
-
-// Fonction pour générer les flashcards Megamix (mélange de tous les types)
-function generateMegamixFlashcards() {
-    const flashcards = [];
-    const allTables = [];
-    for (let i = 1; i <= 12; i++) {
-        allTables.push(i);
-    }
-
-    // Générer des multiplications
-    for (let i = 1; i <= 10; i++) {
-        allTables.forEach((table) => {
-            flashcards.push({
-                question: `${table} x ${i} = ?`,
-                answer: (table * i).toString(),
-                times_wrong: 0,
-                type: 'mul'
-            });
-        });
-    }
-
-    // Générer des additions
-    for (let i = 1; i <= 10; i++) {
-        allTables.forEach((table) => {
-            flashcards.push({
-                question: `${table} + ${i} = ?`,
-                answer: (table + i).toString(),
-                times_wrong: 0,
-                type: 'add'
-            });
-        });
-    }
-
-    // Générer des soustractions (sans résultats négatifs)
-    for (let i = 1; i <= 10; i++) {
-        allTables.forEach((table) => {
-            if (i <= table) {
-                flashcards.push({
-                    question: `${table} - ${i} = ?`,
-                    answer: (table - i).toString(),
-                    times_wrong: 0,
-                    type: 'sub'
-                });
-            } else {
-                flashcards.push({
-                    question: `${i} - ${table} = ?`,
-                    answer: (i - table).toString(),
-                    times_wrong: 0,
-                    type: 'sub'
-                });
-            }
-        });
-    }
-
-    // Générer des factorisations (produits uniques avec facteurs valides)
-    const productsSet = new Set();
-    for (let i = 1; i <= 10; i++) {
-        allTables.forEach((table) => {
-            const product = table * i;
-            if (!productsSet.has(product)) {
-                productsSet.add(product);
-                const validFactors = getFactorPairs(product);
-                if (validFactors.length > 0) {
-                    flashcards.push({
-                        question: `${product} = ? x ?`,
-                        answer: null,
-                        validFactors: validFactors,
-                        times_wrong: 0,
-                        type: 'fact'
-                    });
-                }
-            }
-        });
-    }
-
-    return flashcards;
-}
-
-// Fonction pour mélanger les flashcards
-function shuffleFlashcards() {
-    for (let i = flashcards.length - 1; i > 0; i--) {
-        const j = Math.floor(Math.random() * (i + 1));
-        [flashcards[i], flashcards[j]] = [flashcards[j], flashcards[i]];
-    }
-}
-
 // Fonction utilitaire pour tenter d'afficher le clavier logiciel sur mobile
 function ensureKeyboardOpen(inputEl) {
     if (!inputEl) return;
@@ -522,61 +365,6 @@ function ensureKeyboardOpen(inputEl) {
     }
 }
 
-// Retourne toutes les paires de facteurs pour un nombre donné
-// - Les deux facteurs doivent être <= 12
-// - Exclut 1×n sauf si c'est la seule option
-// Ex: getFactorPairs(12) retourne [[2,6], [3,4]] (sans 1x12)
-// Ex: getFactorPairs(44) retourne [[4,11]] (2x22 exclu car 22 > 12)
-// Ex: getFactorPairs(7) retourne [[1,7]] (seule option pour un nombre premier)
-function getFactorPairs(n) {
-    const pairs = [];
-    for (let i = 1; i <= Math.sqrt(n); i++) {
-        if (n % i === 0) {
-            const other = n / i;
-            // Les deux facteurs doivent être <= 12
-            if (i <= 12 && other <= 12) {
-                pairs.push([i, other]);
-            }
-        }
-    }
-    // Exclure la paire [1, n] sauf si c'est la seule option
-    if (pairs.length > 1) {
-        return pairs.filter(pair => pair[0] !== 1);
-    }
-    return pairs;
-}
-
-// Valide la réponse de l'utilisateur pour le mode factorisation
-// Accepte: "3,4", "3x4", "3*4", "3 4", "4,3" (l'ordre n'a pas d'importance)
-function validateFactorAnswer(userAnswer, validFactors) {
-    // Normaliser l'entrée: remplacer les séparateurs par des virgules
-    const normalized = userAnswer
-        .toLowerCase()
-        .replace(/\s+/g, ',')   // espaces en virgule
-        .replace(/[x*×]/g, ',') // x, *, × en virgule
-        .replace(/,+/g, ',')    // plusieurs virgules en une seule
-        .trim();
-
-    const parts = normalized.split(',').filter(p => p.length > 0);
-
-    if (parts.length !== 2) {
-        return false;
-    }
-
-    const a = parseInt(parts[0], 10);
-    const b = parseInt(parts[1], 10);
-
-    if (isNaN(a) || isNaN(b)) {
-        return false;
-    }
-
-    // Vérifier contre les paires de facteurs valides (l'ordre n'a pas d'importance)
-    return validFactors.some(pair =>
-        (pair[0] === a && pair[1] === b) ||
-        (pair[0] === b && pair[1] === a)
-    );
-}
-
 // Fonction pour afficher une flashcard
 function displayFlashcard() {
     if (currentCardIndex >= flashcards.length) {
@@ -621,8 +409,9 @@ function displayFlashcard() {
     answerInput.focus();
     ensureKeyboardOpen(answerInput);
 
-    // Enregistrer l'heure de début
-    questionStartTime = Date.now();
+    // Le serveur chronomètre la question à partir de ce signal
+    questionStarted = postQuizSession(`/questions/${card.position}/start`)
+        .catch(err => console.warn('Erreur lors du démarrage de la question:', err));
 
     // Démarrer le timer
     startTimer();
@@ -650,6 +439,36 @@ function startTimer() {
     }, 1000);
 }
 
+// Envoie la réponse de la question affichée au serveur, qui la corrige
+async function sendAnswer(userAnswer) {
+    const card = flashcards[currentCardIndex];
+
+    // Désactiver le champ de saisie et les boutons pendant le délai
+    document.getElementById('answer').disabled = true;
+    document.getElementById('submit').disabled = true;
+    document.getElementById('end').disabled = true;
+
+    let answer;
+    try {
+        await questionStarted;
+        answer = await postQuizSession('/answers', { position: card.position, answer: userAnswer });
+    } catch (e) {
+        console.warn('Erreur lors de l\'envoi de la réponse:', e);
+        document.getElementById('feedback').innerText = 'Connexion perdue : la partie ne peut pas être enregistrée.';
+        delayTimer = setTimeout(showResults, 3000);
+        return null;
+    }
+
+    score = answer.score;
+    responseTimes.push(answer.response_ms / 1000);
+    quizExtendable = answer.extendable === true;
+    if (answer.completed) {
+        quizResult = answer.result;
+    }
+    currentCardIndex++;
+    return answer;
+}
+
 // Fonction appelée lorsque le temps est écoulé
 async function handleTimeout() {
     clearInterval(timer);
@@ -660,36 +479,11 @@ async function handleTimeout() {
     }
 
     const card = flashcards[currentCardIndex];
-
-    // Déterminer le type de question (pour mega mode, utiliser card.type)
-    const questionType = (exerciseMode === 'mega' && card.type) ? card.type : exerciseMode;
-
-    // Construire l'affichage de la réponse correcte
-    let correctAnswerDisplay;
-    if (questionType === 'fact') {
-        // Afficher toutes les paires de facteurs valides
-        correctAnswerDisplay = card.validFactors
-            .map(pair => `${pair[0]} x ${pair[1]}`)
-            .join(' ou ');
-    } else {
-        correctAnswerDisplay = card.answer;
-    }
+    const answer = await sendAnswer('');
+    if (!answer) return;
 
     // Afficher le message en français
-    document.getElementById('feedback').innerText = `Temps écoulé ! Veuillez répéter 10 fois : ${card.question.replace(' = ? x ?', '')} = ${correctAnswerDisplay}`;
-
-    // Désactiver le champ de saisie et les boutons pendant le délai
-    document.getElementById('answer').disabled = true;
-    document.getElementById('submit').disabled = true;
-    document.getElementById('end').disabled = true;
-
-    // Enregistrer le temps de réponse comme étant la limite de temps
-    responseTimes.push(getTimeLimit(card) / 1000);
-
-    // Enregistrer l'erreur dans la base de données
-    await recordUserError(card.question);
-
-    currentCardIndex++;
+    document.getElementById('feedback').innerText = `Temps écoulé ! Veuillez répéter 10 fois : ${card.question.replace(' = ? x ?', '')} = ${correctAnswerText(answer)}`;
 
     // Attendre 10 secondes avant d'afficher la prochaine carte
     delayTimer = setTimeout(displayFlashcard, 10000);
@@ -700,61 +494,25 @@ async function submitAnswer() {
     // Arrêter le timer
     clearInterval(timer);
 
-    // Vérifier si le quiz est terminé
-    if (currentCardIndex >= flashcards.length) {
+    // Vérifier si le quiz est terminé ou si une réponse est en cours d'envoi
+    if (currentCardIndex >= flashcards.length || document.getElementById('submit').disabled) {
         return;
     }
 
     const card = flashcards[currentCardIndex];
     const userAnswer = document.getElementById('answer').value.trim();
+    const answer = await sendAnswer(userAnswer);
+    if (!answer) return;
 
-    // Désactiver le champ de saisie et les boutons pendant le délai
-    document.getElementById('answer').disabled = true;
-    document.getElementById('submit').disabled = true;
-    document.getElementById('end').disabled = true;
-
-    // Calculer le temps de réponse
-    const responseTime = (Date.now() - questionStartTime) / 1000; // En secondes
-    responseTimes.push(responseTime);
-
-    // Déterminer le type de question (pour mega mode, utiliser card.type)
-    const questionType = (exerciseMode === 'mega' && card.type) ? card.type : exerciseMode;
-
-    // Vérifier la réponse selon le type de question
-    let isCorrect = false;
-    if (questionType === 'fact') {
-        isCorrect = validateFactorAnswer(userAnswer, card.validFactors);
-    } else {
-        isCorrect = userAnswer.toLowerCase() === card.answer.toLowerCase();
-    }
-
-    if (isCorrect) {
+    if (answer.correct) {
         document.getElementById('feedback').innerText = 'Correct !';
-        score++;
-
-        currentCardIndex++;
 
         // Attendre 500ms avant d'afficher la prochaine carte
         delayTimer = setTimeout(displayFlashcard, 500);
     } else {
-        // Construire l'affichage de la réponse correcte
-        let correctAnswerDisplay;
-        if (questionType === 'fact') {
-            // Afficher toutes les paires de facteurs valides
-            correctAnswerDisplay = card.validFactors
-                .map(pair => `${pair[0]} x ${pair[1]}`)
-                .join(' ou ');
-        } else {
-            correctAnswerDisplay = card.answer;
-        }
-
         // Afficher le message en français
-        document.getElementById('feedback').innerText = `Veuillez répéter 10 fois : ${card.question.replace(' = ? x ?', '')} = ${correctAnswerDisplay}`;
-
-        // Enregistrer l'erreur dans la base de données
-        await recordUserError(card.question);
-
-        currentCardIndex++;
+        const prefix = answer.timed_out ? 'Temps écoulé ! ' : '';
+        document.getElementById('feedback').innerText = `${prefix}Veuillez répéter 10 fois : ${card.question.replace(' = ? x ?', '')} = ${correctAnswerText(answer)}`;
 
         // Attendre 10 secondes avant d'afficher la prochaine carte
         delayTimer = setTimeout(displayFlashcard, 10000);
@@ -762,14 +520,27 @@ async function submitAnswer() {
 }
 
 // Fonction pour terminer le quiz
-function endQuiz() {
+async function endQuiz() {
     // Arrêter les timers
     clearInterval(timer);
     clearTimeout(delayTimer);
+    document.getElementById('end').disabled = true;
 
+    // Le serveur enregistre les réponses déjà données
+    await finishPartialQuiz();
     showResults();
 }
 
+// Enregistre le résultat d'une partie interrompue à partir des réponses déjà données
+async function finishPartialQuiz() {
+    if (!quizSessionId || quizResult || currentCardIndex === 0) return;
+    try {
+        quizResult = await postQuizSession('/finish');
+    } catch (e) {
+        console.warn('Erreur lors de l\'enregistrement du résultat:', e);
+    }
+}
+
 // Fonction pour afficher les résultats
 function showResults() {
     // Effacer tout timer restant
@@ -795,10 +566,8 @@ function showResults() {
         ? selectedTablesChosen.slice().sort((a,b)=>a-b).join(', ')
         : 'aucune';
 
-    // Vérifier si c'est un score parfait Megamix (100/100) et pas encore en défi Diamant
-    const isPerfectMegamix = exerciseMode === 'mega' && score === 100 && currentCardIndex === 100 && !isDiamondChallenge;
-
-    if (isPerfectMegamix) {
+    // Le serveur propose le défi Diamant après un score parfait Megamix (100/100)
+    if (quizExtendable && !isDiamondChallenge) {
         // Proposer le défi Diamant
         document.getElementById('flashcard').innerHTML = `
             <p>Bravo ! Score parfait : ${score}/${currentCardIndex} !</p>
@@ -817,32 +586,23 @@ function showResults() {
         return;
     }
 
-    // Résultats normaux
-    let totalScore = score;
-    let totalQuestions = currentCardIndex;
-
-    // Si on termine le défi Diamant
-    if (isDiamondChallenge) {
-        totalScore = diamondChallengeScore + score;
-        totalQuestions = 100 + currentCardIndex; // 100 premières + les nouvelles
+    // Sans résultat du serveur, la partie n'a pas pu être enregistrée
+    if (!quizResult) {
+        document.getElementById('flashcard').innerHTML = `
+            <p>Partie interrompue : ${score} bonnes réponses sur ${currentCardIndex}. Tables sélectionnées : ${tablesText}.</p>
+            <p>Le score n'a pas pu être enregistré.</p>
+        `;
+        isDiamondChallenge = false;
+        return;
     }
 
+    const totalScore = quizResult.score;
+    const totalQuestions = quizResult.total;
     document.getElementById('flashcard').innerHTML = `
         <p>Vous avez obtenu ${totalScore} bonnes réponses sur ${totalQuestions}. Tables sélectionnées : ${tablesText}.</p>
-        <p>Temps de réponse moyen : ${meanResponseTimeText} secondes</p>
+        <p>Temps de réponse moyen : ${quizResult.mean_time_seconds.toFixed(2)} secondes</p>
     `;
 
-    // Envoi du résultat vers la base de données (et Google Sheets si configuré)
-    if (!resultSent) {
-        resultSent = true;
-        const playerName = getCookie('playerName') || '';
-        try {
-            sendResultToSheet(playerName, totalScore, totalQuestions, selectedTablesChosen, meanResponseTimeSec);
-        } catch (e) {
-            console.warn('Envoi du résultat non effectué:', e);
-        }
-    }
-
     // Vérifier si c'est un score parfait ou un nouveau record
     const isPerfect = totalScore === totalQuestions && totalQuestions > 0;
     const currentRatio = totalQuestions > 0 ? totalScore / totalQuestions : 0;
@@ -870,25 +630,24 @@ function showResults() {
 
     // Réinitialiser le défi Diamant
     isDiamondChallenge = false;
-    diamondChallengeScore = 0;
 }
 
-// Démarrer le défi Diamant (100 questions supplémentaires)
+// Démarrer le défi Diamant (100 questions supplémentaires dans la même partie)
 async function startDiamondChallenge() {
+    let extension;
+    try {
+        extension = await postQuizSession('/extend');
+    } catch (e) {
+        console.warn('Erreur lors du démarrage du défi Diamant:', e);
+        alert('Le défi Diamant n\'a pas pu démarrer.');
+        return;
+    }
     isDiamondChallenge = true;
-    diamondChallengeScore = score; // Sauvegarder le score des 100 premières questions
-
-    // Générer 100 nouvelles questions
-    const allFlashcards = generateMegamixFlashcards();
-    flashcards = selectWeightedFlashcards(allFlashcards, userErrors, MAX_OPERATIONS_MEGA);
-    shuffleFlashcards();
-
-    // Réinitialiser pour la deuxième partie
-    currentCardIndex = 0;
-    score = 0;
-    resultSent = false;
+    quizExtendable = false;
+    flashcards = flashcards.concat(sessionCards(extension));
 
     // Réactiver les contrôles
+    document.getElementById('flashcard').innerHTML = quizMarkup;
     document.getElementById('submit').addEventListener('click', submitAnswer);
     document.getElementById('answer').addEventListener('keyup', answerKeyUpHandler);
     document.getElementById('end').addEventListener('click', endQuiz);
@@ -897,63 +656,16 @@ async function startDiamondChallenge() {
 }
 
 // Terminer sans tenter le défi Diamant
-function finishWithoutDiamond() {
-    const totalResponseTime = responseTimes.reduce((acc, val) => acc + val, 0);
-    const meanResponseTimeSec = responseTimes.length > 0 ? (totalResponseTime / responseTimes.length) : 0;
-    const meanResponseTimeText = meanResponseTimeSec.toFixed(2);
-
-    const tablesText = selectedTablesChosen && selectedTablesChosen.length > 0
-        ? selectedTablesChosen.slice().sort((a,b)=>a-b).join(', ')
-        : 'aucune';
-
-    document.getElementById('flashcard').innerHTML = `
-        <p>Vous avez obtenu ${score} bonnes réponses sur ${currentCardIndex}. Tables sélectionnées : ${tablesText}.</p>
-        <p>Temps de réponse moyen : ${meanResponseTimeText} secondes</p>
-    `;
-
-    // Envoi du résultat
-    if (!resultSent) {
-        resultSent = true;
-        const playerName = getCookie('playerName') || '';
-        try {
-            sendResultToSheet(playerName, score, currentCardIndex, selectedTablesChosen, meanResponseTimeSec);
-        } catch (e) {
-            console.warn('Envoi du résultat non effectué:', e);
-        }
-    }
-
-    // Afficher la célébration pour le score parfait
-    showCelebration(true, true);
-}
-
-// Envoi du résultat au backend (qui poste ensuite vers Google Sheets)
-function sendResultToSheet(name, score, total, tables, meanTimeSeconds) {
+async function finishWithoutDiamond() {
     try {
-        const payload = {
-            name: name || '',
-            score: Number(score) || 0,
-            total: Number(total) || 0,
-            tables: Array.isArray(tables) ? tables : [],
-            exercise_type: exerciseMode || 'mul',
-            mean_time_seconds: Number.isFinite(meanTimeSeconds) ? meanTimeSeconds : 0
-        };
-        // Include group_id if set
-        if (currentGroupId) {
-            payload.group_id = currentGroupId;
-        }
-        return fetch('/api/result', {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify(payload)
-        }).then(res => {
-            if (!res.ok) throw new Error('HTTP ' + res.status);
-            return res.json().catch(() => ({}));
-        }).catch(err => {
-            console.warn('Erreur lors de l\'envoi au backend:', err);
-        });
+        quizResult = await postQuizSession('/finish');
     } catch (e) {
-        console.warn('Exception sendResultToSheet:', e);
+        console.warn('Erreur lors de l\'enregistrement du résultat:', e);
+        alert('Le résultat n\'a pas pu être enregistré.');
+        return;
     }
+    quizExtendable = false;
+    showResults();
 }
 
 // Gestionnaire pour la touche "Entrée" dans le champ de réponse
@@ -1137,7 +849,14 @@ window.onload = async function() {
             const name = nameInput.value.trim();
             if (!name) return;
 
-            const group = await createNewGroup(name);
+            const pinInput = document.getElementById('new-group-pin');
+            const adminPin = pinInput ? pinInput.value : '';
+            if (adminPin && adminPin.length < 4) {
+                alert('Le code administrateur doit contenir au moins 4 caracteres');
+                return;
+            }
+
+            const group = await createNewGroup(name, adminPin);
             if (group) {
                 saveGroupToCookies(group.id, group.secret_key, group.name);
                 if (groupSection) groupSection.style.display = 'none';
@@ -1277,35 +996,32 @@ document.getElementById('table-form').addEventListener('submit', function(event)
     loadFlashcards(selectedTables);
 });
 
+// Contenu de la carte de quiz, rétabli pour le défi Diamant après l'affichage des résultats
+const quizMarkup = document.getElementById('flashcard').innerHTML;
+
 // Fonction pour charger les flashcards en fonction des tables sélectionnées
 async function loadFlashcards(selectedTables) {
-    // Récupérer les erreurs de l'utilisateur et le meilleur score précédent
-    userErrors = await fetchUserErrors();
+    // Récupérer le meilleur score précédent
     userBestScore = await fetchUserBestScore();
 
-    // Générer toutes les flashcards possibles
-    let allFlashcards;
-    let maxOps;
-
-    if (exerciseMode === 'mega') {
-        allFlashcards = generateMegamixFlashcards();
-        maxOps = MAX_OPERATIONS_MEGA;
-    } else {
-        allFlashcards = generateFlashcards(selectedTables);
-        maxOps = MAX_OPERATIONS;
+    // Le serveur choisit les questions (les erreurs ont plus de chances d'apparaître)
+    let session;
+    try {
+        session = await createQuizSession(exerciseMode, selectedTables);
+    } catch (e) {
+        console.warn('Erreur lors du chargement des flashcards:', e);
+        document.getElementById('question').innerText = 'La partie n\'a pas pu démarrer. Veuillez réessayer.';
+        return;
     }
 
-    // Appliquer la sélection pondérée (erreurs ont plus de chances d'apparaître)
-    // et limiter au nombre d'opérations approprié
-    flashcards = selectWeightedFlashcards(allFlashcards, userErrors, maxOps);
-
-    // Mélanger les cartes sélectionnées
-    shuffleFlashcards();
-
+    quizSessionId = session.session_id;
+    flashcards = sessionCards(session);
     currentCardIndex = 0;
     score = 0;
     responseTimes = [];
-    resultSent = false; // Réinitialiser pour la nouvelle session
+    isDiamondChallenge = false;
+    quizExtendable = false;
+    quizResult = null;
 
     // Ajouter les écouteurs d'événements ici
     document.getElementById('submit').addEventListener('click', submitAnswer);
@@ -1325,6 +1041,8 @@ function disconnectUser() {
     currentCardIndex = 0;
     score = 0;
     responseTimes = [];
+    quizSessionId = null;
+    quizResult = null;
     currentGroupId = null;
     currentGroupSecretKey = null;
     currentGroupName = null;
@@ -1353,6 +1071,23 @@ function disconnectUser() {
     deleteCookie('groupName');
 }
 
+// Enregistre la partie en cours si l'élève quitte la page avant la fin
+(function setupBeforeUnload(){
+    function sendPartialResult() {
+        // Rien à enregistrer si la partie n'a pas commencé ou est déjà enregistrée
+        if (!quizSessionId || quizResult || currentCardIndex === 0) return;
+
+        const url = `/api/sessions/${encodeURIComponent(quizSessionId)}/finish`;
+        if (navigator.sendBeacon) {
+            navigator.sendBeacon(url);
+        } else {
+            // Fallback pour anciens navigateurs
+            fetch(url, { method: 'POST', keepalive: true }).catch(() => {});
+        }
+    }
+    window.addEventListener('beforeunload', sendPartialResult);
+})();
+
 // Enregistrer le service worker
 if ('serviceWorker' in navigator) {
     navigator.serviceWorker.register('/service-worker.js')
@@ -1364,60 +1099,3 @@ if ('serviceWorker' in navigator) {
         });
 }
 
-
-// Envoi des résultats lors de la fermeture/rafraîchissement de la page
-(function setupBeforeUnload(){
-    function computeMeanTime() {
-        if (Array.isArray(responseTimes) && responseTimes.length > 0) {
-            const total = responseTimes.reduce((a,b)=>a+b,0);
-            return total / responseTimes.length;
-        }
-        return 0;
-    }
-    function sendPartialResult() {
-        try {
-            // Ne rien envoyer si les résultats ont déjà été envoyés
-            if (resultSent) return;
-
-            // Ne rien envoyer si le quiz n'a pas commencé ou est terminé
-            if (!Array.isArray(flashcards) || flashcards.length === 0) return;
-            if (currentCardIndex <= 0) return;
-            if (currentCardIndex >= flashcards.length) return;
-
-            const name = getCookie('playerName') || '';
-            if (!name) return;
-
-            const meanTime = computeMeanTime();
-            const payload = {
-                name: name,
-                score: Number(score) || 0,
-                total: Number(currentCardIndex) || 0,
-                tables: Array.isArray(selectedTablesChosen) ? selectedTablesChosen : [],
-                exercise_type: exerciseMode || 'mul',
-                mean_time_seconds: Number.isFinite(meanTime) ? meanTime : 0
-            };
-            // Include group_id if set
-            if (currentGroupId) {
-                payload.group_id = currentGroupId;
-            }
-            const url = '/api/result';
-            const json = JSON.stringify(payload);
-
-            if (navigator.sendBeacon) {
-                const blob = new Blob([json], { type: 'application/json' });
-                navigator.sendBeacon(url, blob);
-            } else {
-                // Fallback pour anciens navigateurs
-                fetch(url, {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: json,
-                    keepalive: true
-                }).catch(() => {});
-            }
-        } catch (e) {
-            console.warn('beforeunload send error', e);
-        }
-    }
-    window.addEventListener('beforeunload', sendPartialResult);
-})();
@@ -0,0 +1,1079 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Store persists results, errors, badges and groups. The SQLite and PostgreSQL
+// stores share the queries of sqlStore, written in SQL both understand; they differ
+// by their connection and their schema migrations. The other tables (sessions,
+// answers, review schedule, users) are queried through the store's DB.
+type Store interface {
+	// Results
+	SaveResult(res resultRecord, writes resultWrites) (savedResult, error)
+	LeaderboardRuns(groupID *int64, exerciseType string, window timeWindow) ([]LeaderboardRun, error)
+	UserRuns(userID int64, exerciseType string, window timeWindow) ([]LeaderboardRun, error)
+	RecentAttempts(groupID *int64, limit int) ([]Attempt, error)
+	UserBestScore(userID int64, exerciseType string) (BestScore, error)
+	DeleteResult(groupID, resultID int64) (bool, error)
+
+	// Errors
+	RecordUserError(user *User, exerciseType, question string) error
+	UserErrors(userID int64, exerciseType string) ([]UserError, error)
+
+	// Badges
+	RecordBadges(userID int64, exerciseType string, resultID int64, score, total, tablesCount int, badges []BadgeRule, at time.Time) ([]string, error)
+	EarnedBadges(groupID *int64) ([]EarnedBadge, error)
+	WindowBadges(groupID *int64, window timeWindow) ([]EarnedBadge, error)
+	RebuildBadges(scope ledgerScope) (int, error)
+	BadgeRules(groupID *int64) ([]BadgeRule, error)
+	CreateBadgeRule(rule *BadgeRule) (bool, error)
+	DeleteBadgeRule(groupID int64, ruleID string) (bool, error)
+	SpecialistBadges(groupID *int64) ([]SpecialistBadge, error)
+	RecordSpecialistRun(user *User, exerciseType string, run specialistRun, rule SpecialistRule) (SpecialistProgress, error)
+
+	// Streaks
+	PracticeTimes(groupID, userID *int64) ([]PracticeTime, error)
+
+	// Groups
+	CreateGroup(name, secretKey string, adminPinHash *string, timezone string) (*Group, error)
+	GroupByID(id int64) (*Group, error)
+	GroupBySecretKey(secretKey string) (*Group, error)
+	RenameGroup(id int64, name string) error
+	SetGroupTimezone(id int64, timezone string) error
+	SetGroupLeaderboardStrategy(id int64, strategy string) error
+	GroupTerms(groupID int64) ([]GroupTerm, error)
+	CreateGroupTerm(term *GroupTerm) (bool, error)
+	DeleteGroupTerm(groupID, termID int64) (bool, error)
+	SetGroupSecretKey(id int64, secretKey string) error
+	GroupAdminPinHash(id int64) (string, error)
+	SetGroupAdminPinHash(id int64, hash string) error
+	DefaultGroupID() (int64, error)
+
+	// Webhook outbox
+	EnqueueWebhook(event, url, secret string, payload []byte, now time.Time) error
+	DueWebhooks(now time.Time, limit int) ([]WebhookDelivery, error)
+	ClaimWebhook(id int64, now, until time.Time) (bool, error)
+	WebhookDelivered(id int64, attempts int, at time.Time) error
+	WebhookFailed(id int64, attempts int, lastError string, next *time.Time) error
+	DeadWebhooks(limit int) ([]WebhookDelivery, error)
+	RetryWebhook(id int64, now time.Time) (bool, error)
+	PruneWebhooks(before time.Time) (int64, error)
+
+	// Webhook subscriptions
+	CreateWebhookSubscription(sub *WebhookSubscription) error
+	WebhookSubscriptions(groupID *int64) ([]WebhookSubscription, error)
+	DeleteWebhookSubscription(id int64, groupID *int64) (bool, error)
+
+	// DB returns the handle used for the other tables
+	DB() *DB
+	// Migrations returns the schema migrations of the backend, by increasing version
+	Migrations() []migration
+	Close() error
+}
+
+var store Store
+
+// openStore opens the store selected by [dbconfig]
+func openStore(cfg DBConfig) (Store, error) {
+	switch cfg.Driver {
+	case "", "sqlite":
+		return openSQLiteStore(cfg.DBPath)
+	case "postgres":
+		return openPostgresStore(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// sqlStore implements the queries shared by the SQL stores
+type sqlStore struct {
+	db *DB
+}
+
+func (s *sqlStore) DB() *DB {
+	return s.db
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// resultWrites are written with a result, in the transaction saving it
+type resultWrites struct {
+	// Webhook is the Sheets payload of the result, added to the outbox
+	Webhook *WebhookDelivery
+	// Badges are the badges the result earned, added to the ledger as earned at At
+	Badges []BadgeRule
+	At     time.Time
+	// Specialist is the run of the result toward its specialist badge, nil when the
+	// result is not tracked
+	Specialist *specialistWrite
+}
+
+// specialistWrite is a run toward the specialist badge of a rule
+type specialistWrite struct {
+	Run  specialistRun
+	Rule SpecialistRule
+}
+
+// savedResult is what SaveResult recorded
+type savedResult struct {
+	ID int64
+	// NewBadges are the ledger IDs of the badges the user had not earned before
+	NewBadges []string
+	// Specialist is the specialist progress after the run, nil when not tracked
+	Specialist *SpecialistProgress
+}
+
+// SaveResult stores a quiz result. Its webhook payload is added to the outbox, its
+// badges to the ledger and its run to the specialist progress in the same
+// transaction, so that none is lost on failure.
+func (s *sqlStore) SaveResult(res resultRecord, writes resultWrites) (savedResult, error) {
+	tablesJSON := ""
+	if len(res.Tables) > 0 {
+		if b, err := json.Marshal(res.Tables); err == nil {
+			tablesJSON = string(b)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return savedResult{}, err
+	}
+	defer tx.Rollback()
+
+	var saved savedResult
+	err = tx.QueryRow(`
+		INSERT INTO user_results (user_id, user_name, exercise_type, score, total, tables, mean_time_seconds, group_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, res.User.ID, res.User.Name, res.ExerciseType, res.Score, res.Total, tablesJSON, res.MeanTimeSeconds, res.User.GroupID).Scan(&saved.ID)
+	if err != nil {
+		return savedResult{}, err
+	}
+	if webhook := writes.Webhook; webhook != nil {
+		if err := enqueueWebhook(tx, webhook.Event, webhook.URL, webhook.secret, webhook.Payload, time.Now()); err != nil {
+			return savedResult{}, err
+		}
+	}
+	saved.NewBadges, err = recordBadges(tx, res.User.ID, res.ExerciseType, saved.ID, res.Score, res.Total, len(res.Tables), writes.Badges, writes.At)
+	if err != nil {
+		return savedResult{}, err
+	}
+	if sw := writes.Specialist; sw != nil {
+		progress, err := recordSpecialistRun(tx, res.User, res.ExerciseType, sw.Run, sw.Rule)
+		if err != nil {
+			return savedResult{}, err
+		}
+		saved.Specialist = &progress
+	}
+	return saved, tx.Commit()
+}
+
+// queryAttempts runs a user_results query returning attempt columns
+func (s *sqlStore) queryAttempts(query string, args ...any) ([]Attempt, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []Attempt
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.ID, &a.UserID, &a.UserName, &a.ExerciseType, &a.Score, &a.Total, &a.Tables, &a.MeanTimeSeconds, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// groupFilter returns the condition restricting a query to a group, or every group when nil
+func groupFilter(groupID *int64) (string, []any) {
+	if groupID == nil {
+		return "1 = 1", nil
+	}
+	return "group_id = ?", []any{*groupID}
+}
+
+// LeaderboardRuns returns the results of the users within a window, of an exercise
+// type or every type when empty, in chronological order per user and type
+func (s *sqlStore) LeaderboardRuns(groupID *int64, exerciseType string, window timeWindow) ([]LeaderboardRun, error) {
+	cond, args := groupFilter(groupID)
+	if exerciseType != "" {
+		cond += " AND exercise_type = ?"
+		args = append(args, exerciseType)
+	}
+	windowCond, windowArgs := window.conditions("created_at")
+	return s.queryRuns(`
+		SELECT id, user_id, user_name, exercise_type, score, total, COALESCE(tables, ''), mean_time_seconds, created_at
+		FROM user_results
+		WHERE user_id IS NOT NULL AND `+cond+` AND `+windowCond+`
+		ORDER BY user_id, exercise_type, created_at, id
+	`, append(args, windowArgs...)...)
+}
+
+// UserRuns returns the results of a user within a window, of an exercise type or every
+// type when empty, in chronological order
+func (s *sqlStore) UserRuns(userID int64, exerciseType string, window timeWindow) ([]LeaderboardRun, error) {
+	cond, args := "user_id = ?", []any{userID}
+	if exerciseType != "" {
+		cond += " AND exercise_type = ?"
+		args = append(args, exerciseType)
+	}
+	windowCond, windowArgs := window.conditions("created_at")
+	return s.queryRuns(`
+		SELECT id, user_id, user_name, exercise_type, score, total, COALESCE(tables, ''), mean_time_seconds, created_at
+		FROM user_results
+		WHERE `+cond+` AND `+windowCond+`
+		ORDER BY created_at, id
+	`, append(args, windowArgs...)...)
+}
+
+// queryRuns runs a query on user_results returning runs
+func (s *sqlStore) queryRuns(query string, args ...any) ([]LeaderboardRun, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []LeaderboardRun
+	for rows.Next() {
+		var run LeaderboardRun
+		var meanTime sql.NullFloat64
+		if err := rows.Scan(&run.ID, &run.UserID, &run.UserName, &run.ExerciseType, &run.Score, &run.Total, &run.Tables, &meanTime, &run.CreatedAt); err != nil {
+			return nil, err
+		}
+		if meanTime.Valid {
+			run.MeanTimeSeconds = &meanTime.Float64
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// RecentAttempts returns the latest attempts, newest first
+func (s *sqlStore) RecentAttempts(groupID *int64, limit int) ([]Attempt, error) {
+	cond, args := groupFilter(groupID)
+	return s.queryAttempts(`
+		SELECT id, user_id, user_name, exercise_type, score, total, COALESCE(tables, ''), COALESCE(mean_time_seconds, 0), created_at
+		FROM user_results
+		WHERE `+cond+`
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, append(args, limit)...)
+}
+
+// UserBestScore returns the best ratio score of a user, zero when none
+func (s *sqlStore) UserBestScore(userID int64, exerciseType string) (BestScore, error) {
+	var best BestScore
+	err := s.db.QueryRow(`
+		SELECT score, total
+		FROM user_results
+		WHERE user_id = ? AND exercise_type = ? AND total > 0
+		ORDER BY (CAST(score AS REAL) / total) DESC, score DESC
+		LIMIT 1
+	`, userID, exerciseType).Scan(&best.Score, &best.Total)
+	if err == sql.ErrNoRows {
+		return BestScore{}, nil
+	}
+	return best, err
+}
+
+// DeleteResult deletes a result of a group, reporting whether it existed.
+// The badge ledger of its user is rebuilt without it.
+func (s *sqlStore) DeleteResult(groupID, resultID int64) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var userID sql.NullInt64
+	err = tx.QueryRow(`
+		DELETE FROM user_results WHERE id = ? AND group_id = ?
+		RETURNING user_id
+	`, resultID, groupID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if userID.Valid {
+		rules, err := queryGroupBadgeRules(tx, &groupID)
+		if err != nil {
+			return false, err
+		}
+		if _, err := rebuildBadgeLedger(tx, ledgerScope{UserID: &userID.Int64}, rules); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// RecordUserError inserts an error for a question or increments its error_count.
+// group_id and user_name are copied from the user for reference.
+func (s *sqlStore) RecordUserError(user *User, exerciseType, question string) error {
+	return insertUserError(s.db, user, exerciseType, question)
+}
+
+// insertUserError records an error within a transaction or not
+func insertUserError(q dbtx, user *User, exerciseType, question string) error {
+	_, err := q.Exec(`
+		INSERT INTO user_errors (user_id, user_name, exercise_type, question, fact_key, error_count, last_error_date, group_id)
+		VALUES (?, ?, ?, ?, ?, 1, CURRENT_TIMESTAMP, ?)
+		ON CONFLICT(user_id, exercise_type, question)
+		DO UPDATE SET
+			error_count = user_errors.error_count + 1,
+			last_error_date = CURRENT_TIMESTAMP,
+			user_name = excluded.user_name,
+			group_id = excluded.group_id
+	`, user.ID, user.Name, exerciseType, question, nullableString(questionFactKey(question)), user.GroupID)
+	return err
+}
+
+// UserErrors returns the questions a user got wrong, most frequent first
+func (s *sqlStore) UserErrors(userID int64, exerciseType string) ([]UserError, error) {
+	rows, err := s.db.Query(`
+		SELECT question, COALESCE(fact_key, ''), error_count
+		FROM user_errors
+		WHERE user_id = ? AND exercise_type = ?
+		ORDER BY error_count DESC
+	`, userID, exerciseType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var errors []UserError
+	for rows.Next() {
+		var ue UserError
+		if err := rows.Scan(&ue.Question, &ue.FactKey, &ue.ErrorCount); err != nil {
+			return nil, err
+		}
+		errors = append(errors, ue)
+	}
+	return errors, rows.Err()
+}
+
+// RecordBadges adds the badges earned by a result to the ledger and returns
+// those the user had not earned before
+func (s *sqlStore) RecordBadges(userID int64, exerciseType string, resultID int64, score, total, tablesCount int, badges []BadgeRule, at time.Time) ([]string, error) {
+	return recordBadges(s.db, userID, exerciseType, resultID, score, total, tablesCount, badges, at)
+}
+
+// recordBadges adds badges to the ledger within a transaction or not
+func recordBadges(q dbtx, userID int64, exerciseType string, resultID int64, score, total, tablesCount int, badges []BadgeRule, at time.Time) ([]string, error) {
+	var newBadges []string
+	for _, badge := range badges {
+		var count int
+		err := q.QueryRow(`
+			INSERT INTO earned_badges (user_id, exercise_type, badge_type, category, table_number, earned_count,
+				best_score, best_total, tables_count, first_earned_at, first_result_id, last_earned_at)
+			VALUES (?, ?, ?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(user_id, exercise_type, badge_type)
+			DO UPDATE SET
+				earned_count = earned_badges.earned_count + 1,
+				best_total = CASE WHEN excluded.best_score > earned_badges.best_score THEN excluded.best_total ELSE earned_badges.best_total END,
+				tables_count = CASE WHEN excluded.best_score > earned_badges.best_score THEN excluded.tables_count ELSE earned_badges.tables_count END,
+				best_score = CASE WHEN excluded.best_score > earned_badges.best_score THEN excluded.best_score ELSE earned_badges.best_score END,
+				last_earned_at = excluded.last_earned_at
+			RETURNING earned_count
+		`, userID, exerciseType, badge.ledgerID(), badge.Category, nullableTable(badge.table), score, total, tablesCount, formatDBTime(at), resultID, formatDBTime(at)).Scan(&count)
+		if err != nil {
+			return newBadges, err
+		}
+		if count == 1 {
+			newBadges = append(newBadges, badge.ledgerID())
+		}
+	}
+	return newBadges, nil
+}
+
+// EarnedBadges returns the badge ledger of the users of a group, or of every group
+// when nil, ordered by user and exercise type
+func (s *sqlStore) EarnedBadges(groupID *int64) ([]EarnedBadge, error) {
+	cond, args := "1 = 1", []any(nil)
+	if groupID != nil {
+		cond, args = "u.group_id = ?", []any{*groupID}
+	}
+	rows, err := s.db.Query(`
+		SELECT b.user_id, u.name, u.group_id, b.exercise_type, b.badge_type, b.category, b.earned_count,
+			b.best_score, b.best_total, b.tables_count, COALESCE(b.table_number, 0), b.first_earned_at, COALESCE(b.first_result_id, 0), b.last_earned_at
+		FROM earned_badges b
+		JOIN users u ON u.id = b.user_id
+		WHERE `+cond+`
+		ORDER BY u.name, b.user_id, b.exercise_type, b.badge_type
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var badges []EarnedBadge
+	for rows.Next() {
+		var b EarnedBadge
+		if err := rows.Scan(&b.UserID, &b.UserName, &b.GroupID, &b.ExerciseType, &b.BadgeType, &b.Category, &b.Count,
+			&b.BestScore, &b.BestTotal, &b.TablesCount, &b.TableNumber, &b.FirstEarnedAt, &b.FirstResultID, &b.LastEarnedAt); err != nil {
+			return nil, err
+		}
+		badges = append(badges, b)
+	}
+	return badges, rows.Err()
+}
+
+// WindowBadges computes, in the form of ledger rows, the badges earned by the results
+// of a window, for the users of a group or of every group when nil
+func (s *sqlStore) WindowBadges(groupID *int64, window timeWindow) ([]EarnedBadge, error) {
+	results, err := readLedgerResults(s.db, ledgerScope{GroupID: groupID})
+	if err != nil {
+		return nil, err
+	}
+	rules, err := queryGroupBadgeRules(s.db, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	var badges []EarnedBadge
+	for _, b := range evaluateLedger(results, rules, window) {
+		// Dates as read from earned_badges
+		for _, at := range []*string{&b.FirstEarnedAt, &b.LastEarnedAt} {
+			if t, err := time.Parse(time.DateTime, *at); err == nil {
+				*at = t.Format(time.RFC3339)
+			}
+		}
+		badges = append(badges, *b)
+	}
+	return badges, nil
+}
+
+// RebuildBadges recomputes the badge ledger of the users of a scope from the
+// results, and returns the number of ledger rows
+func (s *sqlStore) RebuildBadges(scope ledgerScope) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := rebuildGroupBadges(tx, scope)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// rebuildGroupBadges rebuilds the ledger of a scope with the rules of its groups
+func rebuildGroupBadges(tx *Tx, scope ledgerScope) (int, error) {
+	rules, err := queryGroupBadgeRules(tx, scope.GroupID)
+	if err != nil {
+		return 0, err
+	}
+	return rebuildBadgeLedger(tx, scope, rules)
+}
+
+// BadgeRules returns the badge rules of a group, or of every group when nil
+func (s *sqlStore) BadgeRules(groupID *int64) ([]BadgeRule, error) {
+	return queryGroupBadgeRules(s.db, groupID)
+}
+
+// CreateBadgeRule adds a rule to its group and recomputes the ledger of the group.
+// It reports false when the group already has a rule with this ID.
+func (s *sqlStore) CreateBadgeRule(rule *BadgeRule) (bool, error) {
+	stored := *rule
+	stored.GroupID, stored.CreatedAt = nil, ""
+	definition, err := json.Marshal(stored)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO badge_rules (group_id, rule_id, definition)
+		VALUES (?, ?, ?)
+		ON CONFLICT(group_id, rule_id) DO NOTHING
+		RETURNING created_at
+	`, *rule.GroupID, rule.ID, string(definition)).Scan(&rule.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := rebuildGroupBadges(tx, ledgerScope{GroupID: rule.GroupID}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// DeleteBadgeRule removes a rule of a group and recomputes the ledger of the group,
+// reporting whether the rule existed
+func (s *sqlStore) DeleteBadgeRule(groupID int64, ruleID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM badge_rules WHERE group_id = ? AND rule_id = ?`, groupID, ruleID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := rebuildGroupBadges(tx, ledgerScope{GroupID: &groupID}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// PracticeTimes returns the result times of the users of a group, or of a user, or
+// of every user when both are nil, by user then time. Users without results have a
+// single row with a nil time.
+func (s *sqlStore) PracticeTimes(groupID, userID *int64) ([]PracticeTime, error) {
+	cond := "1 = 1"
+	var args []any
+	if groupID != nil {
+		cond += " AND u.group_id = ?"
+		args = append(args, *groupID)
+	}
+	if userID != nil {
+		cond += " AND u.id = ?"
+		args = append(args, *userID)
+	}
+	rows, err := s.db.Query(`
+		SELECT u.id, u.name, u.group_id, COALESCE(g.timezone, ''), r.created_at
+		FROM users u
+		LEFT JOIN groups g ON g.id = u.group_id
+		LEFT JOIN user_results r ON r.user_id = u.id
+		WHERE `+cond+`
+		ORDER BY u.id, r.created_at, r.id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []PracticeTime
+	for rows.Next() {
+		var pt PracticeTime
+		var at sql.NullTime
+		if err := rows.Scan(&pt.UserID, &pt.UserName, &pt.GroupID, &pt.Timezone, &at); err != nil {
+			return nil, err
+		}
+		if at.Valid {
+			pt.At = &at.Time
+		}
+		times = append(times, pt)
+	}
+	return times, rows.Err()
+}
+
+// SpecialistBadges returns the specialist badge progress of every user
+func (s *sqlStore) SpecialistBadges(groupID *int64) ([]SpecialistBadge, error) {
+	cond, args := groupFilter(groupID)
+	rows, err := s.db.Query(`
+		SELECT user_id, user_name, exercise_type, table_number, consecutive_perfect, badge_earned, earned_at, dimmed_at
+		FROM specialist_badges
+		WHERE `+cond+`
+		ORDER BY user_name, exercise_type, table_number
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var badges []SpecialistBadge
+	for rows.Next() {
+		var b SpecialistBadge
+		var earnedAt, dimmedAt sql.NullString
+		var badgeEarnedInt int
+		if err := rows.Scan(&b.UserID, &b.UserName, &b.ExerciseType, &b.TableNumber, &b.ConsecutivePerfect, &badgeEarnedInt, &earnedAt, &dimmedAt); err != nil {
+			return nil, err
+		}
+		b.BadgeEarned = badgeEarnedInt == 1
+		b.EarnedAt = earnedAt.String
+		b.Dimmed = dimmedAt.Valid
+		b.DimmedAt = dimmedAt.String
+		if rule, ok := findSpecialistRule(b.ExerciseType); ok {
+			b.Unit, b.Required = rule.Unit, rule.Runs
+		}
+		badges = append(badges, b)
+	}
+	return badges, rows.Err()
+}
+
+// RecordSpecialistRun records a run toward the specialist badge of its unit: a
+// successful run extends the streak and restores a dimmed badge, another run resets
+// the streak, or counts toward the decay of an earned badge. It returns the progress
+// after the run, Awarded when the run earned the badge (rule.Runs successful runs in
+// a row), Decayed when it dimmed or revoked it (rule.DecayFailures failed runs).
+func (s *sqlStore) RecordSpecialistRun(user *User, exerciseType string, run specialistRun, rule SpecialistRule) (SpecialistProgress, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return SpecialistProgress{}, err
+	}
+	defer tx.Rollback()
+
+	progress, err := recordSpecialistRun(tx, user, exerciseType, run, rule)
+	if err != nil {
+		return progress, err
+	}
+	return progress, tx.Commit()
+}
+
+// recordSpecialistRun records a specialist run within a transaction
+func recordSpecialistRun(tx *Tx, user *User, exerciseType string, run specialistRun, rule SpecialistRule) (SpecialistProgress, error) {
+	progress := SpecialistProgress{ExerciseType: exerciseType, TableNumber: run.Table, Unit: rule.Unit, Required: rule.Runs}
+	if !run.Success {
+		_, err := tx.Exec(`
+			UPDATE specialist_badges
+			SET consecutive_perfect = CASE WHEN badge_earned = 1 THEN consecutive_perfect ELSE 0 END,
+				consecutive_failures = consecutive_failures + 1
+			WHERE user_id = ? AND exercise_type = ? AND table_number = ?
+		`, user.ID, exerciseType, run.Table)
+		if err != nil {
+			return progress, err
+		}
+		if rule.DecayFailures > 0 {
+			decay := `dimmed_at = ?`
+			args := []any{formatDBTime(time.Now())}
+			cond := ` AND dimmed_at IS NULL`
+			if rule.Decay == specialistDecayRevoke {
+				decay = `badge_earned = 0, consecutive_perfect = 0, consecutive_failures = 0, earned_at = NULL, dimmed_at = NULL`
+				args, cond = nil, ""
+			}
+			args = append(args, user.ID, exerciseType, run.Table, rule.DecayFailures)
+			result, err := tx.Exec(`
+				UPDATE specialist_badges
+				SET `+decay+`
+				WHERE user_id = ? AND exercise_type = ? AND table_number = ?
+				  AND badge_earned = 1 AND consecutive_failures >= ?`+cond, args...)
+			if err != nil {
+				return progress, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return progress, err
+			}
+			progress.Decayed = n > 0
+		}
+		return specialistProgress(tx, user.ID, progress)
+	}
+
+	// Increment consecutive count or insert new record
+	_, err := tx.Exec(`
+		INSERT INTO specialist_badges (user_id, user_name, exercise_type, table_number, consecutive_perfect, badge_earned, group_id)
+		VALUES (?, ?, ?, ?, 1, 0, ?)
+		ON CONFLICT(user_id, exercise_type, table_number)
+		DO UPDATE SET consecutive_perfect =
+			CASE
+				WHEN specialist_badges.badge_earned = 1 THEN specialist_badges.consecutive_perfect
+				ELSE specialist_badges.consecutive_perfect + 1
+			END,
+			consecutive_failures = 0,
+			dimmed_at = NULL,
+			user_name = excluded.user_name,
+			group_id = excluded.group_id
+	`, user.ID, user.Name, exerciseType, run.Table, user.GroupID)
+	if err != nil {
+		return progress, err
+	}
+
+	// Award badge if enough consecutive perfects and not already earned
+	result, err := tx.Exec(`
+		UPDATE specialist_badges
+		SET badge_earned = 1, earned_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND exercise_type = ? AND table_number = ?
+		  AND consecutive_perfect >= ? AND badge_earned = 0
+	`, user.ID, exerciseType, run.Table, rule.Runs)
+	if err != nil {
+		return progress, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return progress, err
+	}
+	progress.Awarded = n > 0
+	return specialistProgress(tx, user.ID, progress)
+}
+
+// specialistProgress completes a progress with the streak of its table, zero when
+// the user has no perfect run on it
+func specialistProgress(q dbtx, userID int64, progress SpecialistProgress) (SpecialistProgress, error) {
+	var badgeEarned int
+	err := q.QueryRow(`
+		SELECT consecutive_perfect, consecutive_failures, badge_earned, dimmed_at IS NOT NULL
+		FROM specialist_badges
+		WHERE user_id = ? AND exercise_type = ? AND table_number = ?
+	`, userID, progress.ExerciseType, progress.TableNumber).Scan(&progress.ConsecutivePerfect, &progress.ConsecutiveFailures, &badgeEarned, &progress.Dimmed)
+	if err != nil && err != sql.ErrNoRows {
+		return progress, err
+	}
+	progress.BadgeEarned = badgeEarned == 1
+	return progress, nil
+}
+
+// CreateGroup adds a group
+func (s *sqlStore) CreateGroup(name, secretKey string, adminPinHash *string, timezone string) (*Group, error) {
+	var id int64
+	err := s.db.QueryRow(`
+		INSERT INTO groups (name, secret_key, admin_pin_hash, timezone) VALUES (?, ?, ?, ?)
+		RETURNING id
+	`, name, secretKey, adminPinHash, nullableString(timezone)).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.GroupByID(id)
+}
+
+// queryGroup returns the group matching a condition on the groups table
+func (s *sqlStore) queryGroup(cond string, arg any) (*Group, error) {
+	var group Group
+	err := s.db.QueryRow(`
+		SELECT id, name, secret_key, created_at, admin_pin_hash IS NOT NULL, COALESCE(timezone, ''), COALESCE(leaderboard_strategy, '')
+		FROM groups
+		WHERE `+cond, arg).Scan(&group.ID, &group.Name, &group.SecretKey, &group.CreatedAt, &group.HasAdminPin, &group.Timezone,
+		&group.LeaderboardStrategy)
+	if err == sql.ErrNoRows {
+		return nil, errGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GroupByID returns a group by ID
+func (s *sqlStore) GroupByID(id int64) (*Group, error) {
+	return s.queryGroup("id = ?", id)
+}
+
+// GroupBySecretKey returns the group of a secret key
+func (s *sqlStore) GroupBySecretKey(secretKey string) (*Group, error) {
+	return s.queryGroup("secret_key = ?", secretKey)
+}
+
+// RenameGroup changes the name of a group
+func (s *sqlStore) RenameGroup(id int64, name string) error {
+	_, err := s.db.Exec(`UPDATE groups SET name = ? WHERE id = ?`, name, id)
+	return err
+}
+
+// SetGroupTimezone changes the timezone of a group, back to the server default when
+// empty, and rebuilds the ledger of the group whose streaks now end on other days
+func (s *sqlStore) SetGroupTimezone(id int64, timezone string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE groups SET timezone = ? WHERE id = ?`, nullableString(timezone), id); err != nil {
+		return err
+	}
+	if _, err := rebuildGroupBadges(tx, ledgerScope{GroupID: &id}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetGroupLeaderboardStrategy changes the leaderboard strategy of a group, back to the
+// server default when empty
+func (s *sqlStore) SetGroupLeaderboardStrategy(id int64, strategy string) error {
+	_, err := s.db.Exec(`UPDATE groups SET leaderboard_strategy = ? WHERE id = ?`, nullableString(strategy), id)
+	return err
+}
+
+// GroupTerms returns the terms of a group, in chronological order
+func (s *sqlStore) GroupTerms(groupID int64) ([]GroupTerm, error) {
+	rows, err := s.db.Query(`
+		SELECT id, group_id, name, start_date, end_date
+		FROM group_terms
+		WHERE group_id = ?
+		ORDER BY start_date, id
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []GroupTerm
+	for rows.Next() {
+		var term GroupTerm
+		if err := rows.Scan(&term.ID, &term.GroupID, &term.Name, &term.StartDate, &term.EndDate); err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	return terms, rows.Err()
+}
+
+// CreateGroupTerm adds a term to its group. It reports false when the group already
+// has a term with this name.
+func (s *sqlStore) CreateGroupTerm(term *GroupTerm) (bool, error) {
+	err := s.db.QueryRow(`
+		INSERT INTO group_terms (group_id, name, start_date, end_date)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(group_id, name) DO NOTHING
+		RETURNING id
+	`, term.GroupID, term.Name, term.StartDate, term.EndDate).Scan(&term.ID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteGroupTerm removes a term of a group, reporting false when there is none
+func (s *sqlStore) DeleteGroupTerm(groupID, termID int64) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM group_terms WHERE group_id = ? AND id = ?`, groupID, termID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// nullableString stores an empty string as NULL
+func nullableString(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// SetGroupSecretKey replaces the secret key of a group
+func (s *sqlStore) SetGroupSecretKey(id int64, secretKey string) error {
+	_, err := s.db.Exec(`UPDATE groups SET secret_key = ? WHERE id = ?`, secretKey, id)
+	return err
+}
+
+// GroupAdminPinHash returns the PIN hash of a group, empty when no PIN is set
+func (s *sqlStore) GroupAdminPinHash(id int64) (string, error) {
+	var hash sql.NullString
+	err := s.db.QueryRow(`SELECT admin_pin_hash FROM groups WHERE id = ?`, id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", errGroupNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return hash.String, nil
+}
+
+// SetGroupAdminPinHash stores the PIN hash of a group
+func (s *sqlStore) SetGroupAdminPinHash(id int64, hash string) error {
+	_, err := s.db.Exec(`UPDATE groups SET admin_pin_hash = ? WHERE id = ?`, hash, id)
+	return err
+}
+
+// DefaultGroupID returns the ID of the group holding records without a group, creating it if needed
+func (s *sqlStore) DefaultGroupID() (int64, error) {
+	return defaultGroupID(s.db)
+}
+
+// EnqueueWebhook adds a payload to the outbox, due immediately. Payloads with a
+// secret are signed when delivered.
+func (s *sqlStore) EnqueueWebhook(event, url, secret string, payload []byte, now time.Time) error {
+	return enqueueWebhook(s.db, event, url, secret, payload, now)
+}
+
+// enqueueWebhook adds a payload to the outbox within a transaction or not
+func enqueueWebhook(q dbtx, event, url, secret string, payload []byte, now time.Time) error {
+	_, err := q.Exec(`
+		INSERT INTO webhook_outbox (event, url, secret, payload, status, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, event, url, secret, string(payload), webhookStatusPending, formatDBTime(now))
+	return err
+}
+
+// queryWebhooks returns the outbox rows of a query selecting webhookColumns
+func (s *sqlStore) queryWebhooks(query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+		var secret, lastError sql.NullString
+		if err := rows.Scan(&d.ID, &d.Event, &d.URL, &secret, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &lastError, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		d.secret = secret.String
+		d.LastError = lastError.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+const webhookColumns = `id, event, url, secret, payload, status, attempts, next_attempt_at, last_error, created_at`
+
+// DueWebhooks returns the pending deliveries due at now, oldest first
+func (s *sqlStore) DueWebhooks(now time.Time, limit int) ([]WebhookDelivery, error) {
+	return s.queryWebhooks(`
+		SELECT `+webhookColumns+`
+		FROM webhook_outbox
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id
+		LIMIT ?
+	`, webhookStatusPending, formatDBTime(now), limit)
+}
+
+// ClaimWebhook postpones a due delivery to until, and reports whether this call
+// claimed it: false when another worker did first
+func (s *sqlStore) ClaimWebhook(id int64, now, until time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE webhook_outbox SET next_attempt_at = ?
+		WHERE id = ? AND status = ? AND next_attempt_at <= ?
+	`, formatDBTime(until), id, webhookStatusPending, formatDBTime(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// WebhookDelivered records a successful delivery
+func (s *sqlStore) WebhookDelivered(id int64, attempts int, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE webhook_outbox SET status = ?, attempts = ?, delivered_at = ?, last_error = NULL
+		WHERE id = ?
+	`, webhookStatusDelivered, attempts, formatDBTime(at), id)
+	return err
+}
+
+// WebhookFailed records a failed attempt: the delivery is retried at next,
+// or becomes a dead letter when next is nil
+func (s *sqlStore) WebhookFailed(id int64, attempts int, lastError string, next *time.Time) error {
+	if next == nil {
+		_, err := s.db.Exec(`
+			UPDATE webhook_outbox SET status = ?, attempts = ?, last_error = ?
+			WHERE id = ?
+		`, webhookStatusDead, attempts, lastError, id)
+		return err
+	}
+	_, err := s.db.Exec(`
+		UPDATE webhook_outbox SET attempts = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?
+	`, attempts, lastError, formatDBTime(*next), id)
+	return err
+}
+
+// DeadWebhooks returns the deliveries that exhausted their attempts, newest first
+func (s *sqlStore) DeadWebhooks(limit int) ([]WebhookDelivery, error) {
+	return s.queryWebhooks(`
+		SELECT `+webhookColumns+`
+		FROM webhook_outbox
+		WHERE status = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, webhookStatusDead, limit)
+}
+
+// RetryWebhook queues a dead letter again with a fresh attempt count
+func (s *sqlStore) RetryWebhook(id int64, now time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE webhook_outbox SET status = ?, attempts = 0, next_attempt_at = ?
+		WHERE id = ? AND status = ?
+	`, webhookStatusPending, formatDBTime(now), id, webhookStatusDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// PruneWebhooks deletes the deliveries made before a date
+func (s *sqlStore) PruneWebhooks(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM webhook_outbox WHERE status = ? AND delivered_at < ?
+	`, webhookStatusDelivered, formatDBTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CreateWebhookSubscription stores a subscription and sets its ID and creation date
+func (s *sqlStore) CreateWebhookSubscription(sub *WebhookSubscription) error {
+	err := s.db.QueryRow(`
+		INSERT INTO webhook_subscriptions (group_id, url, secret, events)
+		VALUES (?, ?, ?, ?)
+		RETURNING id, created_at
+	`, sub.GroupID, sub.URL, sub.Secret, strings.Join(sub.Events, ",")).Scan(&sub.ID, &sub.CreatedAt)
+	return err
+}
+
+// WebhookSubscriptions returns the subscriptions of a group, or the global ones when groupID is nil
+func (s *sqlStore) WebhookSubscriptions(groupID *int64) ([]WebhookSubscription, error) {
+	cond := "group_id IS NULL"
+	var args []any
+	if groupID != nil {
+		cond = "group_id = ?"
+		args = append(args, *groupID)
+	}
+	rows, err := s.db.Query(`
+		SELECT id, group_id, url, secret, events, created_at
+		FROM webhook_subscriptions
+		WHERE `+cond+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []WebhookSubscription
+	for rows.Next() {
+		var sub WebhookSubscription
+		var subGroupID sql.NullInt64
+		var events string
+		if err := rows.Scan(&sub.ID, &subGroupID, &sub.URL, &sub.Secret, &events, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+		if subGroupID.Valid {
+			sub.GroupID = &subGroupID.Int64
+		}
+		sub.Events = []string{}
+		if events != "" {
+			sub.Events = strings.Split(events, ",")
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	return subscriptions, rows.Err()
+}
+
+// DeleteWebhookSubscription removes a subscription, only from groupID when not nil
+func (s *sqlStore) DeleteWebhookSubscription(id int64, groupID *int64) (bool, error) {
+	query := `DELETE FROM webhook_subscriptions WHERE id = ?`
+	args := []any{id}
+	if groupID != nil {
+		query += ` AND group_id = ?`
+		args = append(args, *groupID)
+	}
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
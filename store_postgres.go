@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresStore keeps the data in a PostgreSQL database, for deployments sharing
+// a Postgres instance. Timestamps are stored without time zone, in UTC, like SQLite.
+type postgresStore struct {
+	sqlStore
+}
+
+// openPostgresStore connects to the PostgreSQL database of a connection string
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("dsn required for the postgres driver")
+	}
+	sqlDB, err := sql.Open("postgres", postgresUTC(dsn))
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	slog.Info("Database opened", "driver", "postgres")
+	return &postgresStore{sqlStore{db: &DB{DB: sqlDB, dialect: dialectPostgres}}}, nil
+}
+
+// postgresUTC sets the session time zone to UTC unless the connection string sets one,
+// so that CURRENT_TIMESTAMP defaults are stored in UTC
+func postgresUTC(dsn string) string {
+	if strings.Contains(strings.ToLower(dsn), "timezone") {
+		return dsn
+	}
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("timezone", "UTC")
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " timezone=UTC"
+}
+
+func (s *postgresStore) Migrations() []migration {
+	return postgresMigrations
+}
+
+// postgresMigrations lists every schema change of the PostgreSQL store. Postgres
+// support starts at version 8 of the SQLite schema, created in a single step;
+// later schema changes get the same version in both lists.
+var postgresMigrations = []migration{
+	{8, "create schema", initPostgresSchema},
+	{9, "create webhook_outbox", initWebhookTables},
+	{10, "create webhook_subscriptions", initWebhookSubscriptionTables},
+	{11, "create earned_badges", initBadgeTables},
+	{12, "create badge_rules", initBadgeRuleTables},
+	{13, "add table_number to earned_badges", addBadgeTableNumber},
+	{14, "add timezone to groups", addGroupTimezone},
+	{15, "add specialist badge decay", addSpecialistDecay},
+	{16, "add fact keys to user_errors and answer_events", addFactKeys},
+	{17, "add group leaderboard strategy", addGroupLeaderboardStrategy},
+	{18, "create group_terms", initGroupTerms},
+	{19, "key review_schedule by fact", keyReviewScheduleByFact},
+	{20, "backfill speed and lightning badges", backfillSpeedBadges},
+}
+
+// initPostgresSchema creates the tables of schema version 8
+func initPostgresSchema(tx *Tx) error {
+	statements := []string{
+		`CREATE TABLE groups (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			name TEXT NOT NULL,
+			secret_key TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			admin_pin_hash TEXT
+		)`,
+		`CREATE TABLE users (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			group_id BIGINT NOT NULL REFERENCES groups(id),
+			name TEXT NOT NULL,
+			name_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(group_id, name_key)
+		)`,
+		`CREATE TABLE user_results (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			user_id BIGINT REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			score INTEGER NOT NULL,
+			total INTEGER NOT NULL,
+			tables TEXT,
+			mean_time_seconds DOUBLE PRECISION,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			group_id BIGINT REFERENCES groups(id)
+		)`,
+		`CREATE INDEX idx_user_results_user ON user_results(user_id, exercise_type)`,
+		`CREATE INDEX idx_user_results_group ON user_results(group_id, created_at)`,
+		`CREATE TABLE user_errors (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			error_count INTEGER DEFAULT 1,
+			last_error_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			group_id BIGINT REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, question)
+		)`,
+		`CREATE TABLE specialist_badges (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			table_number INTEGER NOT NULL,
+			consecutive_perfect INTEGER DEFAULT 0,
+			badge_earned INTEGER DEFAULT 0,
+			earned_at TIMESTAMP,
+			group_id BIGINT REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, table_number)
+		)`,
+		`CREATE INDEX idx_specialist_badges_group ON specialist_badges(group_id)`,
+		`CREATE TABLE quiz_sessions (
+			id TEXT PRIMARY KEY,
+			user_id BIGINT REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			tables TEXT,
+			question_count INTEGER NOT NULL,
+			group_id BIGINT REFERENCES groups(id),
+			created_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP
+		)`,
+		`CREATE INDEX idx_quiz_sessions_user ON quiz_sessions(user_id)`,
+		`CREATE TABLE session_questions (
+			session_id TEXT NOT NULL REFERENCES quiz_sessions(id),
+			position INTEGER NOT NULL,
+			question TEXT NOT NULL,
+			card TEXT NOT NULL,
+			asked_at TIMESTAMP,
+			answered_at TIMESTAMP,
+			given_answer TEXT,
+			correct INTEGER,
+			response_ms BIGINT,
+			PRIMARY KEY (session_id, position)
+		)`,
+		`CREATE TABLE answer_events (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			session_id TEXT,
+			position INTEGER,
+			user_id BIGINT REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			group_id BIGINT REFERENCES groups(id),
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			question_type TEXT NOT NULL,
+			given_answer TEXT,
+			correct INTEGER NOT NULL,
+			response_ms BIGINT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE UNIQUE INDEX idx_answer_events_session ON answer_events(session_id, position)`,
+		`CREATE INDEX idx_answer_events_user ON answer_events(user_id, exercise_type, created_at)`,
+		`CREATE INDEX idx_answer_events_group ON answer_events(group_id, created_at)`,
+		`CREATE TABLE review_schedule (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			user_id BIGINT NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			ease DOUBLE PRECISION NOT NULL DEFAULT 2.5,
+			interval_days DOUBLE PRECISION NOT NULL DEFAULT 0,
+			repetitions INTEGER NOT NULL DEFAULT 0,
+			lapses INTEGER NOT NULL DEFAULT 0,
+			due_at TIMESTAMP NOT NULL,
+			last_reviewed_at TIMESTAMP,
+			group_id BIGINT REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, question)
+		)`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore keeps the data in a SQLite file, the default backend
+type sqliteStore struct {
+	sqlStore
+}
+
+// openSQLiteStore opens or creates the SQLite database at path
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	// The webhook worker writes while requests are served: wait for the lock
+	// instead of failing with SQLITE_BUSY, and let readers run during writes
+	sqlDB, err := sql.Open("sqlite", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Database opened", "driver", "sqlite", "path", path)
+	return &sqliteStore{sqlStore{db: &DB{DB: sqlDB, dialect: dialectSQLite}}}, nil
+}
+
+func (s *sqliteStore) Migrations() []migration {
+	return sqliteMigrations
+}
+
+// sqliteDSN adds the connection pragmas to a database path
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
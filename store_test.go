@@ -0,0 +1,551 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The store tests run on SQLite, and on PostgreSQL when a server is available: the
+// one of the FLASHCARDS_TEST_POSTGRES connection string (postgres://...), or a
+// temporary cluster started with the initdb and pg_ctl found in PATH. Each test gets
+// a new database. The CI workflow (.github/workflows/test.yml) sets
+// FLASHCARDS_TEST_POSTGRES, so that a PostgreSQL failure fails the build there
+// instead of skipping.
+
+var testPostgres struct {
+	once sync.Once
+	// dsn connects to a database of the server to create the test databases
+	dsn string
+	// dir holds the temporary cluster, empty for an external server
+	dir string
+	err error
+	n   atomic.Int64
+}
+
+// startTestPostgres finds or starts the PostgreSQL server of the tests
+func startTestPostgres() {
+	if dsn := os.Getenv("FLASHCARDS_TEST_POSTGRES"); dsn != "" {
+		testPostgres.dsn = dsn
+		return
+	}
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		testPostgres.err = errors.New("set FLASHCARDS_TEST_POSTGRES or put initdb and pg_ctl in PATH")
+		return
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		testPostgres.err = err
+		return
+	}
+	dir, err := os.MkdirTemp("", "flashcards-postgres")
+	if err != nil {
+		testPostgres.err = err
+		return
+	}
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		testPostgres.err = fmt.Errorf("initdb: %v: %s", err, out)
+		return
+	}
+	// Listen on a socket of the temporary directory only
+	start := exec.Command(pgCtl, "-D", data, "-l", filepath.Join(dir, "server.log"), "-w",
+		"-o", "-k "+dir+" -c listen_addresses=''", "start")
+	if out, err := start.CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		testPostgres.err = fmt.Errorf("pg_ctl start: %v: %s", err, out)
+		return
+	}
+	testPostgres.dir = dir
+	testPostgres.dsn = "postgres://postgres@/postgres?sslmode=disable&host=" + url.QueryEscape(dir)
+}
+
+// stopTestPostgres stops the temporary cluster, if one was started
+func stopTestPostgres() {
+	if testPostgres.dir == "" {
+		return
+	}
+	exec.Command("pg_ctl", "-D", filepath.Join(testPostgres.dir, "data"), "-m", "immediate", "stop").Run()
+	os.RemoveAll(testPostgres.dir)
+}
+
+// postgresTestDSN creates an empty database and returns its connection string. It
+// skips the test when no PostgreSQL server is available.
+func postgresTestDSN(t *testing.T) string {
+	t.Helper()
+	testPostgres.once.Do(startTestPostgres)
+	if testPostgres.err != nil {
+		t.Skipf("no PostgreSQL server: %v", testPostgres.err)
+	}
+	u, err := url.Parse(testPostgres.dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		t.Fatalf("FLASHCARDS_TEST_POSTGRES must be a postgres:// URL")
+	}
+
+	admin, err := sql.Open("postgres", testPostgres.dsn)
+	if err != nil {
+		t.Fatalf("connecting to postgres: %v", err)
+	}
+	name := fmt.Sprintf("flashcards_test_%d_%d", os.Getpid(), testPostgres.n.Add(1))
+	if _, err := admin.Exec(`CREATE DATABASE ` + name); err != nil {
+		admin.Close()
+		t.Fatalf("creating database: %v", err)
+	}
+	// Registered first, so that it runs after the store is closed
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP DATABASE IF EXISTS ` + name); err != nil {
+			t.Logf("dropping database %s: %v", name, err)
+		}
+		admin.Close()
+	})
+	u.Path = "/" + name
+	return u.String()
+}
+
+// forEachStore runs a test on a new store of each backend
+func forEachStore(t *testing.T, test func(t *testing.T)) {
+	t.Run("sqlite", func(t *testing.T) {
+		useTestStore(t)
+		test(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		useStore(t, DBConfig{Driver: "postgres", DSN: postgresTestDSN(t)})
+		test(t)
+	})
+}
+
+// testUser adds a group and a user of it
+func testUser(t *testing.T, groupName, userName string) (*Group, *User) {
+	t.Helper()
+	group, err := store.CreateGroup(groupName, groupName+"-key", nil, "")
+	if err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	user, err := createUser(group.ID, userName)
+	if err != nil {
+		t.Fatalf("createUser: %v", err)
+	}
+	return group, user
+}
+
+func TestMigrationLists(t *testing.T) {
+	// Postgres starts at version 8, then has every later migration of SQLite
+	sqliteVersions := make(map[int]string)
+	for i, m := range sqliteMigrations {
+		if i > 0 && m.Version <= sqliteMigrations[i-1].Version {
+			t.Errorf("sqlite migration %d is not after %d", m.Version, sqliteMigrations[i-1].Version)
+		}
+		sqliteVersions[m.Version] = m.Name
+	}
+	if postgresMigrations[0].Version != 8 {
+		t.Errorf("postgres migrations start at %d, want 8", postgresMigrations[0].Version)
+	}
+	for _, m := range postgresMigrations[1:] {
+		if sqliteVersions[m.Version] != m.Name {
+			t.Errorf("postgres migration %d %q is %q on sqlite", m.Version, m.Name, sqliteVersions[m.Version])
+		}
+	}
+	if len(postgresMigrations) != len(sqliteMigrations)-7 {
+		t.Errorf("%d postgres migrations after version 8, want %d", len(postgresMigrations)-1, len(sqliteMigrations)-8)
+	}
+}
+
+func TestPostgresUTC(t *testing.T) {
+	tests := []struct{ dsn, want string }{
+		{"postgres://u:p@db/flash?sslmode=disable", "postgres://u:p@db/flash?sslmode=disable&timezone=UTC"},
+		{"host=db dbname=flash", "host=db dbname=flash timezone=UTC"},
+		{"postgres://db/flash?TimeZone=Europe/Paris", "postgres://db/flash?TimeZone=Europe/Paris"},
+	}
+	for _, tt := range tests {
+		if got := postgresUTC(tt.dsn); got != tt.want {
+			t.Errorf("postgresUTC(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+func TestStoreMigrations(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		applied, err := appliedMigrations()
+		if err != nil {
+			t.Fatalf("appliedMigrations: %v", err)
+		}
+		for _, m := range store.Migrations() {
+			if _, ok := applied[m.Version]; !ok {
+				t.Errorf("migration %d (%s) not applied", m.Version, m.Name)
+			}
+		}
+
+		// Running them again changes nothing
+		if err := runMigrations(); err != nil {
+			t.Fatalf("runMigrations again: %v", err)
+		}
+		again, _ := appliedMigrations()
+		if len(again) != len(applied) {
+			t.Errorf("%d migrations applied after a second run, want %d", len(again), len(applied))
+		}
+
+		// A database migrated by a newer binary is refused
+		if _, err := db.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, schemaVersion()+1, "future"); err != nil {
+			t.Fatalf("inserting a future migration: %v", err)
+		}
+		if err := runMigrations(); err == nil || !strings.Contains(err.Error(), "newer") {
+			t.Errorf("runMigrations with a newer schema = %v, want a refusal", err)
+		}
+	})
+}
+
+func TestStoreGroups(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		group, err := store.CreateGroup("Class A", "key-a", nil, "Europe/Paris")
+		if err != nil {
+			t.Fatalf("CreateGroup: %v", err)
+		}
+		if group.Name != "Class A" || group.Timezone != "Europe/Paris" || group.HasAdminPin || group.CreatedAt == "" {
+			t.Errorf("created group = %+v", group)
+		}
+		if _, err := store.CreateGroup("Class B", "key-a", nil, ""); err == nil {
+			t.Error("CreateGroup accepted a duplicate secret key")
+		}
+		if byKey, err := store.GroupBySecretKey("key-a"); err != nil || byKey.ID != group.ID {
+			t.Errorf("GroupBySecretKey = %+v, %v", byKey, err)
+		}
+		if _, err := store.GroupByID(group.ID + 100); err != errGroupNotFound {
+			t.Errorf("GroupByID of a missing group: %v, want errGroupNotFound", err)
+		}
+
+		if err := store.RenameGroup(group.ID, "Class 1"); err != nil {
+			t.Fatalf("RenameGroup: %v", err)
+		}
+		if err := store.SetGroupTimezone(group.ID, ""); err != nil {
+			t.Fatalf("SetGroupTimezone: %v", err)
+		}
+		if err := store.SetGroupLeaderboardStrategy(group.ID, strategyAverage); err != nil {
+			t.Fatalf("SetGroupLeaderboardStrategy: %v", err)
+		}
+		if err := store.SetGroupSecretKey(group.ID, "key-1"); err != nil {
+			t.Fatalf("SetGroupSecretKey: %v", err)
+		}
+		if err := store.SetGroupAdminPinHash(group.ID, "hash"); err != nil {
+			t.Fatalf("SetGroupAdminPinHash: %v", err)
+		}
+		got, err := store.GroupByID(group.ID)
+		if err != nil {
+			t.Fatalf("GroupByID: %v", err)
+		}
+		if got.Name != "Class 1" || got.Timezone != "" || got.LeaderboardStrategy != strategyAverage || got.SecretKey != "key-1" || !got.HasAdminPin {
+			t.Errorf("updated group = %+v", got)
+		}
+		if hash, err := store.GroupAdminPinHash(group.ID); err != nil || hash != "hash" {
+			t.Errorf("GroupAdminPinHash = %q, %v", hash, err)
+		}
+
+		defaultID, err := store.DefaultGroupID()
+		if err != nil || defaultID == group.ID {
+			t.Fatalf("DefaultGroupID = %d, %v", defaultID, err)
+		}
+		if again, _ := store.DefaultGroupID(); again != defaultID {
+			t.Errorf("DefaultGroupID created a second group: %d, then %d", defaultID, again)
+		}
+
+		autumn := GroupTerm{GroupID: group.ID, Name: "Autumn", StartDate: "2026-09-01", EndDate: "2026-12-18"}
+		spring := GroupTerm{GroupID: group.ID, Name: "Spring", StartDate: "2026-01-05", EndDate: "2026-04-03"}
+		for _, term := range []*GroupTerm{&autumn, &spring} {
+			if created, err := store.CreateGroupTerm(term); err != nil || !created {
+				t.Fatalf("CreateGroupTerm(%s) = %v, %v", term.Name, created, err)
+			}
+		}
+		if created, err := store.CreateGroupTerm(&GroupTerm{GroupID: group.ID, Name: "Autumn", StartDate: "2027-09-01", EndDate: "2027-12-17"}); err != nil || created {
+			t.Errorf("CreateGroupTerm of a duplicate name = %v, %v", created, err)
+		}
+		terms, err := store.GroupTerms(group.ID)
+		if err != nil || len(terms) != 2 || terms[0].Name != "Spring" || terms[1].Name != "Autumn" {
+			t.Errorf("GroupTerms = %+v, %v", terms, err)
+		}
+		if deleted, err := store.DeleteGroupTerm(defaultID, spring.ID); err != nil || deleted {
+			t.Errorf("DeleteGroupTerm from another group = %v, %v", deleted, err)
+		}
+		if deleted, err := store.DeleteGroupTerm(group.ID, spring.ID); err != nil || !deleted {
+			t.Errorf("DeleteGroupTerm = %v, %v", deleted, err)
+		}
+	})
+}
+
+func TestStoreResults(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		group, ann := testUser(t, "Class A", "Ann")
+		_, bob := testUser(t, "Class B", "Bob")
+
+		webhook := &WebhookDelivery{Event: eventResultSubmitted, URL: "https://93.184.216.34/sheets", Payload: []byte(`{"score":38}`)}
+		saved, err := store.SaveResult(resultRecord{User: ann, ExerciseType: "mul", Score: 38, Total: 40, Tables: []int{2, 3, 4, 5, 6}, MeanTimeSeconds: 2.5}, resultWrites{Webhook: webhook})
+		if err != nil {
+			t.Fatalf("SaveResult: %v", err)
+		}
+		first := saved.ID
+		saved, err = store.SaveResult(resultRecord{User: ann, ExerciseType: "mul", Score: 10, Total: 10, Tables: []int{7}}, resultWrites{})
+		if err != nil {
+			t.Fatalf("SaveResult: %v", err)
+		}
+		second := saved.ID
+		if _, err := store.SaveResult(resultRecord{User: bob, ExerciseType: "add", Score: 5, Total: 10}, resultWrites{}); err != nil {
+			t.Fatalf("SaveResult: %v", err)
+		}
+
+		// The webhook payload is queued with its result
+		due, err := store.DueWebhooks(time.Now().Add(time.Minute), 10)
+		if err != nil || len(due) != 1 || due[0].URL != webhook.URL || string(due[0].Payload) != `{"score":38}` {
+			t.Fatalf("DueWebhooks = %+v, %v", due, err)
+		}
+
+		runs, err := store.LeaderboardRuns(&group.ID, "", timeWindow{})
+		if err != nil || len(runs) != 2 || runs[0].ID != first || runs[1].ID != second {
+			t.Fatalf("LeaderboardRuns = %+v, %v", runs, err)
+		}
+		if runs[0].Tables != "[2,3,4,5,6]" || runs[0].MeanTimeSeconds == nil || *runs[0].MeanTimeSeconds != 2.5 || runs[0].UserName != "Ann" {
+			t.Errorf("first run = %+v", runs[0])
+		}
+		future := time.Now().Add(time.Hour)
+		if runs, _ := store.LeaderboardRuns(nil, "", timeWindow{From: &future}); len(runs) != 0 {
+			t.Errorf("LeaderboardRuns after now = %+v", runs)
+		}
+		if runs, _ := store.LeaderboardRuns(nil, "add", timeWindow{}); len(runs) != 1 || runs[0].UserID != bob.ID {
+			t.Errorf("LeaderboardRuns of add = %+v", runs)
+		}
+		if runs, _ := store.UserRuns(ann.ID, "mul", timeWindow{To: &future}); len(runs) != 2 {
+			t.Errorf("UserRuns = %+v", runs)
+		}
+		if attempts, err := store.RecentAttempts(nil, 2); err != nil || len(attempts) != 2 {
+			t.Errorf("RecentAttempts = %+v, %v", attempts, err)
+		}
+		if best, err := store.UserBestScore(ann.ID, "mul"); err != nil || best != (BestScore{10, 10}) {
+			t.Errorf("UserBestScore = %+v, %v", best, err)
+		}
+		if best, err := store.UserBestScore(ann.ID, "div"); err != nil || best != (BestScore{}) {
+			t.Errorf("UserBestScore without results = %+v, %v", best, err)
+		}
+
+		// A result is only deleted from its group
+		if deleted, err := store.DeleteResult(bob.GroupID, first); err != nil || deleted {
+			t.Errorf("DeleteResult from another group = %v, %v", deleted, err)
+		}
+		if deleted, err := store.DeleteResult(group.ID, first); err != nil || !deleted {
+			t.Errorf("DeleteResult = %v, %v", deleted, err)
+		}
+		if runs, _ := store.UserRuns(ann.ID, "", timeWindow{}); len(runs) != 1 || runs[0].ID != second {
+			t.Errorf("UserRuns after delete = %+v", runs)
+		}
+
+		for range 2 {
+			if err := store.RecordUserError(ann, "mul", "7 × 8"); err != nil {
+				t.Fatalf("RecordUserError: %v", err)
+			}
+		}
+		if err := store.RecordUserError(ann, "mul", "6 × 9"); err != nil {
+			t.Fatalf("RecordUserError: %v", err)
+		}
+		errs, err := store.UserErrors(ann.ID, "mul")
+		if err != nil || len(errs) != 2 || errs[0].Question != "7 × 8" || errs[0].ErrorCount != 2 || errs[0].FactKey != "mul:7:8" {
+			t.Errorf("UserErrors = %+v, %v", errs, err)
+		}
+	})
+}
+
+func TestStoreSaveResultRollsBack(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		group, ann := testUser(t, "Class A", "Ann")
+		res := resultRecord{User: ann, ExerciseType: "mul", Score: 40, Total: 40, Tables: []int{1, 2, 3, 4, 5}}
+
+		// Without a ledger, an outbox or the specialist progress, the result is not saved either
+		badges := evaluateBadges(groupBadgeRules(group.ID), badgeInput{res.ExerciseType, res.Score, res.Total, res.Tables, 0, 1})
+		webhook := &WebhookDelivery{Event: eventResultSubmitted, URL: "https://93.184.216.34/sheets", Payload: []byte(`{}`)}
+		rule, _ := findSpecialistRule("mul")
+		for table, writes := range map[string]resultWrites{
+			"earned_badges":     {Badges: badges, At: time.Now()},
+			"webhook_outbox":    {Webhook: webhook},
+			"specialist_badges": {Specialist: &specialistWrite{Run: specialistRun{Table: 7, Success: true}, Rule: rule}},
+		} {
+			if _, err := db.Exec(`ALTER TABLE ` + table + ` RENAME TO ` + table + `_old`); err != nil {
+				t.Fatalf("renaming %s: %v", table, err)
+			}
+			if _, err := store.SaveResult(res, writes); err == nil {
+				t.Errorf("SaveResult succeeded without %s", table)
+			}
+			if runs, err := store.UserRuns(ann.ID, "", timeWindow{}); err != nil || len(runs) != 0 {
+				t.Errorf("UserRuns after a failed save = %+v, %v", runs, err)
+			}
+			if _, err := db.Exec(`ALTER TABLE ` + table + `_old RENAME TO ` + table); err != nil {
+				t.Fatalf("restoring %s: %v", table, err)
+			}
+		}
+	})
+}
+
+func TestStoreBadges(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		group, ann := testUser(t, "Class A", "Ann")
+		res := resultRecord{User: ann, ExerciseType: "mul", Score: 40, Total: 40, Tables: []int{1, 2, 3, 4, 5}, MeanTimeSeconds: 1.8}
+		badges := evaluateBadges(groupBadgeRules(group.ID), badgeInput{res.ExerciseType, res.Score, res.Total, res.Tables, res.MeanTimeSeconds, 1})
+		if ids := badgeIDs(badges); strings.Join(ids, ",") != "gold,speed-gold" {
+			t.Fatalf("badges of a perfect fast run = %v", ids)
+		}
+		saved, err := store.SaveResult(res, resultWrites{Badges: badges, At: time.Now()})
+		if err != nil || len(saved.NewBadges) != 2 {
+			t.Fatalf("SaveResult = %+v, %v", saved, err)
+		}
+		resultID := saved.ID
+		if newBadges, err := store.RecordBadges(ann.ID, "mul", resultID, 40, 40, 5, badges, time.Now()); err != nil || len(newBadges) != 0 {
+			t.Errorf("RecordBadges again = %v, %v", newBadges, err)
+		}
+		earned, err := store.EarnedBadges(&group.ID)
+		if err != nil || len(earned) != 2 || earned[0].Count != 2 || earned[0].FirstResultID != resultID || earned[0].UserName != "Ann" {
+			t.Fatalf("EarnedBadges = %+v, %v", earned, err)
+		}
+
+		// The ledger is rebuilt from the single result
+		if n, err := store.RebuildBadges(ledgerScope{GroupID: &group.ID}); err != nil || n != 2 {
+			t.Errorf("RebuildBadges = %d, %v", n, err)
+		}
+		if earned, _ := store.EarnedBadges(nil); len(earned) != 2 || earned[0].Count != 1 {
+			t.Errorf("EarnedBadges after rebuild = %+v", earned)
+		}
+		if window, err := store.WindowBadges(&group.ID, timeWindow{}); err != nil || len(window) != 2 {
+			t.Errorf("WindowBadges = %+v, %v", window, err)
+		}
+
+		// Group rules are stored once and rebuild the ledger of the group
+		rule := &BadgeRule{ID: "steady", Category: "steady", Rank: 1, GroupID: &group.ID}
+		rule.MinRatio = 0.5
+		if created, err := store.CreateBadgeRule(rule); err != nil || !created || rule.CreatedAt == "" {
+			t.Fatalf("CreateBadgeRule = %v, %v", created, err)
+		}
+		if created, err := store.CreateBadgeRule(&BadgeRule{ID: "steady", Category: "steady", GroupID: &group.ID}); err != nil || created {
+			t.Errorf("CreateBadgeRule of a duplicate = %v, %v", created, err)
+		}
+		rules, err := store.BadgeRules(&group.ID)
+		if err != nil || len(rules) != 1 || rules[0].ID != "steady" || rules[0].MinRatio != 0.5 {
+			t.Errorf("BadgeRules = %+v, %v", rules, err)
+		}
+		if earned, _ := store.EarnedBadges(&group.ID); len(earned) != 3 {
+			t.Errorf("EarnedBadges with the group rule = %+v", earned)
+		}
+		if deleted, err := store.DeleteBadgeRule(group.ID, "steady"); err != nil || !deleted {
+			t.Errorf("DeleteBadgeRule = %v, %v", deleted, err)
+		}
+		if earned, _ := store.EarnedBadges(&group.ID); len(earned) != 2 {
+			t.Errorf("EarnedBadges without the group rule = %+v", earned)
+		}
+
+		if times, err := store.PracticeTimes(&group.ID, nil); err != nil || len(times) != 1 {
+			t.Errorf("PracticeTimes = %+v, %v", times, err)
+		}
+	})
+}
+
+func TestStoreSpecialistRuns(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		_, ann := testUser(t, "Class A", "Ann")
+		rule, ok := findSpecialistRule("mul")
+		if !ok {
+			t.Fatal("no specialist rule for mul")
+		}
+		perfect := resultRecord{User: ann, ExerciseType: "mul", Score: 10, Total: 10, Tables: []int{7}}
+
+		// The progress is saved with the result, the badge earned on the last run
+		for i := 1; i <= rule.Runs; i++ {
+			saved, err := store.SaveResult(perfect, resultWrites{Specialist: resultSpecialistRun(perfect)})
+			if err != nil || saved.Specialist == nil {
+				t.Fatalf("SaveResult = %+v, %v", saved, err)
+			}
+			if p := saved.Specialist; p.ConsecutivePerfect != i || p.TableNumber != 7 || p.Awarded != (i == rule.Runs) {
+				t.Errorf("run %d progress = %+v", i, p)
+			}
+		}
+
+		// Failed runs dim the badge
+		failed := perfect
+		failed.Score = 9
+		var progress SpecialistProgress
+		for range rule.DecayFailures {
+			var err error
+			if progress, err = store.RecordSpecialistRun(ann, "mul", resultSpecialistRun(failed).Run, rule); err != nil {
+				t.Fatalf("RecordSpecialistRun: %v", err)
+			}
+		}
+		if !progress.Decayed || !progress.Dimmed || !progress.BadgeEarned {
+			t.Errorf("progress after %d failed runs = %+v", rule.DecayFailures, progress)
+		}
+		badges, err := store.SpecialistBadges(nil)
+		if err != nil || len(badges) != 1 || badges[0].TableNumber != 7 {
+			t.Errorf("SpecialistBadges = %+v, %v", badges, err)
+		}
+	})
+}
+
+func TestStoreWebhooks(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		now := time.Now()
+		if err := store.EnqueueWebhook(eventBadgeEarned, "https://93.184.216.34/a", "secret", []byte(`{}`), now); err != nil {
+			t.Fatalf("EnqueueWebhook: %v", err)
+		}
+		if err := store.EnqueueWebhook(eventBadgeEarned, "https://93.184.216.34/b", "", []byte(`{}`), now.Add(time.Hour)); err != nil {
+			t.Fatalf("EnqueueWebhook: %v", err)
+		}
+		due, err := store.DueWebhooks(now.Add(time.Second), 10)
+		if err != nil || len(due) != 1 || due[0].secret != "secret" || due[0].Status != webhookStatusPending {
+			t.Fatalf("DueWebhooks = %+v, %v", due, err)
+		}
+
+		// A delivery is claimed once
+		lease := now.Add(time.Minute)
+		if claimed, err := store.ClaimWebhook(due[0].ID, now.Add(time.Second), lease); err != nil || !claimed {
+			t.Fatalf("ClaimWebhook = %v, %v", claimed, err)
+		}
+		if claimed, err := store.ClaimWebhook(due[0].ID, now.Add(time.Second), lease); err != nil || claimed {
+			t.Errorf("ClaimWebhook again = %v, %v", claimed, err)
+		}
+		if err := store.WebhookDelivered(due[0].ID, 1, now); err != nil {
+			t.Fatalf("WebhookDelivered: %v", err)
+		}
+		if n, err := store.PruneWebhooks(now.Add(-time.Hour)); err != nil || n != 0 {
+			t.Errorf("PruneWebhooks before the delivery = %d, %v", n, err)
+		}
+		if n, err := store.PruneWebhooks(now.Add(time.Hour)); err != nil || n != 1 {
+			t.Errorf("PruneWebhooks = %d, %v", n, err)
+		}
+
+		group, err := store.CreateGroup("Class A", "key-a", nil, "")
+		if err != nil {
+			t.Fatalf("CreateGroup: %v", err)
+		}
+		global := &WebhookSubscription{URL: "https://93.184.216.34/global", Secret: "s1"}
+		scoped := &WebhookSubscription{GroupID: &group.ID, URL: "https://93.184.216.34/group", Secret: "s2", Events: []string{eventBadgeEarned, eventGroupCreated}}
+		for _, sub := range []*WebhookSubscription{global, scoped} {
+			if err := store.CreateWebhookSubscription(sub); err != nil || sub.ID == 0 || sub.CreatedAt == "" {
+				t.Fatalf("CreateWebhookSubscription = %+v, %v", sub, err)
+			}
+		}
+		if subs, err := store.WebhookSubscriptions(nil); err != nil || len(subs) != 1 || subs[0].ID != global.ID || len(subs[0].Events) != 0 {
+			t.Errorf("global WebhookSubscriptions = %+v, %v", subs, err)
+		}
+		subs, err := store.WebhookSubscriptions(&group.ID)
+		if err != nil || len(subs) != 1 || *subs[0].GroupID != group.ID || strings.Join(subs[0].Events, ",") != "badge.earned,group.created" {
+			t.Errorf("group WebhookSubscriptions = %+v, %v", subs, err)
+		}
+		if deleted, err := store.DeleteWebhookSubscription(global.ID, &group.ID); err != nil || deleted {
+			t.Errorf("DeleteWebhookSubscription of a global one from a group = %v, %v", deleted, err)
+		}
+		if deleted, err := store.DeleteWebhookSubscription(global.ID, nil); err != nil || !deleted {
+			t.Errorf("DeleteWebhookSubscription = %v, %v", deleted, err)
+		}
+	})
+}
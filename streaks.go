@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	// Timezone database, for hosts without one
+	_ "time/tzdata"
+)
+
+// A user practises on a day when they save at least one result that day, in the
+// timezone of their group. The streak is the number of days practised in a row; it
+// is still current until the end of the day after the last day practised. Streak
+// milestones are badge rules with min_streak_days, evaluated with the other rules.
+
+// maxStreakMilestone bounds the min_streak_days of the badge rules
+const maxStreakMilestone = 366
+
+// Streak is the daily practice of a user
+type Streak struct {
+	UserID   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+	GroupID  int64  `json:"group_id"`
+	// Timezone in which the days are counted
+	Timezone      string `json:"timezone"`
+	CurrentStreak int    `json:"current_streak"`
+	LongestStreak int    `json:"longest_streak"`
+	DaysThisMonth int    `json:"days_this_month"`
+	// PractisedToday is false while the current streak waits for today's practice
+	PractisedToday   bool   `json:"practised_today"`
+	LastPracticeDate string `json:"last_practice_date,omitempty"`
+	// NextMilestone is the streak of the next streak badge, 0 after the last one
+	NextMilestone int `json:"next_milestone,omitempty"`
+}
+
+// PracticeTime is a result time of a user, or a user without results when At is nil
+type PracticeTime struct {
+	UserID   int64
+	UserName string
+	GroupID  int64
+	Timezone string
+	At       *time.Time
+}
+
+var (
+	locationsMu sync.Mutex
+	locations   = make(map[string]*time.Location)
+)
+
+// validateTimezone checks an IANA timezone name such as "Europe/Paris"
+func validateTimezone(name string) *APIError {
+	if _, err := time.LoadLocation(name); err != nil || name == "Local" {
+		return &APIError{Status: http.StatusBadRequest, Code: codeInvalidField, Field: "timezone", Message: fmt.Sprintf("unknown timezone %q", name)}
+	}
+	return nil
+}
+
+// groupLocation returns the location of a group timezone, the server default when empty
+func groupLocation(timezone string) *time.Location {
+	if timezone == "" {
+		timezone = config.GroupConfig.Timezone
+	}
+	locationsMu.Lock()
+	defer locationsMu.Unlock()
+	if loc, ok := locations[timezone]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		slog.Error("Failed to load timezone, using UTC", "timezone", timezone, "error", err)
+		loc = time.UTC
+	}
+	locations[timezone] = loc
+	return loc
+}
+
+// practiceDay returns the day of a time in a location, as midnight UTC so that days
+// compare and add without daylight saving shifts
+func practiceDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// nextDay reports whether day directly follows prev
+func nextDay(prev, day time.Time) bool {
+	return prev.AddDate(0, 0, 1).Equal(day)
+}
+
+// streakCounter follows the streak of a user through results in chronological order
+type streakCounter struct {
+	last time.Time
+	days int
+}
+
+// add counts a day of practice and returns the streak ending on that day
+func (c *streakCounter) add(day time.Time) int {
+	switch {
+	case c.days > 0 && c.last.Equal(day):
+	case c.days > 0 && nextDay(c.last, day):
+		c.days++
+	default:
+		c.days = 1
+	}
+	c.last = day
+	return c.days
+}
+
+// computeStreak fills the streaks of a user from their sorted practice days
+func computeStreak(streak *Streak, days []time.Time, today time.Time) {
+	var counter streakCounter
+	for _, day := range days {
+		if n := counter.add(day); n > streak.LongestStreak {
+			streak.LongestStreak = n
+		}
+		if day.Year() == today.Year() && day.Month() == today.Month() && !day.After(today) {
+			streak.DaysThisMonth++
+		}
+	}
+	if counter.days == 0 {
+		return
+	}
+	streak.LastPracticeDate = counter.last.Format(time.DateOnly)
+	streak.PractisedToday = counter.last.Equal(today)
+	if streak.PractisedToday || nextDay(counter.last, today) {
+		streak.CurrentStreak = counter.days
+	}
+}
+
+// userPracticeDays returns the days practised by each user, in order, from their
+// practice times in chronological order, and the users with their group timezone
+func userPracticeDays(times []PracticeTime) (users []Streak, days map[int64][]time.Time) {
+	days = make(map[int64][]time.Time)
+	seen := make(map[int64]bool)
+	for _, pt := range times {
+		if !seen[pt.UserID] {
+			seen[pt.UserID] = true
+			users = append(users, Streak{UserID: pt.UserID, UserName: pt.UserName, GroupID: pt.GroupID, Timezone: groupLocation(pt.Timezone).String()})
+		}
+		if pt.At == nil {
+			continue
+		}
+		day := practiceDay(*pt.At, groupLocation(pt.Timezone))
+		if d := days[pt.UserID]; len(d) == 0 || !d[len(d)-1].Equal(day) {
+			days[pt.UserID] = append(d, day)
+		}
+	}
+	return users, days
+}
+
+// userStreakDays returns the streak of a user ending today, for the badges of a
+// result about to be saved: today counts as practised
+func userStreakDays(userID int64, now time.Time) (int, error) {
+	times, err := store.PracticeTimes(nil, &userID)
+	if err != nil {
+		return 0, err
+	}
+	users, days := userPracticeDays(times)
+	if len(users) == 0 {
+		// The first result of the user
+		return 1, nil
+	}
+	streak := users[0]
+	today := practiceDay(now, groupLocation(streak.Timezone))
+	computeStreak(&streak, append(days[userID], today), today)
+	return streak.CurrentStreak, nil
+}
+
+// nextStreakMilestone returns the smallest min_streak_days of the rules above a streak
+func nextStreakMilestone(rules []BadgeRule, streak int) int {
+	next := 0
+	for _, rule := range rules {
+		if rule.MinStreakDays > streak && (next == 0 || rule.MinStreakDays < next) {
+			next = rule.MinStreakDays
+		}
+	}
+	return next
+}
+
+// GET /api/streaks - Daily practice streaks of the users of the group, best first
+func getStreaks(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := requestGroupScope(w, r)
+	if !ok {
+		return
+	}
+
+	var userID *int64
+	if r.URL.Query().Get("user_id") != "" || r.URL.Query().Get("name") != "" {
+		user, err := queryUser(r, groupID)
+		if err == errUserNotFound || err == errGroupNotFound {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode([]Streak{})
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to resolve user", "error", err)
+			writeDatabaseError(w)
+			return
+		}
+		userID = &user.ID
+	}
+
+	times, err := store.PracticeTimes(groupID, userID)
+	if err != nil {
+		slog.Error("Failed to query practice times", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	// Rules of each group, for the next milestones
+	rules := badgeRules
+	if groupRules, err := store.BadgeRules(groupID); err != nil {
+		slog.Error("Failed to query badge rules", "error", err)
+	} else {
+		rules = append(slices.Clone(badgeRules), groupRules...)
+	}
+
+	now := time.Now()
+	users, days := userPracticeDays(times)
+	streaks := make([]Streak, 0, len(users))
+	for _, streak := range users {
+		loc := groupLocation(streak.Timezone)
+		computeStreak(&streak, days[streak.UserID], practiceDay(now, loc))
+		streak.NextMilestone = nextStreakMilestone(groupRulesOf(rules, streak.GroupID), streak.CurrentStreak)
+		streaks = append(streaks, streak)
+	}
+
+	sort.Slice(streaks, func(i, j int) bool {
+		if streaks[i].CurrentStreak != streaks[j].CurrentStreak {
+			return streaks[i].CurrentStreak > streaks[j].CurrentStreak
+		}
+		if streaks[i].LongestStreak != streaks[j].LongestStreak {
+			return streaks[i].LongestStreak > streaks[j].LongestStreak
+		}
+		if streaks[i].UserName != streaks[j].UserName {
+			return streaks[i].UserName < streaks[j].UserName
+		}
+		return streaks[i].UserID < streaks[j].UserID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(streaks)
+}
+
+// addGroupTimezone adds the timezone of the groups. The streak badges of the results
+// saved before are awarded by the backfill-badges command.
+func addGroupTimezone(tx *Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE groups ADD COLUMN timezone TEXT`); err != nil {
+		return fmt.Errorf("failed to add timezone to groups: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPracticeDay(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no Europe/Paris timezone: %v", err)
+	}
+	tests := []struct {
+		at   time.Time
+		loc  *time.Location
+		want string
+	}{
+		{time.Date(2026, 3, 14, 23, 30, 0, 0, time.UTC), time.UTC, "2026-03-14"},
+		{time.Date(2026, 3, 14, 23, 30, 0, 0, time.UTC), paris, "2026-03-15"},
+		{time.Date(2026, 3, 14, 22, 59, 0, 0, time.UTC), paris, "2026-03-14"},
+		// Summer time: Paris is two hours ahead
+		{time.Date(2026, 7, 1, 22, 30, 0, 0, time.UTC), paris, "2026-07-02"},
+		{time.Date(2026, 7, 1, 21, 59, 0, 0, time.UTC), paris, "2026-07-01"},
+	}
+	for _, tt := range tests {
+		day := practiceDay(tt.at, tt.loc)
+		if got := day.Format(time.DateOnly); got != tt.want || day.Location() != time.UTC || day.Hour() != 0 {
+			t.Errorf("practiceDay(%v, %v) = %v, want %s at midnight UTC", tt.at, tt.loc, day, tt.want)
+		}
+	}
+}
+
+func TestComputeStreak(t *testing.T) {
+	march := func(days ...int) []time.Time {
+		var out []time.Time
+		for _, d := range days {
+			out = append(out, time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC))
+		}
+		return out
+	}
+	tests := []struct {
+		name      string
+		days      []time.Time
+		today     int
+		current   int
+		longest   int
+		thisMonth int
+		practised bool
+	}{
+		{"practised today", march(10, 11, 12), 12, 3, 3, 3, true},
+		{"still current the day after", march(10, 11, 12), 13, 3, 3, 3, false},
+		{"broken by a day without practice", march(10, 11, 12), 14, 0, 3, 3, false},
+		{"a gap restarts the streak", march(1, 2, 3, 5, 6), 6, 2, 3, 5, true},
+		{"across months", append([]time.Time{time.Date(2026, 2, 27, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)}, march(1)...), 1, 3, 3, 1, true},
+		{"never practised", nil, 1, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streak Streak
+			computeStreak(&streak, tt.days, time.Date(2026, 3, tt.today, 0, 0, 0, 0, time.UTC))
+			if streak.CurrentStreak != tt.current || streak.LongestStreak != tt.longest ||
+				streak.DaysThisMonth != tt.thisMonth || streak.PractisedToday != tt.practised {
+				t.Errorf("streak = %+v, want current %d, longest %d, this month %d, practised today %v",
+					streak, tt.current, tt.longest, tt.thisMonth, tt.practised)
+			}
+		})
+	}
+}
+
+func TestStreakAcrossMidnightInGroupTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("no Europe/Paris timezone: %v", err)
+	}
+	// 00:30 on March 11th in Paris, still March 10th in UTC, then March 12th
+	results := []time.Time{
+		time.Date(2026, 3, 10, 23, 30, 0, 0, time.UTC),
+		time.Date(2026, 3, 12, 10, 0, 0, 0, time.UTC),
+	}
+	now := time.Date(2026, 3, 12, 18, 0, 0, 0, time.UTC)
+	tests := []struct {
+		loc     *time.Location
+		current int
+	}{
+		{paris, 2},
+		{time.UTC, 1},
+	}
+	for _, tt := range tests {
+		var days []time.Time
+		for _, at := range results {
+			days = append(days, practiceDay(at, tt.loc))
+		}
+		var streak Streak
+		computeStreak(&streak, days, practiceDay(now, tt.loc))
+		if streak.CurrentStreak != tt.current {
+			t.Errorf("streak in %v = %d, want %d", tt.loc, streak.CurrentStreak, tt.current)
+		}
+	}
+}
+
+func TestUserPracticeDays(t *testing.T) {
+	at := func(day, hour int) *time.Time {
+		v := time.Date(2026, 3, day, hour, 0, 0, 0, time.UTC)
+		return &v
+	}
+	times := []PracticeTime{
+		{UserID: 1, UserName: "Ann", GroupID: 1, Timezone: "Europe/Paris", At: at(5, 8)},
+		{UserID: 1, UserName: "Ann", GroupID: 1, Timezone: "Europe/Paris", At: at(5, 17)},
+		{UserID: 1, UserName: "Ann", GroupID: 1, Timezone: "Europe/Paris", At: at(6, 9)},
+		{UserID: 2, UserName: "Bob", GroupID: 1, Timezone: "Europe/Paris"},
+	}
+	users, days := userPracticeDays(times)
+	if len(users) != 2 {
+		t.Fatalf("users = %+v, want Ann and Bob", users)
+	}
+	// Several results a day count once
+	if len(days[1]) != 2 || len(days[2]) != 0 {
+		t.Errorf("days = %v, want two days for Ann and none for Bob", days)
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Users belong to a group and have a stable ID. The name a child types is matched
+// against the group's users case-, accent- and whitespace-insensitively, so "Léa",
+// "lea" and "Lea " are the same user.
+
+// User is a pupil of a group
+type User struct {
+	ID        int64  `json:"id"`
+	GroupID   int64  `json:"group_id"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+var (
+	errUserNotFound  = errors.New("user not found")
+	errGroupNotFound = errors.New("group not found")
+	errUserExists    = errors.New("a user with this name already exists in the group")
+)
+
+// userTables lists the tables holding per-user rows
+var userTables = []string{
+	"user_results",
+	"user_errors",
+	"specialist_badges",
+	"quiz_sessions",
+	"answer_events",
+	"review_schedule",
+}
+
+// accentFolding maps accented latin letters to their base letter
+var accentFolding = map[rune]rune{
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+	'ç': 'c',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'ñ': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u',
+	'ý': 'y', 'ÿ': 'y',
+}
+
+// normalizeUserName returns the key used to match user names: lower case,
+// without accents, with whitespace trimmed and collapsed
+func normalizeUserName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.Join(strings.Fields(name), " ")) {
+		if folded, ok := accentFolding[r]; ok {
+			r = folded
+		}
+		if r == 'œ' {
+			b.WriteString("oe")
+			continue
+		}
+		if r == 'æ' {
+			b.WriteString("ae")
+			continue
+		}
+		if unicode.IsPrint(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// cleanUserName returns a display name with whitespace trimmed and collapsed
+func cleanUserName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// initUserTables creates the users table, links the records of every legacy name
+// to a user and makes the per-name tables unique per user ID
+func initUserTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			group_id INTEGER NOT NULL REFERENCES groups(id),
+			name TEXT NOT NULL,
+			name_key TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(group_id, name_key)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create users table: %w", err)
+	}
+
+	// The per-user tables existing when users were introduced
+	tables := []string{"user_results", "user_errors", "specialist_badges", "quiz_sessions", "answer_events", "review_schedule"}
+
+	// Add user_id column to per-user tables if it doesn't exist
+	added := make(map[string]bool)
+	for _, table := range tables {
+		added[table], err = addColumnIfMissing(tx, table, "user_id", "INTEGER REFERENCES users(id)")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create users for legacy names and link their records
+	migrated, err := migrateUserNames(tx, tables)
+	if err != nil {
+		return fmt.Errorf("failed to migrate user names: %w", err)
+	}
+
+	// Tables unique per user name are rebuilt once to be unique per user ID,
+	// merging the rows of names that now belong to the same user
+	if added["user_errors"] {
+		if err := rebuildUserErrors(tx); err != nil {
+			return fmt.Errorf("failed to rebuild user_errors: %w", err)
+		}
+	}
+	if added["specialist_badges"] {
+		if err := rebuildSpecialistBadges(tx); err != nil {
+			return fmt.Errorf("failed to rebuild specialist_badges: %w", err)
+		}
+	}
+	if added["review_schedule"] {
+		if err := rebuildReviewSchedule(tx); err != nil {
+			return fmt.Errorf("failed to rebuild review_schedule: %w", err)
+		}
+	}
+
+	// Merged records take the name of their user, now that no table is unique per name
+	if migrated > 0 {
+		for _, table := range tables {
+			_, err := tx.Exec(`UPDATE ` + table + ` SET user_name = (SELECT name FROM users WHERE users.id = ` + table + `.user_id)`)
+			if err != nil {
+				return fmt.Errorf("failed to update user names in %s: %w", table, err)
+			}
+		}
+	}
+
+	for _, table := range tables {
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_user ON ` + table + `(user_id)`)
+		if err != nil {
+			return fmt.Errorf("failed to create %s user index: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateUserNames links the records without user_id to a user, creating the users
+// from the legacy names. Records without a group go to the default group.
+// It returns the number of legacy names migrated.
+func migrateUserNames(tx *Tx, tables []string) (int, error) {
+	type legacyName struct {
+		groupID sql.NullInt64
+		name    string
+	}
+
+	migrated := 0
+	for _, table := range tables {
+		rows, err := tx.Query(`SELECT DISTINCT group_id, user_name FROM ` + table + ` WHERE user_id IS NULL`)
+		if err != nil {
+			return 0, err
+		}
+		var names []legacyName
+		for rows.Next() {
+			var n legacyName
+			if err := rows.Scan(&n.groupID, &n.name); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			names = append(names, n)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, n := range names {
+			groupID := n.groupID.Int64
+			if !n.groupID.Valid {
+				groupID, err = defaultGroupID(tx)
+				if err != nil {
+					return 0, err
+				}
+			}
+			userID, err := legacyUserID(tx, groupID, n.name)
+			if err != nil {
+				return 0, fmt.Errorf("failed to create user %q: %w", n.name, err)
+			}
+
+			_, err = tx.Exec(`
+				UPDATE `+table+`
+				SET user_id = ?, group_id = ?
+				WHERE user_id IS NULL AND user_name = ? AND (group_id = ? OR (group_id IS NULL AND ? = 0))
+			`, userID, groupID, n.name, n.groupID.Int64, boolToInt(n.groupID.Valid))
+			if err != nil {
+				return 0, err
+			}
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		slog.Info("Migrated legacy user names to users", "names", migrated)
+	}
+	return migrated, nil
+}
+
+// legacyUserID returns the ID of the user of a group matching a legacy name,
+// creating the user if needed. The first spelling met becomes the user's name.
+func legacyUserID(tx *Tx, groupID int64, name string) (int64, error) {
+	nameKey := normalizeUserName(name)
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM users WHERE group_id = ? AND name_key = ?`, groupID, nameKey).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	result, err := tx.Exec(`INSERT INTO users (group_id, name, name_key) VALUES (?, ?, ?)`, groupID, cleanUserName(name), nameKey)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// rebuildUserErrors recreates user_errors unique per user ID, summing merged error counts
+func rebuildUserErrors(tx *Tx) error {
+	return rebuildTable(tx, "user_errors", `
+		CREATE TABLE user_errors_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			error_count INTEGER DEFAULT 1,
+			last_error_date DATETIME DEFAULT CURRENT_TIMESTAMP,
+			group_id INTEGER REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, question)
+		)
+	`, `
+		INSERT INTO user_errors_new (user_id, user_name, exercise_type, question, error_count, last_error_date, group_id)
+		SELECT user_id, MAX(user_name), exercise_type, question, SUM(error_count), MAX(last_error_date), MAX(group_id)
+		FROM user_errors
+		GROUP BY user_id, exercise_type, question
+	`)
+}
+
+// rebuildSpecialistBadges recreates specialist_badges unique per user ID, keeping the best merged progress
+func rebuildSpecialistBadges(tx *Tx) error {
+	return rebuildTable(tx, "specialist_badges", `
+		CREATE TABLE specialist_badges_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			table_number INTEGER NOT NULL,
+			consecutive_perfect INTEGER DEFAULT 0,
+			badge_earned INTEGER DEFAULT 0,
+			earned_at DATETIME,
+			group_id INTEGER REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, table_number)
+		)
+	`, `
+		INSERT INTO specialist_badges_new (user_id, user_name, exercise_type, table_number, consecutive_perfect, badge_earned, earned_at, group_id)
+		SELECT user_id, MAX(user_name), exercise_type, table_number, MAX(consecutive_perfect), MAX(badge_earned), MIN(earned_at), MAX(group_id)
+		FROM specialist_badges
+		GROUP BY user_id, exercise_type, table_number
+	`)
+}
+
+// rebuildReviewSchedule recreates review_schedule unique per user ID, keeping the most recently reviewed state
+func rebuildReviewSchedule(tx *Tx) error {
+	return rebuildTable(tx, "review_schedule", `
+		CREATE TABLE review_schedule_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users(id),
+			user_name TEXT NOT NULL,
+			exercise_type TEXT NOT NULL,
+			question TEXT NOT NULL,
+			ease REAL NOT NULL DEFAULT 2.5,
+			interval_days REAL NOT NULL DEFAULT 0,
+			repetitions INTEGER NOT NULL DEFAULT 0,
+			lapses INTEGER NOT NULL DEFAULT 0,
+			due_at DATETIME NOT NULL,
+			last_reviewed_at DATETIME,
+			group_id INTEGER REFERENCES groups(id),
+			UNIQUE(user_id, exercise_type, question)
+		)
+	`, `
+		INSERT INTO review_schedule_new (user_id, user_name, exercise_type, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id)
+		SELECT user_id, user_name, exercise_type, question, ease, interval_days, repetitions, lapses, due_at, last_reviewed_at, group_id
+		FROM review_schedule r
+		WHERE id = (
+			SELECT id FROM review_schedule
+			WHERE user_id = r.user_id AND exercise_type = r.exercise_type AND question = r.question
+			ORDER BY last_reviewed_at DESC, id DESC
+			LIMIT 1
+		)
+	`)
+}
+
+// rebuildTable replaces a table by a new definition filled from the old table
+func rebuildTable(tx *Tx, table, createSQL, copySQL string) error {
+	for _, stmt := range []string{
+		createSQL,
+		copySQL,
+		`DROP TABLE ` + table,
+		`ALTER TABLE ` + table + `_new RENAME TO ` + table,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Rebuilt table with user IDs", "table", table)
+	return nil
+}
+
+// defaultGroupID returns the ID of the group holding records without a group, creating it if needed
+func defaultGroupID(q dbtx) (int64, error) {
+	var id int64
+	err := q.QueryRow(`SELECT id FROM groups WHERE name = 'Groupe Original' ORDER BY id LIMIT 1`).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	secretKey, err := generateSecretKey()
+	if err != nil {
+		return 0, err
+	}
+	err = q.QueryRow(`INSERT INTO groups (name, secret_key) VALUES ('Groupe Original', ?) RETURNING id`, secretKey).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("Created default group for existing data", "group_id", id, "secret_key", secretKey)
+	return id, nil
+}
+
+// loadUser returns a user by ID
+func loadUser(id int64) (*User, error) {
+	var u User
+	err := db.QueryRow(`
+		SELECT id, group_id, name, created_at FROM users WHERE id = ?
+	`, id).Scan(&u.ID, &u.GroupID, &u.Name, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// findUser returns the user of a group matching a name
+func findUser(groupID int64, name string) (*User, error) {
+	var u User
+	err := db.QueryRow(`
+		SELECT id, group_id, name, created_at FROM users WHERE group_id = ? AND name_key = ?
+	`, groupID, normalizeUserName(name)).Scan(&u.ID, &u.GroupID, &u.Name, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// resolveUser returns the user of a group matching a name, creating it if needed
+func resolveUser(groupID int64, name string) (*User, error) {
+	user, err := findUser(groupID, name)
+	if err != errUserNotFound {
+		return user, err
+	}
+
+	user, err = createUser(groupID, name)
+	if err == errUserExists {
+		// Created concurrently by another request
+		return findUser(groupID, name)
+	}
+	return user, err
+}
+
+// createUser adds a user to a group
+func createUser(groupID int64, name string) (*User, error) {
+	name = cleanUserName(name)
+	if name == "" {
+		return nil, fmt.Errorf("empty user name")
+	}
+
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM groups WHERE id = ?`, groupID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, errGroupNotFound
+	}
+
+	var id int64
+	err = db.QueryRow(`
+		INSERT INTO users (group_id, name, name_key) VALUES (?, ?, ?)
+		ON CONFLICT(group_id, name_key) DO NOTHING
+		RETURNING id
+	`, groupID, name, normalizeUserName(name)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, errUserExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadUser(id)
+}
+
+// requestUser identifies the user of a write request: by user_id when given,
+// otherwise by name within the group, creating the user on first use. Members only
+// write as users of the group of their credentials; the server admin writes as any
+// user, by name in the default group when no group is given. It writes the error
+// response on failure.
+func requestUser(w http.ResponseWriter, r *http.Request, userID *int64, groupID *int64, name string) *User {
+	if !isServerAdmin(r) {
+		memberOf, err := requestGroupMembership(r)
+		switch err {
+		case nil:
+		case errNoCredentials, errBadCredentials:
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, err.Error())
+			return nil
+		default:
+			slog.Error("Failed to check group membership", "error", err)
+			writeDatabaseError(w)
+			return nil
+		}
+		if groupID != nil && *groupID != memberOf {
+			writeError(w, http.StatusForbidden, codeForbidden, "group_id does not match the group credentials")
+			return nil
+		}
+		groupID = &memberOf
+	}
+
+	var user *User
+	var err error
+	switch {
+	case userID != nil:
+		user, err = loadUser(*userID)
+		if err == nil && groupID != nil && user.GroupID != *groupID {
+			err = errUserNotFound
+		}
+	case strings.TrimSpace(name) == "":
+		writeFieldError(w, codeMissingField, "name", "name required")
+		return nil
+	default:
+		var gid int64
+		if groupID != nil {
+			gid = *groupID
+		} else if gid, err = defaultGroupID(db); err != nil {
+			break
+		}
+		user, err = resolveUser(gid, name)
+	}
+
+	switch err {
+	case nil:
+		return user
+	case errUserNotFound:
+		writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+	case errGroupNotFound:
+		writeError(w, http.StatusNotFound, codeNotFound, "group not found")
+	default:
+		slog.Error("Failed to resolve user", "error", err)
+		writeDatabaseError(w)
+	}
+	return nil
+}
+
+// queryUser identifies the user of a read request from the user_id, or name and
+// group_id, query parameters, within the group scope of the request (see
+// requestGroupScope). It returns errUserNotFound for unknown users and for the
+// users of other groups.
+func queryUser(r *http.Request, scope *int64) (*User, error) {
+	q := r.URL.Query()
+	if userIDParam := q.Get("user_id"); userIDParam != "" {
+		userID, err := strconv.ParseInt(userIDParam, 10, 64)
+		if err != nil {
+			return nil, errUserNotFound
+		}
+		user, err := loadUser(userID)
+		if err == nil && scope != nil && user.GroupID != *scope {
+			return nil, errUserNotFound
+		}
+		return user, err
+	}
+
+	name := strings.TrimSpace(q.Get("name"))
+	if name == "" {
+		return nil, errUserNotFound
+	}
+	var groupID int64
+	if scope != nil {
+		groupID = *scope
+	} else if groupIDParam := q.Get("group_id"); groupIDParam != "" {
+		id, err := strconv.ParseInt(groupIDParam, 10, 64)
+		if err != nil {
+			return nil, errGroupNotFound
+		}
+		groupID = id
+	} else {
+		id, err := defaultGroupID(db)
+		if err != nil {
+			return nil, err
+		}
+		groupID = id
+	}
+	return findUser(groupID, name)
+}
+
+// groupIDFromPath parses the {id} path value of group routes
+func groupIDFromPath(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	groupID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "id", "invalid group id")
+		return 0, false
+	}
+	return groupID, true
+}
+
+// groupUsers returns the members of a group, ordered by name
+func groupUsers(groupID int64) ([]User, error) {
+	rows, err := db.Query(`
+		SELECT id, group_id, name, created_at
+		FROM users
+		WHERE group_id = ?
+		ORDER BY name_key
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.GroupID, &u.Name, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// GET /api/groups/{id}/users - List the members of a group
+func listGroupUsers(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := groupUsers(groupID)
+	if err != nil {
+		slog.Error("Failed to query users", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if users == nil {
+		users = []User{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+type userRequest struct {
+	Name string `json:"name"`
+}
+
+// POST /api/groups/{id}/users - Add a member to a group
+func createGroupUser(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	if cleanUserName(req.Name) == "" {
+		writeFieldError(w, codeMissingField, "name", "name required")
+		return
+	}
+
+	user, err := createUser(groupID, req.Name)
+	switch err {
+	case nil:
+	case errGroupNotFound:
+		writeError(w, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	case errUserExists:
+		writeError(w, http.StatusConflict, codeConflict, err.Error())
+		return
+	default:
+		slog.Error("Failed to create user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("User created", "id", user.ID, "group_id", groupID, "name", user.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// PATCH /api/groups/{id}/users/{userID} - Rename a member of a group (admin)
+func renameGroupUser(w http.ResponseWriter, r *http.Request) {
+	groupID, ok := groupIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, err := strconv.ParseInt(r.PathValue("userID"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "userID", "invalid user id")
+		return
+	}
+
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidJSON, "invalid json")
+		return
+	}
+	name := cleanUserName(req.Name)
+	if name == "" {
+		writeFieldError(w, codeMissingField, "name", "name required")
+		return
+	}
+
+	user, err := loadUser(userID)
+	if err == errUserNotFound || (err == nil && user.GroupID != groupID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to load user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	if err := renameUser(user, name); err != nil {
+		if err == errUserExists {
+			writeError(w, http.StatusConflict, codeConflict, err.Error())
+			return
+		}
+		slog.Error("Failed to rename user", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+
+	slog.Info("User renamed", "id", user.ID, "from", user.Name, "to", name)
+	user.Name = name
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// renameUser changes the name of a user, and the user_name copied in their records
+func renameUser(user *User, name string) error {
+	nameKey := normalizeUserName(name)
+
+	var conflicts int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM users WHERE group_id = ? AND name_key = ? AND id <> ?
+	`, user.GroupID, nameKey, user.ID).Scan(&conflicts)
+	if err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return errUserExists
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET name = ?, name_key = ? WHERE id = ?`, name, nameKey, user.ID); err != nil {
+		return err
+	}
+	for _, table := range userTables {
+		if _, err := tx.Exec(`UPDATE `+table+` SET user_name = ? WHERE user_id = ?`, name, user.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
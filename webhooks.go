@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Outbound webhooks go through the webhook_outbox table: the request handler only
+// enqueues the payload, in the transaction saving the result, and a background worker
+// delivers it. Failed deliveries are retried with exponential backoff; after
+// max_attempts they become dead letters, listed and retried by the server admin.
+
+const (
+	webhookStatusPending   = "pending"
+	webhookStatusDelivered = "delivered"
+	webhookStatusDead      = "dead"
+
+	webhookPollInterval = 10 * time.Second
+	webhookBatchSize    = 20
+	webhookBackoffBase  = 30 * time.Second
+	webhookBackoffMax   = 6 * time.Hour
+	// Delivered payloads are kept this long, for troubleshooting
+	webhookRetention = 30 * 24 * time.Hour
+
+	eventResultSubmitted = "result.submitted"
+)
+
+// WebhookDelivery is a payload of the outbox
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	Event         string          `json:"event"`
+	URL           string          `json:"url"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt string          `json:"next_attempt_at,omitempty"`
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+	// secret signs the payload, empty for unsigned deliveries
+	secret string
+}
+
+// initWebhookTables creates the webhook_outbox table
+func initWebhookTables(tx *Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS webhook_outbox (
+			id ` + tx.autoIncrementID() + `,
+			event TEXT NOT NULL,
+			url TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP NOT NULL,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			delivered_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook_outbox table: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_webhook_outbox_due
+		ON webhook_outbox(status, next_attempt_at)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook_outbox index: %w", err)
+	}
+	return nil
+}
+
+// sheetsWebhookURL returns the Google Apps Script receiving the results, if any
+func sheetsWebhookURL() string {
+	if url := os.Getenv("SHEETS_WEBHOOK_URL"); url != "" {
+		return url
+	}
+	return config.WebhookConfig.SheetsURL
+}
+
+// sheetsResultDelivery returns the Google Sheets webhook payload of a result, nil
+// when no webhook is configured
+func sheetsResultDelivery(res resultRecord) (*WebhookDelivery, error) {
+	webhook := sheetsWebhookURL()
+	if webhook == "" {
+		return nil, nil
+	}
+
+	payload := sheetPayload{
+		Date:            time.Now().Format(time.RFC3339),
+		Name:            res.User.Name,
+		Score:           res.Score,
+		Total:           res.Total,
+		Tables:          res.Tables,
+		ExerciseType:    res.ExerciseType,
+		MeanTimeSeconds: res.MeanTimeSeconds,
+	}
+	buf, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return &WebhookDelivery{Event: eventResultSubmitted, URL: webhook, Payload: buf}, nil
+}
+
+// webhookWake asks the worker to deliver without waiting for the next poll
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookWorker() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWebhookWorker delivers the due webhooks until the process exits
+func runWebhookWorker() {
+	client := newWebhookClient(time.Duration(config.WebhookConfig.TimeoutSeconds) * time.Second)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+
+	for {
+		for deliverDueWebhooks(client) == webhookBatchSize {
+			// Full batch: more deliveries may be due
+		}
+		if time.Since(lastPrune) > time.Hour {
+			if n, err := store.PruneWebhooks(time.Now().Add(-webhookRetention)); err != nil {
+				slog.Error("Failed to prune delivered webhooks", "error", err)
+			} else if n > 0 {
+				slog.Info("Pruned delivered webhooks", "count", n)
+			}
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+// newWebhookClient returns the client of the deliveries. Its dialer checks the
+// address connected to, so that neither a host resolving to another address since
+// its subscription nor a redirect reaches the local network. Proxies are not used:
+// the check would apply to the proxy.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: controlWebhookDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// controlWebhookDial refuses the connections to addresses webhooks may not reach
+func controlWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+		return fmt.Errorf("webhook target %s is a private, loopback or link-local address", host)
+	}
+	return nil
+}
+
+// deliverDueWebhooks attempts one batch of due deliveries and returns its size
+func deliverDueWebhooks(client *http.Client) int {
+	now := time.Now()
+	due, err := store.DueWebhooks(now, webhookBatchSize)
+	if err != nil {
+		slog.Error("Failed to read webhook outbox", "error", err)
+		return 0
+	}
+
+	// A delivery is leased past its timeout, so that another instance sharing the
+	// database does not send it at the same time
+	lease := now.Add(2*client.Timeout + time.Minute)
+	for _, d := range due {
+		claimed, err := store.ClaimWebhook(d.ID, now, lease)
+		if err != nil {
+			slog.Error("Failed to claim webhook", "id", d.ID, "error", err)
+			continue
+		}
+		if claimed {
+			deliverWebhook(client, d)
+		}
+	}
+	return len(due)
+}
+
+// deliverWebhook sends a payload and records the outcome
+func deliverWebhook(client *http.Client, d WebhookDelivery) {
+	attempts := d.Attempts + 1
+	err := postWebhook(client, d)
+	if err == nil {
+		if err := store.WebhookDelivered(d.ID, attempts, time.Now()); err != nil {
+			slog.Error("Failed to mark webhook delivered", "id", d.ID, "error", err)
+		}
+		webhookDeliveriesTotal.WithLabelValues(d.Event, "delivered").Inc()
+		slog.Info("Webhook delivered", "id", d.ID, "event", d.Event, "attempts", attempts)
+		return
+	}
+
+	var next *time.Time
+	if attempts < config.WebhookConfig.MaxAttempts {
+		at := time.Now().Add(webhookBackoff(attempts))
+		next = &at
+		webhookDeliveriesTotal.WithLabelValues(d.Event, "retry").Inc()
+		slog.Warn("Webhook delivery failed, will retry", "id", d.ID, "event", d.Event, "attempts", attempts, "next_attempt_at", at, "error", err)
+	} else {
+		webhookDeliveriesTotal.WithLabelValues(d.Event, "dead").Inc()
+		slog.Error("Webhook delivery failed, moved to dead letters", "id", d.ID, "event", d.Event, "attempts", attempts, "error", err)
+	}
+	if err := store.WebhookFailed(d.ID, attempts, err.Error(), next); err != nil {
+		slog.Error("Failed to record webhook failure", "id", d.ID, "error", err)
+	}
+}
+
+// postWebhook posts a payload, signed when it has a secret, failing on transport
+// errors and non-2xx answers
+func postWebhook(client *http.Client, d WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	if d.secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, signWebhook(d.secret, timestamp, d.Payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookBackoff returns the delay before the next attempt: 30s, 1m, 2m, 4m...
+// up to 6h
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBackoffBase
+	for i := 1; i < attempts && delay < webhookBackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookBackoffMax)
+}
+
+// GET /api/webhooks/dead-letters?limit=N - Lists the webhooks that could not be delivered (server admin)
+func getDeadWebhooks(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		n, err := strconv.Atoi(limitParam)
+		if err != nil || n < 1 || n > 1000 {
+			writeFieldError(w, codeInvalidField, "limit", "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := store.DeadWebhooks(limit)
+	if err != nil {
+		slog.Error("Failed to query dead webhooks", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// POST /api/webhooks/dead-letters/{id}/retry - Queues a dead letter again (server admin)
+func retryDeadWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeFieldError(w, codeInvalidField, "id", "invalid webhook id")
+		return
+	}
+
+	requeued, err := store.RetryWebhook(id, time.Now())
+	if err != nil {
+		slog.Error("Failed to retry webhook", "error", err)
+		writeDatabaseError(w)
+		return
+	}
+	if !requeued {
+		writeError(w, http.StatusNotFound, codeNotFound, "dead letter not found")
+		return
+	}
+
+	slog.Info("Webhook queued again", "id", id)
+	wakeWebhookWorker()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}